@@ -0,0 +1,194 @@
+/*
+Command turnservicecli fetches credentials from a TURN service, for example
+to debug deployments or to use them in shell scripts.
+
+Usage:
+
+	turnservicecli fetch -uri URI -client-id ID (-access-token TOKEN | -hmac-secret SECRET) [-json]
+	turnservicecli probe -uri URI -client-id ID (-access-token TOKEN | -hmac-secret SECRET)
+
+The probe command allocates a relay on each TURN URN of the fetched
+credentials and reports the result and round trip time per URN. It exits with 1 if
+any allocation fails.
+
+The access token can also be set with the ACCESS_TOKEN environment variable.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli/probe"
+)
+
+const usage = `usage: turnservicecli <command> [flags]
+
+Commands:
+  fetch    fetch and print TURN credentials
+  probe    allocate a relay on each TURN server
+`
+
+// serviceFlags are the flags to connect to the TURN service.
+type serviceFlags struct {
+	uri         string
+	clientID    string
+	accessToken string
+	hmacSecret  string
+	timeout     time.Duration
+}
+
+func (f *serviceFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.uri, "uri", "", "base URI of the TURN service")
+	flags.StringVar(&f.clientID, "client-id", "", "client ID")
+	flags.StringVar(&f.accessToken, "access-token", os.Getenv("ACCESS_TOKEN"), "access token")
+	flags.StringVar(&f.hmacSecret, "hmac-secret", "", "secret to derive the access token from the client ID")
+	flags.DurationVar(&f.timeout, "timeout", 30*time.Second, "timeout of requests")
+}
+
+// service returns a TURNService for the flags.
+func (f *serviceFlags) service() (*turnservicecli.TURNService, error) {
+	if f.uri == "" {
+		return nil, fmt.Errorf("missing -uri")
+	}
+	accessToken := f.accessToken
+	if f.hmacSecret != "" {
+		accessToken = turnservicecli.ComputeAccessToken(f.hmacSecret, f.clientID)
+	}
+
+	service := turnservicecli.NewTURNService(f.uri, turnservicecli.WithFetchTimeout(f.timeout))
+	service.SetClientIDOnlyAuth(accessToken == "")
+	service.Open(accessToken, f.clientID, "")
+	return service, nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command of args and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "fetch":
+		return runFetch(args[1:], stdout, stderr)
+	case "probe":
+		return runProbe(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n%s", args[0], usage)
+		return 2
+	}
+}
+
+func runFetch(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var service serviceFlags
+	service.register(flags)
+	asJSON := flags.Bool("json", false, "print the credentials response as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	turnService, err := service.service()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer turnService.Close()
+
+	response, err := turnService.FetchCredentials()
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to fetch credentials: %s\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(response); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	turn := response.Turn
+	fmt.Fprintf(stdout, "username: %s\n", turn.Username)
+	fmt.Fprintf(stdout, "password: %s\n", turn.Password)
+	fmt.Fprintf(stdout, "ttl: %ds\n", turn.TTL)
+	for _, server := range turn.Servers {
+		fmt.Fprintf(stdout, "server %s (prio %d): %s\n", server.ID, server.Prio, strings.Join(server.URNs, " "))
+	}
+	return 0
+}
+
+func runProbe(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var service serviceFlags
+	service.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	turnService, err := service.service()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer turnService.Close()
+
+	response, err := turnService.FetchCredentials()
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to fetch credentials: %s\n", err)
+		return 1
+	}
+
+	// Only probe TURN URNs.
+	turn := *response.Turn
+	turn.Servers = nil
+	for _, server := range response.Turn.Servers {
+		s := *server
+		s.URNs = nil
+		for _, urn := range server.URNs {
+			if probe.IsTURN(urn) {
+				s.URNs = append(s.URNs, urn)
+			}
+		}
+		if len(s.URNs) > 0 {
+			turn.Servers = append(turn.Servers, &s)
+		}
+	}
+	if len(turn.Servers) == 0 {
+		fmt.Fprintln(stderr, "no TURN servers to probe")
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), service.timeout)
+	defer cancel()
+	code := 0
+	for _, result := range probe.Servers(ctx, &turn) {
+		if !result.Reachable() {
+			fmt.Fprintf(stdout, "fail %s (%s): %s\n", result.URN, result.ServerID, result.Err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "ok   %s (%s): relay %s, rtt %s\n", result.URN, result.ServerID, result.Relayed, result.RTT.Round(time.Millisecond))
+	}
+	return code
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli/probe"
+)
+
+func newTestServer() *turnservicecli.TestServer {
+	return turnservicecli.NewTestServer(&turnservicecli.CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "test", URNs: []string{"turn:turn.example.com:3478?transport=udp"}},
+		},
+	})
+}
+
+func TestRunFetch(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"fetch", "-uri", server.URL, "-client-id", "client", "-access-token", "token"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	for _, expected := range []string{"username: user\n", "password: password\n", "ttl: 3600s\n", "server test (prio 0): turn:turn.example.com:3478?transport=udp\n"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("output must contain %q, got %s", expected, out)
+		}
+	}
+
+	stdout.Reset()
+	if code := run([]string{"fetch", "-uri", server.URL, "-client-id", "client", "-hmac-secret", "secret", "-json"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s", code, stderr.String())
+	}
+	var response turnservicecli.CredentialsResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil || response.Turn == nil || response.Turn.Username != "user" {
+		t.Errorf("unexpected JSON output: %s (%v)", stdout.String(), err)
+	}
+	auth, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(server.Authorization(), "Bearer "))
+	if !strings.HasPrefix(string(auth), "h") || len(auth) != 66 {
+		t.Errorf("access token must be derived from the HMAC secret, got %q", auth)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	server.SetStatus(500)
+
+	var stdout, stderr bytes.Buffer
+	if code := run(nil, &stdout, &stderr); code != 2 {
+		t.Errorf("missing command must fail with 2, got %d", code)
+	}
+	if code := run([]string{"unknown"}, &stdout, &stderr); code != 2 {
+		t.Errorf("unknown command must fail with 2, got %d", code)
+	}
+	if code := run([]string{"fetch", "-client-id", "client"}, &stdout, &stderr); code != 2 {
+		t.Errorf("missing URI must fail with 2, got %d", code)
+	}
+	if code := run([]string{"fetch", "-uri", server.URL, "-client-id", "client", "-access-token", "token"}, &stdout, &stderr); code != 1 {
+		t.Errorf("failed fetch must fail with 1, got %d", code)
+	}
+}
+
+func TestRunProbe(t *testing.T) {
+	turnServer, err := probe.NewTestServer("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer turnServer.Close()
+
+	server := newTestServer()
+	defer server.Close()
+	// The scheme is case insensitive as in the probe package.
+	urn := "TURN:" + turnServer.Addr().String() + "?transport=udp"
+	server.SetTurn(&turnservicecli.CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "test", URNs: []string{urn, "stun:" + turnServer.Addr().String()}},
+		},
+	})
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"probe", "-uri", server.URL, "-client-id", "client", "-access-token", "token"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("unexpected exit code %d: %s %s", code, stdout.String(), stderr.String())
+	}
+	if expected := "ok   " + urn + " (test): relay " + turnServer.Addr().String() + ", rtt "; !strings.HasPrefix(stdout.String(), expected) {
+		t.Errorf("output must start with %q, got %s", expected, stdout.String())
+	}
+	if strings.Count(stdout.String(), "\n") != 1 {
+		t.Errorf("only TURN URNs must be probed, got %s", stdout.String())
+	}
+
+	server.SetTurn(&turnservicecli.CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "wrong",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "test", URNs: []string{urn}},
+		},
+	})
+	stdout.Reset()
+	if code := run([]string{"probe", "-uri", server.URL, "-client-id", "client", "-access-token", "token"}, &stdout, &stderr); code != 1 {
+		t.Errorf("failed allocation must fail with 1, got %d", code)
+	}
+	if expected := "fail " + urn + " (test): allocate failed: 401 Unauthorized\n"; stdout.String() != expected {
+		t.Errorf("expected %q, got %q", expected, stdout.String())
+	}
+}
@@ -6,6 +6,24 @@ It contains the following packages:
 
 The `turnservicecli` package provides a client implementation for the TURN
 service api's endpoints.
+
+The `turnservicecli/probe` package measures the reachability and round trip
+time of the STUN and TURN servers of credentials.
+
+The `turnservicepion` package converts credentials into ICE servers of
+pion/webrtc, it is only built with the `pion` build tag.
+
+The `turnserviceprom` package exports the metrics of a TURN service client as
+a Prometheus collector, it is only built with the `prometheus` build tag.
+
+The `turnserviceotel` package traces requests of a TURN service client with
+OpenTelemetry, it is only built with the `otel` build tag.
+
+The `turnservicemsgpack` package decodes msgpack responses of the TURN service,
+it is only built with the `msgpack` build tag.
+
+The `cmd/turnservicecli` command fetches credentials from a TURN service on
+the command line and probes the returned TURN servers.
 */
 package spreedturnservicecli
 
@@ -0,0 +1,79 @@
+package turnservicecli
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultRefreshBackoffBase = 5 * time.Second
+	defaultRefreshBackoffMax  = 5 * time.Minute
+
+	// Add up to this fraction of the delay as jitter to retries.
+	retryJitterFraction = 0.2
+)
+
+// backoffDelay returns the exponential backoff delay after the given number
+// of consecutive failures, starting at base and capped at max.
+func backoffDelay(base, max time.Duration, failures int) time.Duration {
+	if failures <= 0 || base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if max > 0 && delay >= max {
+			return max
+		}
+	}
+	if max > 0 && delay > max {
+		return max
+	}
+	return delay
+}
+
+// SetRetryPolicy sets how often fetches of credentials are attempted when
+// they fail with a transport error or a server error of all endpoints. The
+// delay between attempts starts at base and doubles with each attempt, with
+// some random jitter added. Forbidden responses and nonce mismatches are
+// never retried. A maxAttempts of one or less disables retries, which is the
+// default.
+func (service *TURNService) SetRetryPolicy(maxAttempts int, base time.Duration) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	service.Lock()
+	defer service.Unlock()
+	service.retryMaxAttempts = maxAttempts
+	service.retryBase = base
+}
+
+// retry calls f until it succeeds, fails with an error which must not be
+// retried or the attempts of the retry policy are exhausted.
+func (service *TURNService) retry(ctx context.Context, f func() error) error {
+	service.RLock()
+	maxAttempts := service.retryMaxAttempts
+	base := service.retryBase
+	random := service.random
+	service.RUnlock()
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= maxAttempts || ctx.Err() != nil || !isFailoverError(err) {
+			return err
+		}
+
+		delay := backoffDelay(base, 0, attempt)
+		if j, jitterErr := jitter(random, delay, retryJitterFraction); jitterErr == nil {
+			delay += j
+		}
+		service.logger.Printf("turnservicecli: fetch failed, retrying in %s: %s", delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -1,10 +1,19 @@
 package turnservicecli
 
 import (
+	"context"
+	"io"
+	"math"
 	"sync"
 	"time"
 )
 
+const (
+	// DefaultMaxCredentialsTTL is the default maximum time after which cached
+	// credentials expire, regardless of their TTL.
+	DefaultMaxCredentialsTTL = 24 * time.Hour
+)
+
 // CachedCredentialsData combine CredentialsData with a expiration timer.
 type CachedCredentialsData struct {
 	sync.RWMutex
@@ -15,25 +24,61 @@ type CachedCredentialsData struct {
 
 	closed bool
 	quit   chan bool
+	done   chan bool
+
+	expiry    time.Duration
+	expiresAt time.Time
+	// expiresAt by wall clock, the timer is late when the monotonic clock
+	// stops, for example while the system sleeps.
+	expiresWall time.Time
+	clamped     bool
+	clock       Clock
 }
 
 // NewCachedCredentialsData add expiration timer with a percentile to CredentialsData.
+// The expiration timer is limited to DefaultMaxCredentialsTTL.
 func NewCachedCredentialsData(turn *CredentialsData, expirationPercentile uint) *CachedCredentialsData {
+	return newCachedCredentialsData(turn, expirationPercentile, DefaultMaxCredentialsTTL, systemClock{}, 0, nil)
+}
+
+// newCachedCredentialsData is like NewCachedCredentialsData, the expiration
+// timer is limited to maxTTL and randomly shortened by up to jitterFraction.
+func newCachedCredentialsData(turn *CredentialsData, expirationPercentile uint, maxTTL time.Duration, clock Clock, jitterFraction float64, random io.Reader) *CachedCredentialsData {
 	c := &CachedCredentialsData{
 		Turn:    turn,
-		expires: time.Now().Unix() + turn.TTL,
+		expires: clock.Now().Unix() + turn.TTL,
 		quit:    make(chan bool),
+		done:    make(chan bool),
+		clock:   clock,
+	}
+
+	// Compare in seconds, enormous TTLs would overflow time.Duration.
+	expiry := turn.TTL * int64(expirationPercentile) / 100
+	if maxTTL > 0 && expiry > int64(maxTTL/time.Second) {
+		c.expiry = maxTTL
+		c.clamped = true
+	} else {
+		c.expiry = time.Duration(expiry) * time.Second
 	}
+	if j, err := jitter(random, c.expiry, jitterFraction); err == nil {
+		// Expire early, never after the percentile.
+		c.expiry -= j
+	}
+	c.expiresAt = time.Now().Add(c.expiry)
+	c.expiresWall = clock.Now().Add(c.expiry)
 
 	go func() {
-		expiry := turn.TTL * int64(expirationPercentile) / 100
+		// Stop the timer on close, so it is released immediately.
+		timer := time.NewTimer(c.expiry)
+		defer timer.Stop()
 		select {
 		case <-c.quit:
-		case <-time.After(time.Duration(expiry) * time.Second):
+		case <-timer.C:
 		}
 		c.Lock()
 		defer c.Unlock()
 		c.expired = true
+		close(c.done)
 	}()
 
 	return c
@@ -41,18 +86,158 @@ func NewCachedCredentialsData(turn *CredentialsData, expirationPercentile uint)
 
 // Expired returns if the cached CredentialsData has expired.
 func (c *CachedCredentialsData) Expired() bool {
+	now := c.clock.Now()
+	c.RLock()
+	expired := c.expired || c.closed
+	late := !expired && !now.Before(c.expiresWall)
+	c.RUnlock()
+	if late {
+		// The wall clock jumped past the expiry before the timer fired.
+		c.expire()
+	}
+	return expired || late
+}
+
+// Context returns a copy of parent which is cancelled when the cached
+// CredentialsData expires or is closed, or when the parent is cancelled.
+func (c *CachedCredentialsData) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// ExpiresAt returns the time when the TTL of the cached CredentialsData
+// passes. Expired reports true before, when the expiration percentile of the
+// TTL has passed.
+func (c *CachedCredentialsData) ExpiresAt() time.Time {
+	c.RLock()
+	defer c.RUnlock()
+	return time.Unix(c.expires, 0)
+}
+
+// Remaining returns the remaining time until ExpiresAt, zero if that has
+// passed or the cached CredentialsData is closed.
+func (c *CachedCredentialsData) Remaining() time.Duration {
+	now := c.clock.Now()
 	c.RLock()
 	defer c.RUnlock()
-	return c.expired || c.closed
+	switch ttl := c.remaining(now); {
+	case ttl <= 0:
+		return 0
+	case ttl > int64(math.MaxInt64/time.Second):
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Unix(c.expires, 0).Sub(now)
 }
 
-// TTL returns the remaining TTL in seconds of the cached CredentialsData.
+// TTL returns the remaining TTL in seconds of the cached CredentialsData, zero
+// if it has passed or the cached CredentialsData is closed.
 func (c *CachedCredentialsData) TTL() int64 {
-	ttl := c.expires - time.Now().Unix()
-	if ttl < 0 {
+	now := c.clock.Now()
+	c.RLock()
+	defer c.RUnlock()
+	if ttl := c.remaining(now); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// remaining returns the remaining TTL in seconds at now, the lock must be
+// held. Seconds are used as enormous TTLs would overflow time.Duration.
+func (c *CachedCredentialsData) remaining(now time.Time) int64 {
+	if c.closed {
 		return 0
 	}
-	return ttl
+	return c.expires - now.Unix()
+}
+
+// CountdownChan returns a channel which receives the remaining TTL in seconds
+// of the cached CredentialsData at the given interval, and a function to stop
+// the countdown. The channel is closed when the countdown is stopped, the TTL
+// reaches zero or the cached CredentialsData expires. The interval ticks on
+// the Clock of the TURNService if it is a TickerClock.
+func (c *CachedCredentialsData) CountdownChan(interval time.Duration) (<-chan int64, func()) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ch := make(chan int64, 1)
+	stop := make(chan bool)
+	var once sync.Once
+	ticks, stopTicker := newTicker(c.clock, interval)
+	go func() {
+		defer close(ch)
+		defer stopTicker()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-c.done:
+				return
+			case <-ticks:
+			}
+
+			ttl := c.TTL()
+			select {
+			case ch <- ttl:
+			case <-stop:
+				return
+			case <-c.done:
+				return
+			}
+			if ttl == 0 {
+				return
+			}
+		}
+	}()
+
+	return ch, func() {
+		once.Do(func() {
+			close(stop)
+		})
+	}
+}
+
+// expiringIn returns the duration until lead before the cached
+// CredentialsData expires, zero if that has passed. The lead is clamped to
+// the expiry.
+func (c *CachedCredentialsData) expiringIn(lead time.Duration) time.Duration {
+	if lead > c.expiry {
+		lead = c.expiry
+	}
+	if d := time.Until(c.expiresAt.Add(-lead)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// usableStale returns if the cached CredentialsData has expired at its
+// percentile no longer than grace ago, but its TTL has not passed and it has
+// not been closed or expired early.
+func (c *CachedCredentialsData) usableStale(grace time.Duration) bool {
+	now := c.clock.Now()
+	c.RLock()
+	defer c.RUnlock()
+	if !c.expired || c.remaining(now) <= 0 {
+		return false
+	}
+	since := time.Since(c.expiresAt)
+	return since >= 0 && since <= grace
+}
+
+func (c *CachedCredentialsData) expire() {
+	c.Lock()
+	defer c.Unlock()
+	if !c.expired && !c.closed {
+		close(c.quit)
+	}
+	c.expired = true
 }
 
 // Close closes the cached CredentialsData and expires it if not already expired.
@@ -0,0 +1,168 @@
+package turnservicecli
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCachedCredentialsDataContext(t *testing.T) {
+	turn := NewCachedCredentialsData(&CredentialsData{TTL: 2}, 50)
+	defer turn.Close()
+
+	ctx, cancel := turn.Context(context.Background())
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context must not be done before expiry")
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("context must be done after expiry")
+	}
+	if !turn.Expired() {
+		t.Error("turn must be expired when context is done")
+	}
+}
+
+func TestCachedCredentialsDataContextParent(t *testing.T) {
+	turn := NewCachedCredentialsData(&CredentialsData{TTL: 3600}, 80)
+	defer turn.Close()
+
+	parent, parentCancel := context.WithCancel(context.Background())
+	ctx, cancel := turn.Context(parent)
+	defer cancel()
+
+	parentCancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context must be done when parent is cancelled")
+	}
+	if turn.Expired() {
+		t.Error("turn must not be expired")
+	}
+}
+
+func TestCachedCredentialsDataCountdownChan(t *testing.T) {
+	clock := &fakeClock{now: time.Now().Round(0)}
+	turn := newCachedCredentialsData(&CredentialsData{TTL: 60}, 100, DefaultMaxCredentialsTTL, clock, 0, nil)
+	defer turn.Close()
+
+	ch, cancel := turn.CountdownChan(20 * time.Second)
+	defer cancel()
+
+	select {
+	case ttl := <-ch:
+		t.Fatalf("countdown must not tick before the clock advances, got %d", ttl)
+	case <-time.After(10 * time.Millisecond):
+	}
+	for _, expected := range []int64{40, 20} {
+		clock.Advance(20 * time.Second)
+		select {
+		case ttl := <-ch:
+			if ttl != expected {
+				t.Errorf("expected TTL %d, got %d", expected, ttl)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("countdown must tick")
+		}
+	}
+
+	// The TTL reaches zero and the countdown stops.
+	clock.Advance(20 * time.Second)
+	for ttl := range ch {
+		if ttl != 0 {
+			t.Errorf("expected TTL of zero, got %d", ttl)
+		}
+	}
+}
+
+func TestCachedCredentialsDataCountdownChanCancel(t *testing.T) {
+	turn := NewCachedCredentialsData(&CredentialsData{TTL: 3600}, 80)
+	defer turn.Close()
+
+	ch, cancel := turn.CountdownChan(10 * time.Millisecond)
+	if ttl := <-ch; ttl <= 0 {
+		t.Errorf("expected positive TTL, got %d", ttl)
+	}
+	cancel()
+	cancel()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("channel must be closed after cancel")
+		}
+	}
+}
+
+func TestCachedCredentialsDataCloseTwice(t *testing.T) {
+	turn := NewCachedCredentialsData(&CredentialsData{TTL: 3600}, 80)
+	turn.Close()
+	turn.Close()
+	if !turn.Expired() {
+		t.Error("turn must be expired after Close")
+	}
+
+	turn = NewCachedCredentialsData(&CredentialsData{TTL: 3600}, 80)
+	turn.expire()
+	turn.Close()
+	turn.expire()
+	if !turn.Expired() {
+		t.Error("turn must be expired after expire and Close")
+	}
+}
+
+func TestCachedCredentialsDataRemaining(t *testing.T) {
+	start := time.Now()
+	turn := NewCachedCredentialsData(&CredentialsData{TTL: 3600}, 80)
+
+	expiresAt := turn.ExpiresAt()
+	if expiresAt.Before(start.Add(3599*time.Second)) || expiresAt.After(start.Add(3601*time.Second)) {
+		t.Errorf("unexpected expiry time %s", expiresAt)
+	}
+	if remaining := turn.Remaining(); remaining <= 3590*time.Second || remaining > 3600*time.Second {
+		t.Errorf("unexpected remaining time %s", remaining)
+	}
+	if ttl := turn.TTL(); ttl < 3590 || ttl > 3600 {
+		t.Errorf("unexpected TTL %d", ttl)
+	}
+
+	// Safe to use concurrently with Close.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			turn.Remaining()
+			turn.TTL()
+		}
+	}()
+	turn.Close()
+	<-done
+
+	if remaining := turn.Remaining(); remaining != 0 {
+		t.Errorf("remaining time must be zero after Close, got %s", remaining)
+	}
+	if ttl := turn.TTL(); ttl != 0 {
+		t.Errorf("TTL must be zero after Close, got %d", ttl)
+	}
+	if !turn.ExpiresAt().Equal(expiresAt) {
+		t.Error("expiry time must not change after Close")
+	}
+
+	passed := NewCachedCredentialsData(&CredentialsData{TTL: 0}, 80)
+	defer passed.Close()
+	if remaining := passed.Remaining(); remaining != 0 {
+		t.Errorf("remaining time must be zero after the TTL passed, got %s", remaining)
+	}
+}
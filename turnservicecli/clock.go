@@ -0,0 +1,67 @@
+package turnservicecli
+
+import (
+	"time"
+)
+
+const (
+	// Treat differences between elapsed wall clock and monotonic time larger
+	// than this as a clock jump, for example after the system resumed from
+	// sleep.
+	clockJumpThreshold = 30 * time.Second
+)
+
+// A Clock provides the current wall clock time.
+type Clock interface {
+	Now() time.Time
+}
+
+// A TickerClock is a Clock which also provides tickers, for example a fake
+// clock to drive CachedCredentialsData.CountdownChan in tests.
+type TickerClock interface {
+	Clock
+	// NewTicker returns a channel which receives the time at every interval
+	// d, and a function to stop the ticker.
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+// newTicker returns a ticker of clock if it is a TickerClock, otherwise a
+// ticker of the system.
+func newTicker(clock Clock, d time.Duration) (<-chan time.Time, func()) {
+	if clock, ok := clock.(TickerClock); ok {
+		return clock.NewTicker(d)
+	}
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+type systemClock struct{}
+
+func (clock systemClock) Now() time.Time {
+	// Strip the monotonic clock reading, so only wall clock time is used.
+	return time.Now().Round(0)
+}
+
+// clockJumpDetector detects jumps of a wall clock compared to the monotonic
+// clock.
+type clockJumpDetector struct {
+	wall      time.Time
+	monotonic time.Time
+}
+
+// check returns if wall clock time has jumped since the last check. The
+// first check never reports a jump.
+func (d *clockJumpDetector) check(clock Clock) bool {
+	wall := clock.Now()
+	monotonic := time.Now()
+	defer func() {
+		d.wall = wall
+		d.monotonic = monotonic
+	}()
+	if d.monotonic.IsZero() {
+		return false
+	}
+
+	drift := wall.Sub(d.wall) - monotonic.Sub(d.monotonic)
+	return drift > clockJumpThreshold || drift < -clockJumpThreshold
+}
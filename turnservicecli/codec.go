@@ -0,0 +1,30 @@
+package turnservicecli
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// A ResponseCodec decodes the responses of the remote service. The content
+// type of the codec is sent as Accept header with every request, so the
+// service can respond in a matching format.
+type ResponseCodec interface {
+	// ContentType returns the media type decoded by the codec.
+	ContentType() string
+	// Decode decodes the response body from r into v.
+	Decode(r io.Reader, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (codec jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (codec jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// JSONCodec is the ResponseCodec for JSON responses. It is the default, the
+// turnservicemsgpack package provides a codec for msgpack responses.
+var JSONCodec ResponseCodec = jsonCodec{}
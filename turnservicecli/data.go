@@ -1,25 +1,101 @@
 package turnservicecli
 
 import (
+	"fmt"
+	"net"
+	"sort"
 	"time"
 )
 
-// CredentialsResponse defines a REST response containing TURN data.
+// CredentialsResponse defines a REST response containing TURN data. The
+// optional Cacheable hint is set to false by services whose credentials must
+// not be cached.
 type CredentialsResponse struct {
-	Success bool             `json:"success"`
-	Nonce   string           `json:"nonce"`
-	Expires *time.Time       `json:"expires,omitempty"`
-	Turn    *CredentialsData `json:"turn"`
-	Session string           `json:"session,omitempty"`
+	Success   bool             `json:"success"`
+	Nonce     string           `json:"nonce"`
+	Expires   *time.Time       `json:"expires,omitempty"`
+	Turn      *CredentialsData `json:"turn"`
+	Session   string           `json:"session,omitempty"`
+	Cacheable *bool            `json:"cacheable,omitempty"`
 }
 
-// CredentialsData defines TURN credentials with servers.
+// CredentialsData defines TURN credentials with servers. Protocols optionally
+// contains distinct credentials keyed by transport, see CredentialsFor.
 type CredentialsData struct {
-	TTL      int64         `json:"ttl"`
-	Username string        `json:"username"`
-	Password string        `json:"password"`
-	Servers  []*URNsWithID `json:"servers,omitempty"`
-	GeoURI   string        `json:"geo_uri,omitempty"`
+	TTL       int64                           `json:"ttl"`
+	Username  string                          `json:"username"`
+	Password  string                          `json:"password"`
+	Servers   []*URNsWithID                   `json:"servers,omitempty"`
+	GeoURI    string                          `json:"geo_uri,omitempty"`
+	Protocols map[string]*ProtocolCredentials `json:"protocols,omitempty"`
+
+	// ForceRelay makes RecommendedTransportPolicy always recommend relay
+	// only, it is not part of the API response.
+	ForceRelay bool `json:"-"`
+}
+
+// Validate checks that the CredentialsData can be used to connect, with a
+// username, a password and at least one server URN. The returned error wraps
+// ErrInvalidCredentials.
+func (data *CredentialsData) Validate() error {
+	switch {
+	case data.Username == "":
+		return fmt.Errorf("%w: missing username", ErrInvalidCredentials)
+	case data.Password == "":
+		return fmt.Errorf("%w: missing password", ErrInvalidCredentials)
+	}
+	for _, server := range data.Servers {
+		if len(server.URNs) > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no servers", ErrInvalidCredentials)
+}
+
+// ProtocolCredentials defines TURN credentials for a single transport.
+type ProtocolCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CredentialsFor returns the username and password to use for the relay urn.
+// Credentials for the transport of urn (see TransportUDP and TransportTCP)
+// are returned if available, otherwise the shared Username and Password.
+func (data *CredentialsData) CredentialsFor(urn string) (username, password string) {
+	if credentials, ok := data.Protocols[urnTransport(urn)]; ok && credentials != nil {
+		return credentials.Username, credentials.Password
+	}
+	return data.Username, data.Password
+}
+
+// ICE transport policies as used in the WebRTC RTCConfiguration.
+const (
+	TransportPolicyAll   = "all"
+	TransportPolicyRelay = "relay"
+)
+
+// RecommendedTransportPolicy returns the ICE transport policy implied by the
+// servers of the CredentialsData. TransportPolicyRelay is returned when only
+// TURN relays and no STUN servers are provided or when ForceRelay is set,
+// otherwise TransportPolicyAll.
+func (data *CredentialsData) RecommendedTransportPolicy() string {
+	if data.ForceRelay {
+		return TransportPolicyRelay
+	}
+
+	relays := false
+	for _, server := range data.Servers {
+		for _, urn := range server.URNs {
+			if !isRelayURN(urn) {
+				return TransportPolicyAll
+			}
+			relays = true
+		}
+	}
+	if relays {
+		return TransportPolicyRelay
+	}
+	return TransportPolicyAll
 }
 
 // URNsWithID defines TURN servers groups with ID.
@@ -31,6 +107,307 @@ type URNsWithID struct {
 	I18N  map[string]string `json:"i18n,omitempty"`
 }
 
+// BestServer returns the server group with the lowest Prio, the first one
+// if several groups share the lowest Prio. False is returned if there are no
+// server groups.
+func (data *CredentialsData) BestServer() (*URNsWithID, bool) {
+	var best *URNsWithID
+	for _, server := range data.Servers {
+		if best == nil || server.Prio < best.Prio {
+			best = server
+		}
+	}
+	return best, best != nil
+}
+
+// BestServerWithGeo is like BestServer, but returns the server group with the
+// lowest Prio of the groups listed earliest in geo. BestServer is used if
+// none of the groups are listed in geo or geo is nil.
+func (data *CredentialsData) BestServerWithGeo(geo *GeoData) (*URNsWithID, bool) {
+	if geo != nil {
+		for _, id := range geo.Prefer {
+			var best *URNsWithID
+			for _, server := range data.Servers {
+				if server.ID == id && (best == nil || server.Prio < best.Prio) {
+					best = server
+				}
+			}
+			if best != nil {
+				return best, true
+			}
+		}
+	}
+	return data.BestServer()
+}
+
+// OrderedServers returns the server groups sorted by the preferred order of
+// IDs in geo, followed by the groups not listed in geo. Groups with the same
+// preference are sorted by descending Prio, ties keep their original order.
+// A nil geo sorts by Prio only.
+func (data *CredentialsData) OrderedServers(geo *GeoData) []*URNsWithID {
+	rank := make(map[string]int)
+	unranked := 0
+	if geo != nil {
+		unranked = len(geo.Prefer)
+		for i, id := range geo.Prefer {
+			if _, ok := rank[id]; !ok {
+				rank[id] = i
+			}
+		}
+	}
+	preference := func(server *URNsWithID) int {
+		if r, ok := rank[server.ID]; ok {
+			return r
+		}
+		return unranked
+	}
+
+	servers := append([]*URNsWithID(nil), data.Servers...)
+	sort.SliceStable(servers, func(i, j int) bool {
+		pi, pj := preference(servers[i]), preference(servers[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return servers[i].Prio > servers[j].Prio
+	})
+	return servers
+}
+
+// SortServers sorts servers in place by descending Prio, servers with the
+// same Prio keep their order. This is the order of OrderedServers without
+// geo.
+func SortServers(servers []*URNsWithID) {
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].Prio > servers[j].Prio
+	})
+}
+
+// GroupedServers returns the server groups with groups of the same ID
+// merged into one, in the order of the first group of each ID. A merged
+// group has the URNs of all its groups and the highest Prio of them, the
+// other fields of the first group. Groups with a single ID are returned as
+// is, they must not be modified.
+func (data *CredentialsData) GroupedServers() []*URNsWithID {
+	var servers []*URNsWithID
+	index := make(map[string]int)
+	merged := make(map[string]bool)
+	for _, server := range data.Servers {
+		i, ok := index[server.ID]
+		if !ok {
+			index[server.ID] = len(servers)
+			servers = append(servers, server)
+			continue
+		}
+		if !merged[server.ID] {
+			// Copy before merging into the first group.
+			group := *servers[i]
+			group.URNs = append([]string(nil), group.URNs...)
+			servers[i] = &group
+			merged[server.ID] = true
+		}
+		group := servers[i]
+		group.URNs = append(group.URNs, server.URNs...)
+		if server.Prio > group.Prio {
+			group.Prio = server.Prio
+		}
+	}
+	return servers
+}
+
+// RelaysWithoutTransport returns the relay URNs without an explicit
+// transport parameter, which are likely to default to UDP.
+func (data *CredentialsData) RelaysWithoutTransport() []string {
+	var urns []string
+	for _, server := range data.Servers {
+		for _, urn := range server.URNs {
+			if isRelayURN(urn) && urnParameter(urn, "transport") == "" {
+				urns = append(urns, urn)
+			}
+		}
+	}
+	return urns
+}
+
+// NormalizePorts adds the default port of their scheme to all URNs without an
+// explicit port, 3478 for stun and turn and 5349 for stuns and turns.
+func (data *CredentialsData) NormalizePorts() {
+	data.NormalizePortsWith(defaultURNPorts)
+}
+
+// NormalizePortsWith adds the port of their scheme in ports to all URNs
+// without an explicit port. URNs with schemes not in ports are not changed.
+func (data *CredentialsData) NormalizePortsWith(ports map[string]int) {
+	for _, server := range data.Servers {
+		for i, urn := range server.URNs {
+			if port, ok := ports[urnScheme(urn)]; ok {
+				server.URNs[i] = urnWithDefaultPort(urn, port)
+			}
+		}
+	}
+}
+
+// LimitURNsPerServer returns a copy of the CredentialsData with at most n
+// URNs per server group, preferring URNs with UDP over TCP transport. URNs
+// with the same transport keep their order. A n of zero or less keeps all
+// URNs.
+func (data *CredentialsData) LimitURNsPerServer(n int) *CredentialsData {
+	return data.LimitURNsPerServerWith(n, defaultTransportOrder)
+}
+
+// LimitURNsPerServerWith is like LimitURNsPerServer but prefers transports in
+// the given order. URNs with transports not in order come last.
+func (data *CredentialsData) LimitURNsPerServerWith(n int, order []string) *CredentialsData {
+	rank := make(map[string]int)
+	for i, transport := range order {
+		if _, ok := rank[transport]; !ok {
+			rank[transport] = i
+		}
+	}
+	preference := func(urn string) int {
+		if r, ok := rank[urnTransport(urn)]; ok {
+			return r
+		}
+		return len(order)
+	}
+
+	servers := make([]*URNsWithID, 0, len(data.Servers))
+	for _, server := range data.Servers {
+		s := *server
+		s.URNs = append([]string(nil), server.URNs...)
+		sort.SliceStable(s.URNs, func(i, j int) bool {
+			return preference(s.URNs[i]) < preference(s.URNs[j])
+		})
+		if n > 0 && len(s.URNs) > n {
+			s.URNs = s.URNs[:n]
+		}
+		servers = append(servers, &s)
+	}
+	return data.withServers(servers)
+}
+
+// withServers returns a copy of the CredentialsData with servers.
+func (data *CredentialsData) withServers(servers []*URNsWithID) *CredentialsData {
+	c := *data
+	c.Servers = servers
+	return &c
+}
+
+// filterURNs returns a copy of the CredentialsData with only the URNs for
+// which keep returns true. Server groups without remaining URNs are removed.
+func (data *CredentialsData) filterURNs(keep func(urn string) bool) *CredentialsData {
+	var servers []*URNsWithID
+	for _, server := range data.Servers {
+		var urns []string
+		for _, urn := range server.URNs {
+			if keep(urn) {
+				urns = append(urns, urn)
+			}
+		}
+		if len(urns) == 0 {
+			continue
+		}
+		s := *server
+		s.URNs = urns
+		servers = append(servers, &s)
+	}
+	return data.withServers(servers)
+}
+
+// A Filter selects URNs by transport, see CredentialsData.Filter.
+type Filter uint
+
+// Filters of URNs, which can be combined.
+const (
+	// FilterUDP selects URNs with UDP transport, including turns: and
+	// stuns: URNs over DTLS.
+	FilterUDP Filter = 1 << iota
+	// FilterTCP selects turn: and stun: URNs with TCP transport.
+	FilterTCP
+	// FilterTLS selects turns: and stuns: URNs with TCP transport.
+	FilterTLS
+)
+
+// urnFilter returns the Filter which selects urn.
+func urnFilter(urn string) Filter {
+	if urnTransport(urn) != TransportTCP {
+		return FilterUDP
+	}
+	switch urnScheme(urn) {
+	case schemeTURNS, schemeSTUNS:
+		return FilterTLS
+	}
+	return FilterTCP
+}
+
+// Filter returns a copy of the CredentialsData with only the URNs selected
+// by filter, for example FilterTCP|FilterTLS for clients which cannot use
+// UDP. Server groups without remaining URNs are removed.
+func (data *CredentialsData) Filter(filter Filter) *CredentialsData {
+	return data.filterURNs(func(urn string) bool {
+		return urnFilter(urn)&filter != 0
+	})
+}
+
+// FilterByCIDR returns a copy of the CredentialsData with only the URNs whose
+// host has at least one IP address in the allowed networks. Host names are
+// resolved with resolver, URNs which fail to resolve are removed. Server
+// groups without remaining URNs are removed.
+func (data *CredentialsData) FilterByCIDR(allowed []*net.IPNet, resolver func(host string) ([]net.IP, error)) *CredentialsData {
+	return data.filterURNs(func(urn string) bool {
+		host, _ := urnHostPort(urn)
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			var err error
+			if ips, err = resolver(host); err != nil {
+				return false
+			}
+		}
+		for _, ip := range ips {
+			for _, network := range allowed {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// ScoredServer defines a TURN server group with an estimated score.
+type ScoredServer struct {
+	Server *URNsWithID
+	Score  float64
+}
+
+// ScoreServers annotates the server groups with a score estimated by oracle,
+// for example the expected latency of an URN. The score of a group is the
+// lowest score of its URNs, groups are returned sorted by ascending score.
+// Groups without URNs are omitted.
+func (data *CredentialsData) ScoreServers(oracle func(urn string) float64) []ScoredServer {
+	var scored []ScoredServer
+	for _, server := range data.Servers {
+		if len(server.URNs) == 0 {
+			continue
+		}
+		score := oracle(server.URNs[0])
+		for _, urn := range server.URNs[1:] {
+			if s := oracle(urn); s < score {
+				score = s
+			}
+		}
+		scored = append(scored, ScoredServer{
+			Server: server,
+			Score:  score,
+		})
+	}
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Score < scored[j].Score
+	})
+	return scored
+}
+
 // GeoResponse defines a REST response containing TURN geo.
 type GeoResponse struct {
 	Success bool     `json:"success"`
@@ -41,4 +418,5 @@ type GeoResponse struct {
 // GeoData defines ordered TURN IDs.
 type GeoData struct {
 	Prefer []string `json:"prefer"`
+	TTL    int64    `json:"ttl,omitempty"`
 }
@@ -0,0 +1,696 @@
+package turnservicecli
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsDataRecommendedTransportPolicy(t *testing.T) {
+	testcases := []struct {
+		name       string
+		urns       []string
+		forceRelay bool
+		expected   string
+	}{
+		{"empty", nil, false, TransportPolicyAll},
+		{"relay only", []string{"turn:relay.example.com:3478", "turns:relay.example.com:5349"}, false, TransportPolicyRelay},
+		{"mixed", []string{"stun:stun.example.com:3478", "turn:relay.example.com:3478"}, false, TransportPolicyAll},
+		{"stun only", []string{"stun:stun.example.com:3478"}, false, TransportPolicyAll},
+		{"forced", []string{"stun:stun.example.com:3478"}, true, TransportPolicyRelay},
+	}
+
+	for _, testcase := range testcases {
+		data := &CredentialsData{
+			Servers: []*URNsWithID{
+				&URNsWithID{ID: "test", URNs: testcase.urns},
+			},
+			ForceRelay: testcase.forceRelay,
+		}
+		if policy := data.RecommendedTransportPolicy(); policy != testcase.expected {
+			t.Errorf("%s: expected %s, got %s", testcase.name, testcase.expected, policy)
+		}
+	}
+}
+
+func TestCredentialsDataSignJWT(t *testing.T) {
+	secret := []byte("secret")
+	signer := func(data []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	}
+
+	data := &CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "test", URNs: []string{"turn:relay.example.com:3478"}},
+		},
+	}
+	token, err := data.SignJWT(signer, map[string]interface{}{
+		"sub": "client",
+		"exp": 1234,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT must have three parts: %s", token)
+	}
+
+	expectedSignature, _ := signer([]byte(parts[0] + "." + parts[1]))
+	if parts[2] != base64.RawURLEncoding.EncodeToString(expectedSignature) {
+		t.Errorf("invalid signature: %s", parts[2])
+	}
+
+	var header map[string]string
+	decoded, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if err := json.Unmarshal(decoded, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header["alg"] != JWTAlgorithmHS256 || header["typ"] != "JWT" {
+		t.Errorf("unexpected header: %v", header)
+	}
+
+	var claims struct {
+		Sub  string           `json:"sub"`
+		Exp  int64            `json:"exp"`
+		Iat  int64            `json:"iat"`
+		Turn *CredentialsData `json:"turn"`
+	}
+	decoded, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(decoded, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sub != "client" || claims.Exp != 1234 || claims.Iat == 0 {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if claims.Turn == nil || claims.Turn.Username != "user" || claims.Turn.Password != "password" || len(claims.Turn.Servers) != 1 {
+		t.Errorf("unexpected turn claim: %+v", claims.Turn)
+	}
+}
+
+func TestCredentialsDataCredentialsFor(t *testing.T) {
+	var single CredentialsData
+	if err := json.Unmarshal([]byte(`{"ttl":3600,"username":"user","password":"password"}`), &single); err != nil {
+		t.Fatal(err)
+	}
+	var multi CredentialsData
+	if err := json.Unmarshal([]byte(`{"ttl":3600,"username":"user","password":"password","protocols":{"udp":{"username":"udp-user","password":"udp-password"},"tcp":{"username":"tcp-user","password":"tcp-password"}}}`), &multi); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		data     *CredentialsData
+		urn      string
+		username string
+		password string
+	}{
+		{&single, "turn:relay.example.com:3478", "user", "password"},
+		{&single, "turn:relay.example.com:3478?transport=tcp", "user", "password"},
+		{&multi, "turn:relay.example.com:3478", "udp-user", "udp-password"},
+		{&multi, "turn:relay.example.com:3478?transport=udp", "udp-user", "udp-password"},
+		{&multi, "turn:relay.example.com:3478?transport=TCP", "tcp-user", "tcp-password"},
+		{&multi, "turns:relay.example.com:5349", "tcp-user", "tcp-password"},
+	}
+
+	for _, testcase := range testcases {
+		username, password := testcase.data.CredentialsFor(testcase.urn)
+		if username != testcase.username || password != testcase.password {
+			t.Errorf("%s: expected %s/%s, got %s/%s", testcase.urn, testcase.username, testcase.password, username, password)
+		}
+	}
+}
+
+func TestCredentialsDataScoreServers(t *testing.T) {
+	data := &CredentialsData{
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "far", URNs: []string{"turn:far.example.com:3478"}},
+			&URNsWithID{ID: "empty"},
+			&URNsWithID{ID: "near", URNs: []string{"turn:far.example.com:3478", "turn:near.example.com:3478"}},
+			&URNsWithID{ID: "medium", URNs: []string{"turn:medium.example.com:3478"}},
+			&URNsWithID{ID: "medium2", URNs: []string{"turn:medium.example.com:3478?transport=tcp"}},
+		},
+	}
+	latencies := map[string]float64{
+		"turn:far.example.com:3478":                  100,
+		"turn:near.example.com:3478":                 10,
+		"turn:medium.example.com:3478":               50,
+		"turn:medium.example.com:3478?transport=tcp": 50,
+	}
+
+	scored := data.ScoreServers(func(urn string) float64 {
+		return latencies[urn]
+	})
+	expected := []struct {
+		id    string
+		score float64
+	}{
+		{"near", 10},
+		{"medium", 50},
+		{"medium2", 50},
+		{"far", 100},
+	}
+	if len(scored) != len(expected) {
+		t.Fatalf("expected %d scored servers, got %d", len(expected), len(scored))
+	}
+	for i, e := range expected {
+		if scored[i].Server.ID != e.id || scored[i].Score != e.score {
+			t.Errorf("position %d: expected %s/%v, got %s/%v", i, e.id, e.score, scored[i].Server.ID, scored[i].Score)
+		}
+	}
+}
+
+func TestCredentialsDataBestServer(t *testing.T) {
+	testcases := []struct {
+		name     string
+		servers  []*URNsWithID
+		expected string
+	}{
+		{"empty", nil, ""},
+		{"single", []*URNsWithID{
+			&URNsWithID{ID: "a", Prio: 5},
+		}, "a"},
+		{"multiple", []*URNsWithID{
+			&URNsWithID{ID: "a", Prio: 5},
+			&URNsWithID{ID: "b", Prio: 1},
+			&URNsWithID{ID: "c", Prio: 3},
+		}, "b"},
+		{"tied", []*URNsWithID{
+			&URNsWithID{ID: "a", Prio: 5},
+			&URNsWithID{ID: "b", Prio: 1},
+			&URNsWithID{ID: "c", Prio: 1},
+		}, "b"},
+	}
+
+	for _, testcase := range testcases {
+		data := &CredentialsData{Servers: testcase.servers}
+		server, ok := data.BestServer()
+		if testcase.expected == "" {
+			if ok || server != nil {
+				t.Errorf("%s: expected no server, got %v", testcase.name, server)
+			}
+			continue
+		}
+		if !ok || server.ID != testcase.expected {
+			t.Errorf("%s: expected %s, got %v", testcase.name, testcase.expected, server)
+		}
+	}
+}
+
+func TestCredentialsDataBestServerWithGeo(t *testing.T) {
+	data := &CredentialsData{Servers: []*URNsWithID{
+		&URNsWithID{ID: "a", Prio: 5},
+		&URNsWithID{ID: "b", Prio: 1},
+		&URNsWithID{ID: "c", Prio: 3},
+		&URNsWithID{ID: "c", Prio: 2},
+	}}
+	testcases := []struct {
+		name     string
+		geo      *GeoData
+		expected *URNsWithID
+	}{
+		{"nil geo", nil, data.Servers[1]},
+		{"preferred", &GeoData{Prefer: []string{"a", "b"}}, data.Servers[0]},
+		{"preferred prio", &GeoData{Prefer: []string{"c"}}, data.Servers[3]},
+		{"unknown ids", &GeoData{Prefer: []string{"x", "a"}}, data.Servers[0]},
+		{"no known ids", &GeoData{Prefer: []string{"x"}}, data.Servers[1]},
+	}
+
+	for _, testcase := range testcases {
+		if server, ok := data.BestServerWithGeo(testcase.geo); !ok || server != testcase.expected {
+			t.Errorf("%s: expected %v, got %v", testcase.name, testcase.expected, server)
+		}
+	}
+	if server, ok := (&CredentialsData{}).BestServerWithGeo(&GeoData{Prefer: []string{"a"}}); ok || server != nil {
+		t.Errorf("expected no server, got %v", server)
+	}
+}
+
+func TestCredentialsDataOrderedServers(t *testing.T) {
+	servers := []*URNsWithID{
+		&URNsWithID{ID: "a", Prio: 1},
+		&URNsWithID{ID: "b", Prio: 5},
+		&URNsWithID{ID: "c", Prio: 5},
+		&URNsWithID{ID: "d", Prio: 3},
+	}
+	testcases := []struct {
+		name     string
+		geo      *GeoData
+		expected string
+	}{
+		{"nil geo", nil, "b,c,d,a"},
+		{"empty geo", &GeoData{}, "b,c,d,a"},
+		{"full geo", &GeoData{Prefer: []string{"a", "d", "c", "b"}}, "a,d,c,b"},
+		{"partial geo", &GeoData{Prefer: []string{"d"}}, "d,b,c,a"},
+		{"unknown ids", &GeoData{Prefer: []string{"x", "a", "y"}}, "a,b,c,d"},
+		{"duplicate ids", &GeoData{Prefer: []string{"c", "a", "c"}}, "c,a,b,d"},
+		{"leading duplicate ids", &GeoData{Prefer: []string{"a", "a", "d"}}, "a,d,b,c"},
+	}
+
+	for _, testcase := range testcases {
+		data := &CredentialsData{Servers: servers}
+		var ids []string
+		for _, server := range data.OrderedServers(testcase.geo) {
+			ids = append(ids, server.ID)
+		}
+		if result := strings.Join(ids, ","); result != testcase.expected {
+			t.Errorf("%s: expected %s, got %s", testcase.name, testcase.expected, result)
+		}
+	}
+
+	if servers[0].ID != "a" || servers[1].ID != "b" {
+		t.Error("servers must not be modified")
+	}
+}
+
+func TestSortServers(t *testing.T) {
+	servers := []*URNsWithID{
+		&URNsWithID{ID: "a", Prio: 1},
+		&URNsWithID{ID: "b", Prio: 5},
+		&URNsWithID{ID: "c", Prio: 3},
+		&URNsWithID{ID: "d", Prio: 5},
+	}
+	SortServers(servers)
+	var ids []string
+	for _, server := range servers {
+		ids = append(ids, server.ID)
+	}
+	if result := strings.Join(ids, ","); result != "b,d,c,a" {
+		t.Errorf("expected b,d,c,a, got %s", result)
+	}
+}
+
+func TestCredentialsDataGroupedServers(t *testing.T) {
+	data := &CredentialsData{
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", Prio: 1, URNs: []string{"turn:a1.example.com"}},
+			&URNsWithID{ID: "b", Prio: 2, URNs: []string{"turn:b.example.com"}},
+			&URNsWithID{ID: "a", Prio: 3, URNs: []string{"turn:a2.example.com"}},
+		},
+	}
+	servers := data.GroupedServers()
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 server groups, got %d", len(servers))
+	}
+	if s := servers[0]; s.ID != "a" || s.Prio != 3 || strings.Join(s.URNs, " ") != "turn:a1.example.com turn:a2.example.com" {
+		t.Errorf("unexpected merged server group: %+v", s)
+	}
+	if servers[1] != data.Servers[1] {
+		t.Error("single server group must be returned as is")
+	}
+	if s := data.Servers[0]; s.Prio != 1 || len(s.URNs) != 1 {
+		t.Errorf("original server group must not be modified: %+v", s)
+	}
+}
+
+func TestCredentialsDataLimitURNsPerServer(t *testing.T) {
+	data := &CredentialsData{
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", URNs: []string{
+				"turns:a.example.com:443?transport=tcp",
+				"turn:a.example.com:3478?transport=tcp",
+				"turn:a.example.com:3478?transport=udp",
+				"turn:a.example.com:3479",
+			}},
+			&URNsWithID{ID: "b", URNs: []string{
+				"turn:b.example.com:3478?transport=tcp",
+			}},
+		},
+	}
+
+	testcases := []struct {
+		name     string
+		limited  *CredentialsData
+		expected []string
+	}{
+		{"one", data.LimitURNsPerServer(1), []string{
+			"turn:a.example.com:3478?transport=udp",
+			"turn:b.example.com:3478?transport=tcp",
+		}},
+		{"two", data.LimitURNsPerServer(2), []string{
+			"turn:a.example.com:3478?transport=udp",
+			"turn:a.example.com:3479",
+			"turn:b.example.com:3478?transport=tcp",
+		}},
+		{"unlimited", data.LimitURNsPerServer(0), []string{
+			"turn:a.example.com:3478?transport=udp",
+			"turn:a.example.com:3479",
+			"turns:a.example.com:443?transport=tcp",
+			"turn:a.example.com:3478?transport=tcp",
+			"turn:b.example.com:3478?transport=tcp",
+		}},
+		{"tcp first", data.LimitURNsPerServerWith(2, []string{TransportTCP}), []string{
+			"turns:a.example.com:443?transport=tcp",
+			"turn:a.example.com:3478?transport=tcp",
+			"turn:b.example.com:3478?transport=tcp",
+		}},
+	}
+
+	for _, testcase := range testcases {
+		var urns []string
+		for _, server := range testcase.limited.Servers {
+			urns = append(urns, server.URNs...)
+		}
+		if strings.Join(urns, " ") != strings.Join(testcase.expected, " ") {
+			t.Errorf("%s: expected %v, got %v", testcase.name, testcase.expected, urns)
+		}
+	}
+
+	if len(data.Servers[0].URNs) != 4 || data.Servers[0].URNs[0] != "turns:a.example.com:443?transport=tcp" {
+		t.Errorf("original data must not be modified: %v", data.Servers[0].URNs)
+	}
+}
+
+func TestCredentialsDataValidate(t *testing.T) {
+	servers := []*URNsWithID{
+		&URNsWithID{ID: "a", URNs: []string{"turn:a.example.com:3478"}},
+	}
+	testcases := []struct {
+		name  string
+		data  *CredentialsData
+		valid bool
+	}{
+		{"valid", &CredentialsData{Username: "user", Password: "password", Servers: servers}, true},
+		{"no username", &CredentialsData{Password: "password", Servers: servers}, false},
+		{"no password", &CredentialsData{Username: "user", Servers: servers}, false},
+		{"no servers", &CredentialsData{Username: "user", Password: "password"}, false},
+		{"no urns", &CredentialsData{Username: "user", Password: "password", Servers: []*URNsWithID{&URNsWithID{ID: "a"}}}, false},
+	}
+
+	for _, testcase := range testcases {
+		err := testcase.data.Validate()
+		if testcase.valid && err != nil {
+			t.Errorf("%s: expected valid, got %s", testcase.name, err)
+		} else if !testcase.valid && !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: expected invalid credentials, got %v", testcase.name, err)
+		}
+	}
+}
+
+func TestCredentialsDataFilterByCIDR(t *testing.T) {
+	data := &CredentialsData{
+		Username: "user",
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", URNs: []string{
+				"turn:inside.example.com:3478",
+				"turn:outside.example.com:3478?transport=tcp",
+			}},
+			&URNsWithID{ID: "b", URNs: []string{
+				"turn:192.0.2.10:3478",
+				"turns:[2001:db8::1]:5349",
+			}},
+			&URNsWithID{ID: "c", URNs: []string{
+				"turn:outside.example.com",
+				"turn:unknown.example.com",
+			}},
+		},
+	}
+	_, network4, _ := net.ParseCIDR("192.0.2.0/24")
+	_, network6, _ := net.ParseCIDR("2001:db8::/32")
+	resolver := func(host string) ([]net.IP, error) {
+		switch host {
+		case "inside.example.com":
+			return []net.IP{net.ParseIP("198.51.100.1"), net.ParseIP("192.0.2.1")}, nil
+		case "outside.example.com":
+			return []net.IP{net.ParseIP("198.51.100.1")}, nil
+		}
+		return nil, fmt.Errorf("unknown host %s", host)
+	}
+
+	filtered := data.FilterByCIDR([]*net.IPNet{network4, network6}, resolver)
+	if filtered.Username != "user" {
+		t.Errorf("credentials must be kept, got %s", filtered.Username)
+	}
+	if len(filtered.Servers) != 2 {
+		t.Fatalf("expected 2 server groups, got %d", len(filtered.Servers))
+	}
+	if s := filtered.Servers[0]; s.ID != "a" || len(s.URNs) != 1 || s.URNs[0] != "turn:inside.example.com:3478" {
+		t.Errorf("unexpected server group: %+v", s)
+	}
+	if s := filtered.Servers[1]; s.ID != "b" || len(s.URNs) != 2 {
+		t.Errorf("unexpected server group: %+v", s)
+	}
+	if len(data.Servers) != 3 || len(data.Servers[0].URNs) != 2 {
+		t.Error("original credentials must not be modified")
+	}
+}
+
+func TestCredentialsDataFilter(t *testing.T) {
+	data := &CredentialsData{
+		Username: "user",
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", URNs: []string{
+				"stun:relay.example.com:3478",
+				"turn:relay.example.com:3478",
+				"turn:relay.example.com:3478?transport=TCP",
+			}},
+			&URNsWithID{ID: "b", URNs: []string{
+				"turns:relay2.example.com:5349",
+				"turns:relay2.example.com:5349?transport=udp",
+			}},
+		},
+	}
+
+	testcases := []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{"udp", FilterUDP, []string{
+			"a:stun:relay.example.com:3478",
+			"a:turn:relay.example.com:3478",
+			"b:turns:relay2.example.com:5349?transport=udp",
+		}},
+		{"tcp", FilterTCP, []string{
+			"a:turn:relay.example.com:3478?transport=TCP",
+		}},
+		{"tls", FilterTLS, []string{
+			"b:turns:relay2.example.com:5349",
+		}},
+		{"no udp", FilterTCP | FilterTLS, []string{
+			"a:turn:relay.example.com:3478?transport=TCP",
+			"b:turns:relay2.example.com:5349",
+		}},
+		{"none", 0, nil},
+	}
+	for _, testcase := range testcases {
+		filtered := data.Filter(testcase.filter)
+		var urns []string
+		for _, server := range filtered.Servers {
+			for _, urn := range server.URNs {
+				urns = append(urns, server.ID+":"+urn)
+			}
+		}
+		if strings.Join(urns, " ") != strings.Join(testcase.expected, " ") {
+			t.Errorf("%s: expected %v, got %v", testcase.name, testcase.expected, urns)
+		}
+		if filtered.Username != "user" {
+			t.Errorf("%s: credentials must be kept, got %s", testcase.name, filtered.Username)
+		}
+	}
+	if len(data.Servers[0].URNs) != 3 {
+		t.Error("original credentials must not be modified")
+	}
+}
+
+func TestCredentialsDataMarshalJSEP(t *testing.T) {
+	data := &CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", URNs: []string{
+				"stun:relay.example.com:3478",
+				"turn:relay.example.com:3478",
+				"turn:relay.example.com:3478?transport=tcp",
+			}},
+			&URNsWithID{ID: "b", URNs: []string{
+				"turns:relay2.example.com:5349",
+			}},
+		},
+	}
+
+	encoded, err := data.MarshalJSEP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"iceServers":[` +
+		`{"urls":["stun:relay.example.com:3478"]},` +
+		`{"urls":["turn:relay.example.com:3478","turn:relay.example.com:3478?transport=tcp"],"username":"user","credential":"password"},` +
+		`{"urls":["turns:relay2.example.com:5349"],"username":"user","credential":"password"}` +
+		`],"iceTransportPolicy":"all"}`
+	if string(encoded) != expected {
+		t.Errorf("unexpected JSEP encoding:\n%s\nexpected:\n%s", encoded, expected)
+	}
+
+	encoded, err = (&CredentialsData{}).MarshalJSEP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"iceServers":[],"iceTransportPolicy":"all"}` {
+		t.Errorf("unexpected JSEP encoding: %s", encoded)
+	}
+}
+
+func TestCredentialsDataICEServers(t *testing.T) {
+	data := &CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", URNs: []string{
+				"stun:relay.example.com:3478",
+				"turn:relay.example.com:3478?transport=udp",
+			}},
+			&URNsWithID{ID: "b", URNs: []string{
+				"turn:relay2.example.com:3478?transport=udp",
+				"turns:relay2.example.com:5349?transport=tcp",
+			}},
+			&URNsWithID{ID: "c", Prio: 10, URNs: []string{
+				"turn:relay3.example.com:3478?transport=udp",
+			}},
+		},
+		Protocols: map[string]*ProtocolCredentials{
+			TransportTCP: &ProtocolCredentials{Username: "tcpuser", Password: "tcppassword"},
+		},
+	}
+
+	encoded, err := json.Marshal(data.ICEServers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[` +
+		`{"urls":["turn:relay3.example.com:3478?transport=udp"],"username":"user","credential":"password"},` +
+		`{"urls":["stun:relay.example.com:3478"]},` +
+		`{"urls":["turn:relay.example.com:3478?transport=udp"],"username":"user","credential":"password"},` +
+		`{"urls":["turn:relay2.example.com:3478?transport=udp"],"username":"user","credential":"password"},` +
+		`{"urls":["turns:relay2.example.com:5349?transport=tcp"],"username":"tcpuser","credential":"tcppassword"}` +
+		`]`
+	if string(encoded) != expected {
+		t.Errorf("unexpected ICE servers:\n%s\nexpected:\n%s", encoded, expected)
+	}
+
+	if servers := (&CredentialsData{}).ICEServers(); servers == nil || len(servers) != 0 {
+		t.Errorf("expected empty ICE servers, got %v", servers)
+	}
+}
+
+func TestCredentialsDataRelaysWithoutTransport(t *testing.T) {
+	data := &CredentialsData{
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", URNs: []string{
+				"stun:relay.example.com:3478",
+				"turn:relay.example.com:3478",
+				"turn:relay.example.com:3478?transport=udp",
+				"turn:relay.example.com:443?transport=tcp",
+			}},
+			&URNsWithID{ID: "b", URNs: []string{
+				"turns:relay2.example.com:5349",
+			}},
+		},
+	}
+
+	urns := data.RelaysWithoutTransport()
+	if len(urns) != 2 || urns[0] != "turn:relay.example.com:3478" || urns[1] != "turns:relay2.example.com:5349" {
+		t.Errorf("unexpected relays without transport: %v", urns)
+	}
+	if urns := (&CredentialsData{}).RelaysWithoutTransport(); len(urns) != 0 {
+		t.Errorf("expected no relays, got %v", urns)
+	}
+}
+
+func TestCredentialsDataNormalizePorts(t *testing.T) {
+	urns := []string{
+		"turn:relay.example.com",
+		"turn:relay.example.com?transport=tcp",
+		"turns:relay.example.com",
+		"stun:relay.example.com",
+		"stuns:relay.example.com",
+		"turn:relay.example.com:443?transport=tcp",
+		"turn:192.0.2.1",
+		"turn:[2001:db8::1]",
+		"turn:[2001:db8::1]:3479",
+	}
+	expected := []string{
+		"turn:relay.example.com:3478",
+		"turn:relay.example.com:3478?transport=tcp",
+		"turns:relay.example.com:5349",
+		"stun:relay.example.com:3478",
+		"stuns:relay.example.com:5349",
+		"turn:relay.example.com:443?transport=tcp",
+		"turn:192.0.2.1:3478",
+		"turn:[2001:db8::1]:3478",
+		"turn:[2001:db8::1]:3479",
+	}
+
+	data := &CredentialsData{
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", URNs: append([]string(nil), urns...)},
+		},
+	}
+	data.NormalizePorts()
+	for i, urn := range data.Servers[0].URNs {
+		if urn != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], urn)
+		}
+	}
+
+	data = &CredentialsData{
+		Servers: []*URNsWithID{
+			&URNsWithID{ID: "a", URNs: []string{"turn:relay.example.com", "turns:relay.example.com"}},
+		},
+	}
+	data.NormalizePortsWith(map[string]int{"turns": 443})
+	if data.Servers[0].URNs[0] != "turn:relay.example.com" || data.Servers[0].URNs[1] != "turns:relay.example.com:443" {
+		t.Errorf("unexpected URNs: %v", data.Servers[0].URNs)
+	}
+}
+
+func TestCredentialsDiff(t *testing.T) {
+	servers := func(ids ...string) []*URNsWithID {
+		var servers []*URNsWithID
+		for _, id := range ids {
+			servers = append(servers, &URNsWithID{ID: id})
+		}
+		return servers
+	}
+
+	old := &CredentialsData{Username: "user", Password: "password", Servers: servers("a", "b")}
+	testcases := []struct {
+		name     string
+		new      *CredentialsData
+		expected string
+	}{
+		{"unchanged", &CredentialsData{Username: "user", Password: "password", Servers: servers("a", "b")}, "no changes"},
+		{"added", &CredentialsData{Username: "user", Password: "password", Servers: servers("a", "b", "c")}, "added servers: c"},
+		{"removed", &CredentialsData{Username: "user", Password: "password", Servers: servers("b")}, "removed servers: a"},
+		{"rotated", &CredentialsData{Username: "user2", Password: "password2", Servers: servers("a", "b")}, "username changed; password changed"},
+		{"all", &CredentialsData{Username: "user", Password: "password2", Servers: servers("c", "a")}, "added servers: c; removed servers: b; password changed"},
+	}
+
+	for _, testcase := range testcases {
+		diff := CredentialsDiff(old, testcase.new)
+		if s := diff.String(); s != testcase.expected {
+			t.Errorf("%s: expected %q, got %q", testcase.name, testcase.expected, s)
+		}
+		if diff.Empty() != (testcase.expected == "no changes") {
+			t.Errorf("%s: unexpected Empty %v", testcase.name, diff.Empty())
+		}
+	}
+
+	diff := CredentialsDiff(nil, old)
+	if len(diff.AddedServers) != 2 || !diff.UsernameChanged || !diff.PasswordChanged {
+		t.Errorf("unexpected diff from nil: %+v", diff)
+	}
+}
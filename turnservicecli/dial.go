@@ -0,0 +1,47 @@
+package turnservicecli
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// WithDialContext sets the function which dials the connections for requests
+// to the remote service, for example to connect through a tunnel.
+func WithDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) Option {
+	return func(service *TURNService) {
+		service.dialContext = dial
+	}
+}
+
+// WithUnixSocket connects requests to the remote service to the unix socket
+// at path, for services on the same host. The host of the service URI is
+// only sent in the Host header, for example with http://localhost, and
+// requests are not proxied.
+func WithUnixSocket(path string) Option {
+	return func(service *TURNService) {
+		var dialer net.Dialer
+		service.dialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		service.proxy = noProxy
+	}
+}
+
+// dialer returns the DialContext of the transport, which limits the time to
+// connect to the connect timeout, the caller must hold the lock.
+func (service *TURNService) dialer() func(ctx context.Context, network, address string) (net.Conn, error) {
+	dial := service.dialContext
+	if dial == nil {
+		dial = (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext
+	}
+	timeout := service.connectTimeout
+	if timeout == 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, address)
+	}
+}
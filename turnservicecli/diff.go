@@ -0,0 +1,74 @@
+package turnservicecli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CredDiff describes the changes between two CredentialsData, see
+// CredentialsDiff.
+type CredDiff struct {
+	AddedServers    []string
+	RemovedServers  []string
+	UsernameChanged bool
+	PasswordChanged bool
+}
+
+// CredentialsDiff returns the changes from old to new. Server groups are
+// compared by ID. Either of old and new may be nil.
+func CredentialsDiff(old, new *CredentialsData) CredDiff {
+	if old == nil {
+		old = &CredentialsData{}
+	}
+	if new == nil {
+		new = &CredentialsData{}
+	}
+
+	diff := CredDiff{
+		UsernameChanged: old.Username != new.Username,
+		PasswordChanged: old.Password != new.Password,
+	}
+	oldIDs := make(map[string]bool)
+	for _, server := range old.Servers {
+		oldIDs[server.ID] = true
+	}
+	newIDs := make(map[string]bool)
+	for _, server := range new.Servers {
+		newIDs[server.ID] = true
+		if !oldIDs[server.ID] {
+			diff.AddedServers = append(diff.AddedServers, server.ID)
+		}
+	}
+	for _, server := range old.Servers {
+		if !newIDs[server.ID] {
+			diff.RemovedServers = append(diff.RemovedServers, server.ID)
+		}
+	}
+	return diff
+}
+
+// Empty returns if there are no changes.
+func (diff CredDiff) Empty() bool {
+	return len(diff.AddedServers) == 0 && len(diff.RemovedServers) == 0 && !diff.UsernameChanged && !diff.PasswordChanged
+}
+
+// String returns a concise description of the changes for logging.
+func (diff CredDiff) String() string {
+	if diff.Empty() {
+		return "no changes"
+	}
+	var changes []string
+	if len(diff.AddedServers) > 0 {
+		changes = append(changes, fmt.Sprintf("added servers: %s", strings.Join(diff.AddedServers, ", ")))
+	}
+	if len(diff.RemovedServers) > 0 {
+		changes = append(changes, fmt.Sprintf("removed servers: %s", strings.Join(diff.RemovedServers, ", ")))
+	}
+	if diff.UsernameChanged {
+		changes = append(changes, "username changed")
+	}
+	if diff.PasswordChanged {
+		changes = append(changes, "password changed")
+	}
+	return strings.Join(changes, "; ")
+}
@@ -0,0 +1,167 @@
+package turnservicecli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+)
+
+// endpointSession is a base URI of the remote service with the session to use
+// for requests to it.
+type endpointSession struct {
+	uri     string
+	session string
+}
+
+// SetEndpoints sets the ordered list of base URIs of the remote service. The
+// first URI is the primary endpoint, the others are tried in order when a
+// request fails with a transport error or a server error (5xx).
+//
+// Sessions are scoped per endpoint: the session returned by an endpoint is
+// only ever sent to that endpoint, so failing over to a secondary endpoint
+// does not replace the session used when the primary endpoint recovers. The
+// session passed to Open is used for the primary endpoint.
+func (service *TURNService) SetEndpoints(uris []string) {
+	if len(uris) == 0 {
+		return
+	}
+	service.Lock()
+	defer service.Unlock()
+	if uris[0] != service.uri {
+		service.uri = uris[0]
+		service.session = ""
+	}
+	service.uris = append([]string(nil), uris...)
+	sessions := make(map[string]string)
+	for _, uri := range service.uris[1:] {
+		if session, ok := service.sessions[uri]; ok {
+			sessions[uri] = session
+		}
+	}
+	service.sessions = sessions
+}
+
+// NewTURNServiceMulti creates a TURNService with the ordered list of base URIs
+// of the remote service, see SetEndpoints.
+func NewTURNServiceMulti(uris []string, opts ...Option) *TURNService {
+	var uri string
+	if len(uris) > 0 {
+		uri = uris[0]
+	}
+	service := NewTURNService(uri, opts...)
+	service.SetEndpoints(uris)
+	return service
+}
+
+// SetStickyEndpoint enables or disables sticky endpoints. When enabled, the
+// endpoint which last returned credentials is tried first, so an endpoint
+// which failed is only tried again when the others fail too. It is disabled
+// by default, the endpoints are always tried in the order of SetEndpoints.
+func (service *TURNService) SetStickyEndpoint(sticky bool) {
+	service.Lock()
+	defer service.Unlock()
+	service.stickyEndpoint = sticky
+}
+
+// endpointSessions returns the endpoints with their sessions, the caller must
+// hold the lock.
+func (service *TURNService) endpointSessions() []endpointSession {
+	if len(service.uris) == 0 {
+		return []endpointSession{{service.uri, service.session}}
+	}
+	endpoints := make([]endpointSession, 0, len(service.uris))
+	if service.stickyEndpoint && service.lastEndpoint != "" {
+		for _, uri := range service.uris {
+			if uri == service.lastEndpoint {
+				endpoints = append(endpoints, endpointSession{uri, service.endpointSession(uri)})
+				break
+			}
+		}
+	}
+	for _, uri := range service.uris {
+		if len(endpoints) > 0 && uri == endpoints[0].uri {
+			continue
+		}
+		endpoints = append(endpoints, endpointSession{uri, service.endpointSession(uri)})
+	}
+	return endpoints
+}
+
+// endpointSession returns the session of uri, the caller must hold the lock.
+func (service *TURNService) endpointSession(uri string) string {
+	if uri == service.uri {
+		return service.session
+	}
+	return service.sessions[uri]
+}
+
+// setEndpointSession sets the session of uri which returned credentials, the
+// caller must hold the lock.
+func (service *TURNService) setEndpointSession(uri, session string) {
+	service.lastEndpoint = uri
+	if uri == service.uri {
+		service.session = session
+		return
+	}
+	if service.sessions == nil {
+		service.sessions = make(map[string]string)
+	}
+	service.sessions[uri] = session
+}
+
+// resetSessions clears the sessions of all endpoints, the caller must hold
+// the lock.
+func (service *TURNService) resetSessions() {
+	service.session = ""
+	service.sessions = nil
+}
+
+// failover calls f for the endpoints in order until it succeeds or fails with
+// an error which is not worth trying the next endpoint for. It returns the
+// URI of the last endpoint tried.
+func (service *TURNService) failover(ctx context.Context, endpoints []endpointSession, f func(endpoint endpointSession) error) (string, error) {
+	var uri string
+	var err error
+	for _, endpoint := range endpoints {
+		uri = endpoint.uri
+		if err = f(endpoint); err == nil || ctx.Err() != nil || !isFailoverError(err) {
+			break
+		}
+		service.logger.Printf("turnservicecli: request to %s failed, trying next endpoint: %s", uri, err)
+	}
+	return uri, err
+}
+
+// isFailoverError returns if err is a connection error or a server error.
+// Certificate verification, pinning and URL errors fail again when retried.
+func isFailoverError(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return false
+	}
+	err = urlErr.Err
+
+	var (
+		pinningErr       *PinningError
+		unknownAuthority x509.UnknownAuthorityError
+		hostnameErr      x509.HostnameError
+		invalidErr       x509.CertificateInvalidError
+		recordErr        tls.RecordHeaderError
+	)
+	switch {
+	case errors.As(err, &pinningErr), errors.As(err, &unknownAuthority),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr),
+		errors.As(err, &recordErr):
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,81 @@
+package turnservicecli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrForbidden is returned when the remote service rejects the access
+	// token or the session. The returned error wraps ErrForbidden with the
+	// body of the response.
+	ErrForbidden = errors.New("forbidden")
+	// ErrInvalidNonce is returned when the nonce of a response does not
+	// match the nonce of the request.
+	ErrInvalidNonce = errors.New("nonce mismatch")
+	// ErrUnsuccessful is returned when the remote service responds without
+	// success.
+	ErrUnsuccessful = errors.New("response unsuccessful")
+	// ErrInvalidCredentials is returned when the remote service responds
+	// with credentials which can not be used, see CredentialsData.Validate.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrMissingSession is returned when a request with a session is
+	// answered successfully but without a session.
+	ErrMissingSession = errors.New("missing session in response")
+	// ErrUnexpectedStatus is matched by errors.Is for every StatusError.
+	ErrUnexpectedStatus = errors.New("unexpected status")
+	// ErrPinMismatch is matched by errors.Is for every PinningError.
+	ErrPinMismatch = errors.New("public key pin mismatch")
+	// ErrNoCredentials is returned when no valid credentials are available
+	// without another error, for example after static credentials expired.
+	ErrNoCredentials = errors.New("no credentials available")
+)
+
+// StatusError is returned when the remote service responds with an
+// unexpected HTTP status code. Body holds the start of the response body.
+type StatusError struct {
+	Endpoint   string
+	StatusCode int
+	Body       []byte
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("%s return wrong status: %d", err.Endpoint, err.StatusCode)
+}
+
+// Is reports if target is ErrUnexpectedStatus.
+func (err *StatusError) Is(target error) bool {
+	return target == ErrUnexpectedStatus
+}
+
+// PinningError is returned when no certificate of a verified chain of the
+// remote service matches the pinned public keys, see WithPinnedPublicKeys.
+// Pins holds the pins of the certificates which were checked.
+type PinningError struct {
+	Pins []string
+}
+
+func (err *PinningError) Error() string {
+	return fmt.Sprintf("%s: got %s", ErrPinMismatch, strings.Join(err.Pins, ", "))
+}
+
+// Is reports if target is ErrPinMismatch.
+func (err *PinningError) Is(target error) bool {
+	return target == ErrPinMismatch
+}
+
+// GeoError is returned by CredentialsWithGeo together with the credentials
+// when only the GeoData could not be fetched. Err is the error of the fetch.
+type GeoError struct {
+	Err error
+}
+
+func (err *GeoError) Error() string {
+	return fmt.Sprintf("geo: %s", err.Err)
+}
+
+// Unwrap returns the error of the fetch.
+func (err *GeoError) Unwrap() error {
+	return err.Err
+}
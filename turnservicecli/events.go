@@ -0,0 +1,111 @@
+package turnservicecli
+
+import (
+	"sync"
+	"time"
+)
+
+// An EventType identifies a step in the lifecycle of credentials.
+type EventType int
+
+const (
+	// EventFetchStart is emitted before credentials are fetched.
+	EventFetchStart EventType = iota + 1
+	// EventFetchSuccess is emitted after credentials were fetched.
+	EventFetchSuccess
+	// EventFetchFailure is emitted after a fetch of credentials failed.
+	EventFetchFailure
+	// EventCached is emitted when fetched credentials become the cached
+	// credentials of the TURNService.
+	EventCached
+	// EventExpired is emitted when cached credentials expire or are closed.
+	EventExpired
+	// EventRefreshTriggered is emitted when a background refresh of the
+	// credentials is scheduled.
+	EventRefreshTriggered
+)
+
+var eventTypeNames = map[EventType]string{
+	EventFetchStart:       "fetch-start",
+	EventFetchSuccess:     "fetch-success",
+	EventFetchFailure:     "fetch-failure",
+	EventCached:           "cached",
+	EventExpired:          "expired",
+	EventRefreshTriggered: "refresh-triggered",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// An Event describes a step in the lifecycle of credentials. FetchID
+// identifies the fetch an event belongs to, it is shared by the fetch events
+// and the cached and expired events of the fetched credentials, and zero for
+// events not related to a fetch.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	FetchID  uint64
+	Endpoint string
+	Err      error
+}
+
+// An EventHandler receives lifecycle events of a TURNService, see
+// TURNService.SetEventHandler.
+type EventHandler func(Event)
+
+// serviceEvents forwards to an optional EventHandler.
+type serviceEvents struct {
+	sync.RWMutex
+
+	handler EventHandler
+}
+
+func (e *serviceEvents) set(h EventHandler) {
+	e.Lock()
+	defer e.Unlock()
+	e.handler = h
+}
+
+func (e *serviceEvents) get() EventHandler {
+	e.RLock()
+	defer e.RUnlock()
+	return e.handler
+}
+
+func (e *serviceEvents) emit(clock Clock, event Event) {
+	if h := e.get(); h != nil {
+		event.Time = clock.Now()
+		h(event)
+	}
+}
+
+// SetEventHandler sets an EventHandler which receives the lifecycle events of
+// the credentials as a single timeline. The handler is called synchronously
+// from the goroutine causing the event and must not block. Passing nil
+// disables events.
+func (service *TURNService) SetEventHandler(h EventHandler) {
+	service.events.set(h)
+}
+
+// emit emits an event to the EventHandler, the service lock must not be held.
+func (service *TURNService) emit(event Event) {
+	service.RLock()
+	clock := service.clock
+	service.RUnlock()
+	service.events.emit(clock, event)
+}
+
+// watchExpiry emits EventExpired when credentials fetched with fetchID expire.
+func (service *TURNService) watchExpiry(credentials *CachedCredentialsData, fetchID uint64) {
+	if service.events.get() == nil {
+		return
+	}
+	go func() {
+		<-credentials.done
+		service.emit(Event{Type: EventExpired, FetchID: fetchID})
+	}()
+}
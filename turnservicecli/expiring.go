@@ -0,0 +1,89 @@
+package turnservicecli
+
+import (
+	"time"
+)
+
+// A TURNExpiringHandler is a function handler which can be registered to
+// get called shortly before cached TURN credentials expire.
+type TURNExpiringHandler func(*CachedCredentialsData)
+
+// expiringHandler is a TURNExpiringHandler registered with BindOnExpiring.
+type expiringHandler struct {
+	id   uint64
+	lead time.Duration
+	h    TURNExpiringHandler
+}
+
+// BindOnExpiring triggers lead before the cached TURN credentials expire, for
+// example to re-establish ICE with new credentials in time. The lead is
+// clamped to the expiry of the credentials, so it never exceeds their TTL.
+// The handler is not called for credentials which are closed or replaced
+// before. It returns a function which unbinds the handler again.
+func (service *TURNService) BindOnExpiring(lead time.Duration, h TURNExpiringHandler) func() {
+	service.Lock()
+	service.bindings++
+	id := service.bindings
+	handler := expiringHandler{id, lead, h}
+	service.expiringHandlers = append(service.expiringHandlers, handler)
+	credentials := service.credentials
+	service.Unlock()
+
+	if credentials != nil {
+		service.scheduleExpiring(credentials, handler)
+	}
+	return func() {
+		service.unbindExpiring(id)
+	}
+}
+
+func (service *TURNService) unbindExpiring(id uint64) {
+	service.Lock()
+	defer service.Unlock()
+	// Copy, the previous slice may be in use by watchExpiring.
+	handlers := make([]expiringHandler, 0, len(service.expiringHandlers))
+	for _, handler := range service.expiringHandlers {
+		if handler.id != id {
+			handlers = append(handlers, handler)
+		}
+	}
+	service.expiringHandlers = handlers
+}
+
+// isExpiringBound returns if the expiring handler with id is still bound.
+func (service *TURNService) isExpiringBound(id uint64) bool {
+	service.RLock()
+	defer service.RUnlock()
+	for _, handler := range service.expiringHandlers {
+		if handler.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// watchExpiring schedules the expiring handlers for new cached credentials,
+// the service lock must not be held.
+func (service *TURNService) watchExpiring(credentials *CachedCredentialsData) {
+	service.RLock()
+	handlers := service.expiringHandlers
+	service.RUnlock()
+	for _, handler := range handlers {
+		service.scheduleExpiring(credentials, handler)
+	}
+}
+
+func (service *TURNService) scheduleExpiring(credentials *CachedCredentialsData, handler expiringHandler) {
+	go func() {
+		timer := time.NewTimer(credentials.expiringIn(handler.lead))
+		defer timer.Stop()
+		select {
+		case <-credentials.done:
+			return
+		case <-timer.C:
+		}
+		if !credentials.Expired() && service.isExpiringBound(handler.id) {
+			handler.h(credentials)
+		}
+	}()
+}
@@ -0,0 +1,145 @@
+package turnservicecli
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileCacheRecord is the content of a cache file.
+type fileCacheRecord struct {
+	Key         string             `json:"key"`
+	Credentials *StoredCredentials `json:"credentials"`
+}
+
+// fileCredentialStore is a CredentialStore which keeps the credentials of a
+// single key in a file encrypted with AES-GCM.
+type fileCredentialStore struct {
+	sync.Mutex
+
+	path   string
+	aead   cipher.AEAD
+	random io.Reader
+}
+
+// NewFileCredentialStore returns a CredentialStore which persists the
+// credentials of a single key to the file at path, so a restarted process can
+// use them without a fetch. The file is encrypted with key which must be 16,
+// 24 or 32 bytes long to select AES-128, AES-192 or AES-256, and is only
+// readable by the owner.
+func NewFileCredentialStore(path string, key []byte) (CredentialStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCredentialStore{path: path, aead: aead, random: rand.Reader}, nil
+}
+
+func (s *fileCredentialStore) Get(key string) (*StoredCredentials, error) {
+	s.Lock()
+	defer s.Unlock()
+	record, err := s.read()
+	if err != nil || record == nil || record.Key != key || record.Credentials == nil {
+		return nil, err
+	}
+	if !time.Now().Before(record.Credentials.Expires) {
+		return nil, nil
+	}
+	return record.Credentials, nil
+}
+
+func (s *fileCredentialStore) Put(key string, credentials *StoredCredentials) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.write(&fileCacheRecord{key, credentials})
+}
+
+func (s *fileCredentialStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	record, err := s.read()
+	if err != nil || record == nil || record.Key != key {
+		return err
+	}
+	return os.Remove(s.path)
+}
+
+// read returns the record of the file, nil if there is no file.
+func (s *fileCredentialStore) read() (*fileCacheRecord, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("cache file too short")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(s.path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt cache file: %s", err.Error())
+	}
+
+	var record fileCacheRecord
+	if err := json.Unmarshal(plaintext, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// write replaces the file atomically with record.
+func (s *fileCredentialStore) write(record *fileCacheRecord) error {
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(s.random, nonce); err != nil {
+		return err
+	}
+	data := s.aead.Seal(nonce, nonce, plaintext, []byte(s.path))
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// SetCacheFile is a shortcut to use a CredentialStore returned by
+// NewFileCredentialStore, see SetCredentialStore. An empty path restores the
+// default in-memory store.
+func (service *TURNService) SetCacheFile(path string, key []byte) error {
+	if path == "" {
+		service.SetCredentialStore(nil)
+		return nil
+	}
+	store, err := NewFileCredentialStore(path, key)
+	if err != nil {
+		return err
+	}
+	service.SetCredentialStore(store)
+	return nil
+}
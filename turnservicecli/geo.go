@@ -0,0 +1,139 @@
+package turnservicecli
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Cache geo data for this many seconds if the response has no TTL.
+	defaultGeoTTL = 300
+)
+
+// cachedGeoData caches GeoData until it expires.
+type cachedGeoData struct {
+	sync.Mutex
+
+	geo     *GeoData
+	expires time.Time
+}
+
+func (c *cachedGeoData) get() *GeoData {
+	c.Lock()
+	defer c.Unlock()
+	if c.geo == nil || !time.Now().Before(c.expires) {
+		return nil
+	}
+	return c.geo
+}
+
+func (c *cachedGeoData) set(geo *GeoData) {
+	ttl := geo.TTL
+	if ttl <= 0 {
+		ttl = defaultGeoTTL
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.geo = geo
+	c.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// getGeo returns the cached GeoData, fetching it if fetch is set and the
+// cached data has expired.
+func (service *TURNService) getGeo(ctx context.Context, fetch bool) (*GeoData, error) {
+	if geo := service.geo.get(); geo != nil || !fetch {
+		return geo, nil
+	}
+	return service.FetchGeoContext(ctx)
+}
+
+// FetchGeo fetches new GeoData via the remote service, regardless of the
+// cached GeoData which is replaced. The nonce of the response is validated.
+func (service *TURNService) FetchGeo() (*GeoData, error) {
+	return service.FetchGeoContext(context.Background())
+}
+
+// FetchGeoContext is like FetchGeo, but the fetch is cancelled when ctx is
+// done.
+func (service *TURNService) FetchGeoContext(ctx context.Context) (*GeoData, error) {
+	service.RLock()
+	accessToken := service.accessToken
+	clientID := service.clientID
+	endpoints := service.endpointSessions()
+	service.RUnlock()
+
+	ctx, cancel := service.fetchContext(ctx)
+	defer cancel()
+	ctx, span := service.startSpan(ctx, "turnservicecli.FetchGeo", nil)
+
+	var response *GeoResponse
+	_, err := service.failover(ctx, endpoints, func(endpoint endpointSession) error {
+		var err error
+		response, err = service.fetchGeo(ctx, endpoint.uri, accessToken, clientID, endpoint.session)
+		return err
+	})
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	service.geo.set(response.Geo)
+	return response.Geo, nil
+}
+
+func (service *TURNService) fetchGeo(ctx context.Context, uri, accessToken, clientID, session string) (*GeoResponse, error) {
+	var response GeoResponse
+	nonce, err := service.doRequest(ctx, uri, "geo", accessToken, clientID, session, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.Success || response.Geo == nil {
+		return &response, fmt.Errorf("geo %w", ErrUnsuccessful)
+	}
+
+	if err := service.checkNonce(nonce, response.Nonce); err != nil {
+		return &response, err
+	}
+
+	return &response, nil
+}
+
+// Geo implements the geo API call to the TURNService returning the GeoData
+// with the preferred order of TURN server IDs. GeoData is cached with its own
+// TTL and only fetched if fetch is set and the cached data has expired.
+func (service *TURNService) Geo(fetch bool) (*GeoData, error) {
+	return service.GeoContext(context.Background(), fetch)
+}
+
+// GeoContext is like Geo but uses ctx for the request.
+func (service *TURNService) GeoContext(ctx context.Context, fetch bool) (*GeoData, error) {
+	return service.getGeo(ctx, fetch)
+}
+
+// CredentialsWithGeo returns the credentials together with the GeoData of the
+// TURNService, fetching both concurrently if fetch is set and the cached data
+// has expired. GeoData is cached with its own TTL. If only the GeoData can not
+// be fetched, the credentials are returned without GeoData and with a
+// *GeoError.
+func (service *TURNService) CredentialsWithGeo(ctx context.Context, fetch bool) (*CachedCredentialsData, *GeoData, error) {
+	var wg sync.WaitGroup
+	var geo *GeoData
+	var geoErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		geo, geoErr = service.getGeo(ctx, fetch)
+	}()
+
+	credentials, _, err := service.getCredentials(ctx, fetch)
+	wg.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	if geoErr != nil {
+		return credentials, nil, &GeoError{Err: geoErr}
+	}
+	return credentials, geo, nil
+}
@@ -0,0 +1,82 @@
+package turnservicecli
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// http3RetryInterval is the time after a failed HTTP/3 request during which
+// requests use the fallback transport.
+const http3RetryInterval = 5 * time.Minute
+
+// WithHTTP3 sends requests to the remote service with roundTripper, an
+// HTTP/3 round tripper like the one of github.com/quic-go/quic-go/http3,
+// for services behind QUIC capable load balancers. When a request fails
+// with roundTripper, for example because UDP is blocked, it is sent again
+// with the internal HTTP/2 and HTTP/1.1 transport, which is then used for
+// five minutes before HTTP/3 is tried again. The TLS configuration of
+// roundTripper is used as is.
+func WithHTTP3(roundTripper http.RoundTripper) Option {
+	return func(service *TURNService) {
+		service.http3 = roundTripper
+	}
+}
+
+// newClient returns the internal client with the transport of the
+// TURNService, the caller must hold the lock.
+func (service *TURNService) newClient() *http.Client {
+	if service.http3 == nil {
+		return &http.Client{
+			Transport: service.transport,
+			Timeout:   service.requestTimeout,
+		}
+	}
+	return &http.Client{
+		Transport: &fallbackRoundTripper{
+			primary:  service.http3,
+			fallback: service.transport,
+		},
+		Timeout: service.requestTimeout,
+	}
+}
+
+// fallbackRoundTripper sends requests with primary, falling back to
+// fallback for a while when primary fails.
+type fallbackRoundTripper struct {
+	sync.Mutex
+	primary  http.RoundTripper
+	fallback http.RoundTripper
+	failed   time.Time
+}
+
+func (t *fallbackRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.Lock()
+	useFallback := !t.failed.IsZero() && time.Since(t.failed) < http3RetryInterval
+	t.Unlock()
+	if useFallback {
+		return t.fallback.RoundTrip(request)
+	}
+
+	retry := request
+	if request.Body != nil {
+		if request.GetBody == nil {
+			return t.primary.RoundTrip(request)
+		}
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry = request.Clone(request.Context())
+		retry.Body = body
+	}
+	response, err := t.primary.RoundTrip(request)
+	if err == nil || request.Context().Err() != nil {
+		return response, err
+	}
+
+	t.Lock()
+	t.failed = time.Now()
+	t.Unlock()
+	return t.fallback.RoundTrip(retry)
+}
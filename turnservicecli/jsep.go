@@ -0,0 +1,63 @@
+package turnservicecli
+
+import (
+	"encoding/json"
+)
+
+// ICEServer is a RTCIceServer as used by WebRTC and JSEP.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// jsepConfiguration is the ICE part of the RTCConfiguration as used by JSEP.
+type jsepConfiguration struct {
+	ICEServers         []ICEServer `json:"iceServers"`
+	ICETransportPolicy string      `json:"iceTransportPolicy,omitempty"`
+}
+
+// ICEServers returns the URNs of all server groups as ICE servers, ready to
+// be used as iceServers of a WebRTC configuration. Each server group becomes
+// an ICE server with the credentials of the CredentialsData, split by
+// credentials if per transport credentials are used. STUN URNs become ICE
+// servers without credentials. The ICE servers are in the order of
+// OrderedServers without geo, by descending Prio.
+func (data *CredentialsData) ICEServers() []ICEServer {
+	iceServers := []ICEServer{}
+	for _, server := range data.OrderedServers(nil) {
+		first := len(iceServers)
+		for _, urn := range server.URNs {
+			var username, credential string
+			if isRelayURN(urn) {
+				username, credential = data.CredentialsFor(urn)
+			}
+			found := false
+			for i := first; i < len(iceServers); i++ {
+				if iceServers[i].Username == username && iceServers[i].Credential == credential {
+					iceServers[i].URLs = append(iceServers[i].URLs, urn)
+					found = true
+					break
+				}
+			}
+			if !found {
+				iceServers = append(iceServers, ICEServer{
+					URLs:       []string{urn},
+					Username:   username,
+					Credential: credential,
+				})
+			}
+		}
+	}
+	return iceServers
+}
+
+// MarshalJSEP returns the JSON encoding of the CredentialsData as ICE server
+// configuration of JSEP (RFC 8829), with the "iceServers" and
+// "iceTransportPolicy" members of a RTCConfiguration, see ICEServers.
+func (data *CredentialsData) MarshalJSEP() ([]byte, error) {
+	return json.Marshal(&jsepConfiguration{
+		ICEServers:         data.ICEServers(),
+		ICETransportPolicy: data.RecommendedTransportPolicy(),
+	})
+}
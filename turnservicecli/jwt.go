@@ -0,0 +1,57 @@
+package turnservicecli
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// JWTAlgorithmHS256 is the JWT algorithm for HMAC using SHA-256.
+	JWTAlgorithmHS256 = "HS256"
+
+	// jwtCredentialsClaim is the JWT claim containing the CredentialsData.
+	jwtCredentialsClaim = "turn"
+)
+
+// SignJWT packages the CredentialsData as claims of a JWT signed with
+// signer, which must implement the HS256 algorithm. See SignJWTWithAlgorithm.
+func (data *CredentialsData) SignJWT(signer func([]byte) ([]byte, error), claims map[string]interface{}) (string, error) {
+	return data.SignJWTWithAlgorithm(JWTAlgorithmHS256, signer, claims)
+}
+
+// SignJWTWithAlgorithm packages the CredentialsData as claims of a JWT signed
+// with signer, which must implement the JWT algorithm alg. The credentials are
+// added as "turn" claim to the provided claims. The "iat" and "exp" claims are
+// set from the TTL of the credentials if not provided.
+func (data *CredentialsData) SignJWTWithAlgorithm(alg string, signer func([]byte) ([]byte, error), claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": alg,
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	payload := make(map[string]interface{}, len(claims)+3)
+	payload["iat"] = now
+	payload["exp"] = now + data.TTL
+	for key, value := range claims {
+		payload[key] = value
+	}
+	payload[jwtCredentialsClaim] = data
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	token := fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(header), base64.RawURLEncoding.EncodeToString(encodedPayload))
+	signature, err := signer([]byte(token))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign JWT: %s", err.Error())
+	}
+
+	return fmt.Sprintf("%s.%s", token, base64.RawURLEncoding.EncodeToString(signature)), nil
+}
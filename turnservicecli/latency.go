@@ -0,0 +1,145 @@
+package turnservicecli
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Probe at this interval by default, see SetLatencyProbing.
+const defaultProbeInterval = 5 * time.Minute
+
+// A LatencyProber measures the round trip times of the URNs of data. URNs
+// which are not reachable are omitted. The probe subpackage provides a
+// LatencyProber with probe.RTTs.
+type LatencyProber func(ctx context.Context, data *CredentialsData) map[string]time.Duration
+
+// latencies are the round trip times measured for cached credentials.
+type latencies struct {
+	credentials *CachedCredentialsData
+	rtts        map[string]time.Duration
+}
+
+// SetLatencyProbing enables ranking of servers by round trip time, see
+// BestServers. The servers of cached credentials are measured with prober
+// right away and then every interval while the credentials are valid, an
+// interval of zero or less probes every 5 minutes. Passing a nil prober
+// disables probing.
+func (service *TURNService) SetLatencyProbing(prober LatencyProber, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	service.Lock()
+	if service.probeStop != nil {
+		close(service.probeStop)
+		service.probeStop = nil
+	}
+	service.prober = prober
+	service.probeInterval = interval
+	service.latencies = nil
+	credentials := service.credentials
+	service.Unlock()
+
+	if credentials != nil {
+		service.watchLatency(credentials)
+	}
+}
+
+// BestServers returns up to n server groups of the cached credentials with
+// the lowest measured round trip time of their URNs, see SetLatencyProbing.
+// Groups without measurements follow in the order of OrderedServers without
+// geo, which is the order of all groups until the first measurement. A n of
+// zero or less returns all groups. Nil is returned if there are no valid
+// cached credentials.
+func (service *TURNService) BestServers(n int) []*URNsWithID {
+	service.RLock()
+	credentials := service.credentials
+	latencies := service.latencies
+	service.RUnlock()
+	if credentials == nil || credentials.Expired() {
+		return nil
+	}
+
+	var rtts map[string]time.Duration
+	if latencies != nil && latencies.credentials == credentials {
+		rtts = latencies.rtts
+	}
+	credentials.RLock()
+	turn := credentials.Turn
+	credentials.RUnlock()
+
+	scored := turn.withServers(turn.OrderedServers(nil)).ScoreServers(func(urn string) float64 {
+		if rtt, ok := rtts[urn]; ok {
+			return float64(rtt)
+		}
+		return math.Inf(1)
+	})
+	if n <= 0 || n > len(scored) {
+		n = len(scored)
+	}
+	servers := make([]*URNsWithID, 0, n)
+	for _, s := range scored[:n] {
+		servers = append(servers, s.Server)
+	}
+	return servers
+}
+
+// watchLatency probes the servers of new cached credentials until they
+// expire or probing is reconfigured, the service lock must not be held.
+func (service *TURNService) watchLatency(credentials *CachedCredentialsData) {
+	service.Lock()
+	prober, interval := service.prober, service.probeInterval
+	if prober == nil {
+		service.Unlock()
+		return
+	}
+	if service.probeStop != nil {
+		// Stop probing replaced credentials.
+		close(service.probeStop)
+	}
+	stop := make(chan struct{})
+	service.probeStop = stop
+	parent := service.ctx
+	service.Unlock()
+
+	credentials.RLock()
+	turn := credentials.Turn
+	credentials.RUnlock()
+
+	go func() {
+		ctx, cancel := credentials.Context(parent)
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rtts := prober(ctx, turn)
+			if ctx.Err() != nil {
+				return
+			}
+			service.Lock()
+			if service.credentials == credentials && service.probeStop == stop {
+				service.latencies = &latencies{credentials, rtts}
+			}
+			service.Unlock()
+
+			timer := time.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,41 @@
+package turnservicecli
+
+import (
+	"sync"
+)
+
+// A Logger is used to log diagnostic messages. It is satisfied by the
+// *log.Logger of the standard library.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// serviceLogger forwards to an optional Logger.
+type serviceLogger struct {
+	sync.RWMutex
+
+	logger Logger
+}
+
+func (l *serviceLogger) set(logger Logger) {
+	l.Lock()
+	defer l.Unlock()
+	l.logger = logger
+}
+
+// enabled returns if a Logger is set, to avoid formatting arguments on hot
+// paths when logging is disabled.
+func (l *serviceLogger) enabled() bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.logger != nil
+}
+
+func (l *serviceLogger) Printf(format string, v ...interface{}) {
+	l.RLock()
+	logger := l.logger
+	l.RUnlock()
+	if logger != nil {
+		logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,89 @@
+package turnservicecli
+
+import (
+	"sync"
+	"time"
+)
+
+// fetchLatencyBuckets are the upper bounds in seconds of the buckets of the
+// fetch latency histogram.
+var fetchLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics is a snapshot of the metrics of a TURNService. Its fields map
+// directly to Prometheus metrics, see the Collector of the turnserviceprom
+// package.
+type Metrics struct {
+	// FetchAttempts and FetchFailures count the fetches of credentials, a
+	// fetch with retries counts once.
+	FetchAttempts uint64
+	FetchFailures uint64
+
+	// FetchLatencyBuckets maps the upper bounds in seconds of the fetch
+	// latency histogram to the cumulative count of fetches.
+	FetchLatencyBuckets map[float64]uint64
+	FetchLatencyCount   uint64
+	FetchLatencySum     float64
+
+	// CredentialsTTL is the remaining TTL of the cached credentials, zero
+	// if there are none.
+	CredentialsTTL time.Duration
+}
+
+// fetchMetrics collects the metrics of fetches.
+type fetchMetrics struct {
+	sync.Mutex
+
+	attempts uint64
+	failures uint64
+	buckets  []uint64
+	sum      float64
+}
+
+func (m *fetchMetrics) record(latency time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.buckets == nil {
+		m.buckets = make([]uint64, len(fetchLatencyBuckets))
+	}
+	m.attempts++
+	if err != nil {
+		m.failures++
+	}
+	seconds := latency.Seconds()
+	m.sum += seconds
+	for i, bound := range fetchLatencyBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+}
+
+// Metrics returns a snapshot of the metrics of the TURNService.
+func (service *TURNService) Metrics() Metrics {
+	service.RLock()
+	credentials := service.credentials
+	service.RUnlock()
+
+	m := &service.metrics
+	m.Lock()
+	metrics := Metrics{
+		FetchAttempts:       m.attempts,
+		FetchFailures:       m.failures,
+		FetchLatencyBuckets: make(map[float64]uint64, len(fetchLatencyBuckets)),
+		FetchLatencyCount:   m.attempts,
+		FetchLatencySum:     m.sum,
+	}
+	for i, bound := range fetchLatencyBuckets {
+		var count uint64
+		if m.buckets != nil {
+			count = m.buckets[i]
+		}
+		metrics.FetchLatencyBuckets[bound] = count
+	}
+	m.Unlock()
+
+	if credentials != nil {
+		metrics.CredentialsTTL = credentials.Remaining()
+	}
+	return metrics
+}
@@ -1,15 +1,142 @@
 package turnservicecli
 
 import (
-	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
 )
 
-func makeNonce() (string, error) {
+const (
+	// Remember this many of the most recently issued nonces.
+	maxRecentNonces = 1024
+
+	// Give up if random repeats a recent nonce this many times.
+	maxNonceAttempts = 3
+)
+
+// A NonceMode defines how nonces are sent to and validated against the
+// responses of the remote service.
+type NonceMode int
+
+const (
+	// NonceRequired sends a nonce with every request and requires the
+	// response to echo it. This is the default.
+	NonceRequired NonceMode = iota
+	// NonceOptional sends a nonce with every request but accepts responses
+	// without nonce. A nonce in the response must still match.
+	NonceOptional
+	// NonceDisabled sends no nonce and skips validation of the response.
+	NonceDisabled
+)
+
+// SetNonceMode sets the NonceMode used for requests to the remote service,
+// for example to talk to server versions which do not echo the nonce.
+func (service *TURNService) SetNonceMode(mode NonceMode) {
+	service.Lock()
+	defer service.Unlock()
+	service.nonceMode = mode
+}
+
+// checkNonce validates the nonce received in a response to a request sent
+// with nonce according to the NonceMode. Each nonce is accepted only once,
+// so replayed responses are rejected.
+func (service *TURNService) checkNonce(nonce, received string) error {
+	service.RLock()
+	mode := service.nonceMode
+	service.RUnlock()
+	switch {
+	case mode == NonceDisabled:
+		return nil
+	case mode == NonceOptional && received == "":
+		return nil
+	case subtle.ConstantTimeCompare([]byte(received), []byte(nonce)) != 1:
+		return ErrInvalidNonce
+	case !service.nonces.consume(nonce):
+		return fmt.Errorf("%w: replayed response", ErrInvalidNonce)
+	}
+	return nil
+}
+
+// recentNonces tracks the most recently issued nonces and if a response with
+// them has been accepted.
+type recentNonces struct {
+	sync.Mutex
+
+	answered map[string]bool
+	order    []string
+}
+
+// issue returns a new nonce read from random which differs from the recently
+// issued nonces.
+func (r *recentNonces) issue(random io.Reader) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.answered == nil {
+		r.answered = make(map[string]bool)
+	}
+	for attempt := 0; attempt < maxNonceAttempts; attempt++ {
+		nonce, err := makeNonce(random)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := r.answered[nonce]; ok {
+			continue
+		}
+		if len(r.order) >= maxRecentNonces {
+			delete(r.answered, r.order[0])
+			r.order = r.order[1:]
+		}
+		r.answered[nonce] = false
+		r.order = append(r.order, nonce)
+		return nonce, nil
+	}
+	return "", errors.New("random source repeats nonces")
+}
+
+// consume marks nonce as answered, it returns false if nonce was not issued
+// recently or has already been answered.
+func (r *recentNonces) consume(nonce string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if answered, ok := r.answered[nonce]; !ok || answered {
+		return false
+	}
+	r.answered[nonce] = true
+	return true
+}
+
+func makeNonce(random io.Reader) (string, error) {
 	nonce := make([]byte, 32)
-	_, err := rand.Read(nonce)
+	_, err := io.ReadFull(random, nonce)
 	if err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(nonce), nil
 }
+
+// randomFloat returns a random number in [0,1) read from random.
+func randomFloat(random io.Reader) (float64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(random, b[:]); err != nil {
+		return 0, err
+	}
+	// Use 53 bits, the precision of a float64.
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53), nil
+}
+
+// jitter returns a random duration in [0,d*fraction) read from random.
+func jitter(random io.Reader, d time.Duration, fraction float64) (time.Duration, error) {
+	if d <= 0 || fraction <= 0 {
+		return 0, nil
+	}
+	f, err := randomFloat(random)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(float64(d) * fraction * f), nil
+}
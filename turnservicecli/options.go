@@ -0,0 +1,166 @@
+package turnservicecli
+
+import (
+	"crypto/tls"
+	"math"
+	"net/http"
+	"time"
+)
+
+// An Option configures a TURNService created with NewTURNService.
+type Option func(*TURNService)
+
+// WithTLSConfig sets the TLS configuration used for requests to the remote
+// service. A copy is used, with a ClientSessionCache if it has none.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(service *TURNService) {
+		service.tlsConfig = tlsConfig
+	}
+}
+
+// WithExpirationPercentile sets the percentile of the TTL after which cached
+// credentials expire. Zero selects the default of 80.
+func WithExpirationPercentile(expirationPercentile uint) Option {
+	return func(service *TURNService) {
+		service.expirationPercentile = expirationPercentile
+	}
+}
+
+// WithRefreshInterval sets the interval of the refresh loop, see
+// TURNService.SetRefreshInterval.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(service *TURNService) {
+		if interval <= 0 {
+			interval = defaultRefreshInterval
+		}
+		service.refreshInterval = interval
+	}
+}
+
+// WithHTTPClient sets the http.Client used for requests to the remote
+// service, see TURNService.SetHTTPClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(service *TURNService) {
+		service.customClient = client
+	}
+}
+
+// WithRoundTripper sets the http.RoundTripper used for requests to the
+// remote service, see TURNService.SetRoundTripper.
+func WithRoundTripper(roundTripper http.RoundTripper) Option {
+	return func(service *TURNService) {
+		if roundTripper != nil {
+			service.customClient = &http.Client{Transport: roundTripper}
+		}
+	}
+}
+
+// WithLogger sets the Logger used for diagnostic messages.
+func WithLogger(logger Logger) Option {
+	return func(service *TURNService) {
+		service.logger.set(logger)
+	}
+}
+
+// WithFetchTimeout sets a default deadline for fetches, see
+// TURNService.WithDefaultFetchTimeout.
+func WithFetchTimeout(d time.Duration) Option {
+	return func(service *TURNService) {
+		service.defaultFetchTimeout = d
+	}
+}
+
+// WithMaxCredentialsTTL sets the maximum time after which fetched credentials
+// expire, see TURNService.SetMaxCredentialsTTL.
+func WithMaxCredentialsTTL(maxTTL time.Duration) Option {
+	return func(service *TURNService) {
+		service.maxCredentialsTTL = maxTTL
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent to the remote service.
+func WithUserAgent(userAgent string) Option {
+	return func(service *TURNService) {
+		service.userAgent = userAgent
+	}
+}
+
+// WithRetryPolicy sets how often failed fetches of credentials are attempted,
+// see TURNService.SetRetryPolicy.
+func WithRetryPolicy(maxAttempts int, base time.Duration) Option {
+	return func(service *TURNService) {
+		if maxAttempts < 1 {
+			maxAttempts = 1
+		}
+		service.retryMaxAttempts = maxAttempts
+		service.retryBase = base
+	}
+}
+
+// WithRefreshJitter sets the random jitter of refreshes and expiry, see
+// TURNService.SetRefreshJitter.
+func WithRefreshJitter(fraction float64) Option {
+	return func(service *TURNService) {
+		if fraction < 0 {
+			fraction = 0
+		} else if fraction >= 1 {
+			fraction = math.Nextafter(1, 0)
+		}
+		service.refreshJitter = fraction
+	}
+}
+
+// WithTracer sets the Tracer which traces fetches and requests, see
+// TURNService.SetTracer.
+func WithTracer(tracer Tracer) Option {
+	return func(service *TURNService) {
+		service.tracer = tracer
+	}
+}
+
+// WithProvider sets the Provider used to fetch credentials, see
+// TURNService.SetProvider.
+func WithProvider(provider Provider) Option {
+	return func(service *TURNService) {
+		service.provider = provider
+	}
+}
+
+// WithConnectTimeout sets the timeout to connect to the remote service.
+// Zero selects the default of 30 seconds, a negative d disables the timeout.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(service *TURNService) {
+		service.connectTimeout = d
+	}
+}
+
+// WithResponseHeaderTimeout sets the timeout to receive the response
+// headers after a request has been sent to the remote service. Zero selects
+// the default of 30 seconds, a negative d disables the timeout.
+func WithResponseHeaderTimeout(d time.Duration) Option {
+	return func(service *TURNService) {
+		service.responseHeaderTimeout = d
+	}
+}
+
+// WithRequestTimeout sets the timeout of a request to the remote service,
+// including connecting and reading the response body. Zero selects the
+// default of 60 seconds, a negative d disables the timeout. Fetches with
+// retries can take longer, see WithFetchTimeout to limit them.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(service *TURNService) {
+		service.requestTimeout = d
+	}
+}
+
+// timeoutOrDefault returns d with zero replaced by def and negative values
+// by zero, which disables timeouts.
+func timeoutOrDefault(d, def time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return def
+	case d < 0:
+		return 0
+	}
+	return d
+}
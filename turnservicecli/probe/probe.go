@@ -0,0 +1,144 @@
+/*
+Package probe measures the reachability and round trip time of the STUN and
+TURN servers of turnservicecli credentials, for example to select the
+servers with the lowest latency.
+
+STUN URNs are probed with a Binding request, TURN URNs by allocating a relay
+with the credentials, which is released again right away.
+*/
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+)
+
+// DefaultTimeout is the timeout of probes if the context has no deadline.
+const DefaultTimeout = 5 * time.Second
+
+// Result is the result of probing a STUN or TURN URN.
+type Result struct {
+	ServerID string
+	URN      string
+
+	// RTT is the round trip time of the first request to the server, after
+	// the connection has been established.
+	RTT time.Duration
+	// Mapped is the server reflexive address of the probe, if returned by
+	// the server.
+	Mapped net.Addr
+	// Relayed is the address of the relay allocated on a TURN server.
+	Relayed net.Addr
+
+	Err error
+}
+
+// Reachable returns if the server of the URN was reachable, and for TURN
+// URNs a relay could be allocated.
+func (r *Result) Reachable() bool {
+	return r.Err == nil
+}
+
+// URN probes a single urn, using username and password to allocate a relay
+// on TURN servers.
+func URN(ctx context.Context, urn, username, password string) *Result {
+	result := &Result{URN: urn}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	conn, err := dial(ctx, urn)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock pending reads.
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	var mapped, relayed *net.UDPAddr
+	if IsTURN(urn) {
+		relayed, mapped, result.RTT, err = conn.allocate(username, password, deadline)
+	} else {
+		mapped, result.RTT, err = conn.binding(deadline)
+	}
+	if err != nil {
+		var netErr net.Error
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		} else if errors.As(err, &netErr) && netErr.Timeout() {
+			// The read deadline is the deadline of ctx.
+			err = context.DeadlineExceeded
+		}
+		result.Err = err
+		return result
+	}
+	if mapped != nil {
+		result.Mapped = mapped
+	}
+	if relayed != nil {
+		result.Relayed = relayed
+	}
+	return result
+}
+
+// Servers probes all URNs of data concurrently and returns their results in
+// the order of the URNs of data. TURN URNs are probed with the credentials
+// for their transport, see turnservicecli.CredentialsData.CredentialsFor.
+func Servers(ctx context.Context, data *turnservicecli.CredentialsData) []*Result {
+	var results []*Result
+	var wg sync.WaitGroup
+	for _, server := range data.Servers {
+		for _, urn := range server.URNs {
+			result := &Result{ServerID: server.ID, URN: urn}
+			results = append(results, result)
+			wg.Add(1)
+			go func(result *Result) {
+				defer wg.Done()
+				username, password := data.CredentialsFor(result.URN)
+				id := result.ServerID
+				*result = *URN(ctx, result.URN, username, password)
+				result.ServerID = id
+			}(result)
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// RTTs probes all URNs of data like Servers and returns the round trip times
+// of the reachable URNs. It is a turnservicecli.LatencyProber, for use with
+// TURNService.SetLatencyProbing.
+func RTTs(ctx context.Context, data *turnservicecli.CredentialsData) map[string]time.Duration {
+	rtts := make(map[string]time.Duration)
+	for _, result := range Servers(ctx, data) {
+		if result.Reachable() {
+			rtts[result.URN] = result.RTT
+		}
+	}
+	return rtts
+}
+
+// IsTURN returns if urn refers to a TURN server, the scheme is matched case
+// insensitively.
+func IsTURN(urn string) bool {
+	urn = strings.ToLower(urn)
+	return strings.HasPrefix(urn, "turn:") || strings.HasPrefix(urn, "turns:")
+}
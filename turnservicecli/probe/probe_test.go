@@ -0,0 +1,166 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+)
+
+func TestParseURN(t *testing.T) {
+	testcases := []struct {
+		urn       string
+		scheme    string
+		address   string
+		transport string
+	}{
+		{"stun:stun.example.com", "stun", "stun.example.com:3478", "udp"},
+		{"turn:turn.example.com:1234?transport=tcp", "turn", "turn.example.com:1234", "tcp"},
+		{"turns:[2001:db8::1]", "turns", "[2001:db8::1]:5349", "tcp"},
+		{"TURN:192.0.2.1:3478?transport=UDP", "turn", "192.0.2.1:3478", "udp"},
+	}
+	for _, testcase := range testcases {
+		scheme, address, transport, err := parseURN(testcase.urn)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", testcase.urn, err)
+			continue
+		}
+		if scheme != testcase.scheme || address != testcase.address || transport != testcase.transport {
+			t.Errorf("%s: unexpected result %s %s %s", testcase.urn, scheme, address, transport)
+		}
+	}
+
+	for _, urn := range []string{"invalid", "http://example.com", "turn:?transport=tcp", "turn:example.com?transport=sctp"} {
+		if _, _, _, err := parseURN(urn); err == nil {
+			t.Errorf("%s: expected error", urn)
+		}
+	}
+}
+
+func TestSTUNMessage(t *testing.T) {
+	key := stunLongTermKey("user", "example.com", "password")
+	m := newSTUNMessage(stunAllocateRequest)
+	m.add(stunAttrUsername, []byte("user"))
+	m.add(stunAttrNonce, []byte("a nonce"))
+
+	decoded, err := decodeSTUNMessage(m.encode(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.typ != m.typ || decoded.transactionID != m.transactionID {
+		t.Errorf("unexpected header %+v", decoded)
+	}
+	if string(decoded.get(stunAttrNonce)) != "a nonce" {
+		t.Errorf("unexpected nonce %q", decoded.get(stunAttrNonce))
+	}
+	if !decoded.checkIntegrity(key) {
+		t.Error("message integrity must match")
+	}
+	if decoded.checkIntegrity(stunLongTermKey("user", "example.com", "wrong")) {
+		t.Error("message integrity must not match other keys")
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}
+	m.add(stunAttrXORRelayedAddress, xorAddressValue(addr, m.transactionID))
+	if decoded, _ := decodeSTUNMessage(m.encode(nil)); decoded != nil {
+		if relayed, ok := decoded.xorAddress(stunAttrXORRelayedAddress); !ok || relayed.String() != addr.String() {
+			t.Errorf("expected relayed address %s, got %v", addr, relayed)
+		}
+	}
+
+	if _, err := decodeSTUNMessage(m.encode(nil)[:30]); err == nil {
+		t.Error("truncated message must fail")
+	}
+}
+
+func TestServers(t *testing.T) {
+	server, err := NewTestServer("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	addr := server.Addr().String()
+	data := &turnservicecli.CredentialsData{
+		Username: "user",
+		Password: "password",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "a", URNs: []string{"stun:" + addr, "turn:" + addr + "?transport=udp"}},
+			{ID: "b", URNs: []string{"turn:" + silent.LocalAddr().String()}},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancel()
+	results := Servers(ctx, data)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+
+	stun := results[0]
+	if !stun.Reachable() || stun.ServerID != "a" || stun.URN != "stun:"+addr {
+		t.Fatalf("unexpected STUN result %+v", stun)
+	}
+	if stun.Mapped == nil || stun.Relayed != nil || stun.RTT <= 0 {
+		t.Errorf("STUN result must have a mapped address and RTT only, got %+v", stun)
+	}
+
+	turn := results[1]
+	if !turn.Reachable() || turn.ServerID != "a" {
+		t.Fatalf("unexpected TURN result %+v", turn)
+	}
+	if turn.Relayed == nil || turn.Relayed.String() != addr || turn.Mapped == nil || turn.RTT <= 0 {
+		t.Errorf("TURN result must have relayed and mapped address, got %+v", turn)
+	}
+	if n := server.Allocations(); n != 0 {
+		t.Errorf("allocation must be released, got %d", n)
+	}
+
+	if timeout := results[2]; timeout.Reachable() || timeout.ServerID != "b" || timeout.Err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %+v", timeout)
+	}
+}
+
+func TestURNWrongPassword(t *testing.T) {
+	server, err := NewTestServer("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	result := URN(context.Background(), "turn:"+server.Addr().String(), "user", "wrong")
+	if result.Reachable() || result.Err.Error() != "allocate failed: 401 Unauthorized" {
+		t.Errorf("expected unauthorized, got %v", result.Err)
+	}
+	if result.Relayed != nil {
+		t.Errorf("expected no relayed address, got %s", result.Relayed)
+	}
+}
+
+func TestRTTs(t *testing.T) {
+	server, err := NewTestServer("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	urn := "turn:" + server.Addr().String()
+	var prober turnservicecli.LatencyProber = RTTs
+	rtts := prober(context.Background(), &turnservicecli.CredentialsData{
+		Username: "user",
+		Password: "wrong",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "a", URNs: []string{"stun:" + server.Addr().String(), urn}},
+		},
+	})
+	if len(rtts) != 1 || rtts["stun:"+server.Addr().String()] <= 0 {
+		t.Errorf("expected RTT of reachable URN only, got %v", rtts)
+	}
+}
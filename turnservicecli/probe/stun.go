@@ -0,0 +1,455 @@
+package probe
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// STUN message types and attributes as defined in RFC 5389 and RFC 5766.
+const (
+	stunMagicCookie = 0x2112a442
+	stunHeaderSize  = 20
+
+	stunBindingRequest  = 0x0001
+	stunBindingSuccess  = 0x0101
+	stunBindingError    = 0x0111
+	stunAllocateRequest = 0x0003
+	stunAllocateSuccess = 0x0103
+	stunAllocateError   = 0x0113
+	stunRefreshRequest  = 0x0004
+
+	stunAttrUsername           = 0x0006
+	stunAttrMessageIntegrity   = 0x0008
+	stunAttrErrorCode          = 0x0009
+	stunAttrLifetime           = 0x000d
+	stunAttrRealm              = 0x0014
+	stunAttrNonce              = 0x0015
+	stunAttrXORRelayedAddress  = 0x0016
+	stunAttrRequestedTransport = 0x0019
+	stunAttrXORMappedAddress   = 0x0020
+
+	stunIntegritySize = 24
+	protocolUDP       = 17
+)
+
+// Initial retransmission timeout of STUN requests over UDP.
+const stunRTO = 500 * time.Millisecond
+
+// stunAttr is an attribute of a STUN message.
+type stunAttr struct {
+	typ   uint16
+	value []byte
+}
+
+// stunMessage is a STUN message.
+type stunMessage struct {
+	typ           uint16
+	transactionID [12]byte
+	attrs         []stunAttr
+
+	// raw is the encoding of a decoded message.
+	raw []byte
+}
+
+func newSTUNMessage(typ uint16) *stunMessage {
+	m := &stunMessage{typ: typ}
+	rand.Read(m.transactionID[:])
+	return m
+}
+
+func (m *stunMessage) add(typ uint16, value []byte) {
+	m.attrs = append(m.attrs, stunAttr{typ, value})
+}
+
+// get returns the value of the first attribute typ, nil if there is none.
+func (m *stunMessage) get(typ uint16) []byte {
+	for _, attr := range m.attrs {
+		if attr.typ == typ {
+			return attr.value
+		}
+	}
+	return nil
+}
+
+// encode returns the encoding of the message with a MESSAGE-INTEGRITY
+// attribute computed with key, none if key is nil.
+func (m *stunMessage) encode(key []byte) []byte {
+	buf := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(buf[0:], m.typ)
+	binary.BigEndian.PutUint32(buf[4:], stunMagicCookie)
+	copy(buf[8:], m.transactionID[:])
+	for _, attr := range m.attrs {
+		buf = appendSTUNAttr(buf, attr.typ, attr.value)
+	}
+	if key != nil {
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)-stunHeaderSize+stunIntegritySize))
+		buf = appendSTUNAttr(buf, stunAttrMessageIntegrity, stunIntegrity(buf, key))
+	}
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)-stunHeaderSize))
+	return buf
+}
+
+func appendSTUNAttr(buf []byte, typ uint16, value []byte) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[0:], typ)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(value)))
+	buf = append(buf, header[:]...)
+	buf = append(buf, value...)
+	if pad := len(value) % 4; pad != 0 {
+		buf = append(buf, make([]byte, 4-pad)...)
+	}
+	return buf
+}
+
+// stunIntegrity returns the HMAC-SHA1 of the message buf.
+func stunIntegrity(buf, key []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	return mac.Sum(nil)
+}
+
+// stunLongTermKey returns the key of long-term credentials.
+func stunLongTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+func decodeSTUNMessage(buf []byte) (*stunMessage, error) {
+	if len(buf) < stunHeaderSize || binary.BigEndian.Uint32(buf[4:]) != stunMagicCookie {
+		return nil, errors.New("not a STUN message")
+	}
+	length := int(binary.BigEndian.Uint16(buf[2:]))
+	if len(buf) != stunHeaderSize+length {
+		return nil, errors.New("invalid STUN message length")
+	}
+	m := &stunMessage{
+		typ: binary.BigEndian.Uint16(buf[0:]),
+		raw: buf,
+	}
+	copy(m.transactionID[:], buf[8:stunHeaderSize])
+	for offset := stunHeaderSize; offset < len(buf); {
+		if offset+4 > len(buf) {
+			return nil, errors.New("truncated STUN attribute")
+		}
+		typ := binary.BigEndian.Uint16(buf[offset:])
+		size := int(binary.BigEndian.Uint16(buf[offset+2:]))
+		if offset+4+size > len(buf) {
+			return nil, errors.New("truncated STUN attribute")
+		}
+		m.add(typ, buf[offset+4:offset+4+size])
+		offset += 4 + (size+3)&^3
+	}
+	return m, nil
+}
+
+// checkIntegrity returns if the MESSAGE-INTEGRITY attribute of the decoded
+// message matches key.
+func (m *stunMessage) checkIntegrity(key []byte) bool {
+	for offset := stunHeaderSize; offset+4 <= len(m.raw); {
+		typ := binary.BigEndian.Uint16(m.raw[offset:])
+		size := int(binary.BigEndian.Uint16(m.raw[offset+2:]))
+		if typ == stunAttrMessageIntegrity {
+			if size != sha1.Size || offset+4+size > len(m.raw) {
+				return false
+			}
+			buf := append([]byte(nil), m.raw[:offset]...)
+			binary.BigEndian.PutUint16(buf[2:], uint16(offset-stunHeaderSize+stunIntegritySize))
+			return hmac.Equal(stunIntegrity(buf, key), m.raw[offset+4:offset+4+size])
+		}
+		offset += 4 + (size+3)&^3
+	}
+	return false
+}
+
+// errorCode returns the error code and reason of an error response.
+func (m *stunMessage) errorCode() (int, string) {
+	value := m.get(stunAttrErrorCode)
+	if len(value) < 4 {
+		return 0, ""
+	}
+	return int(value[2]&0x7)*100 + int(value[3]), string(value[4:])
+}
+
+// xorAddress returns the address of a XOR-MAPPED-ADDRESS style attribute.
+func (m *stunMessage) xorAddress(typ uint16) (*net.UDPAddr, bool) {
+	value := m.get(typ)
+	if len(value) < 8 {
+		return nil, false
+	}
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:], stunMagicCookie)
+	copy(key[4:], m.transactionID[:])
+	port := binary.BigEndian.Uint16(value[2:]) ^ uint16(stunMagicCookie>>16)
+	var ip net.IP
+	switch value[1] {
+	case 1:
+		ip = make(net.IP, net.IPv4len)
+	case 2:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil, false
+	}
+	if len(value) < 4+len(ip) {
+		return nil, false
+	}
+	for i := range ip {
+		ip[i] = value[4+i] ^ key[i]
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, true
+}
+
+// xorAddressValue returns the value of a XOR-MAPPED-ADDRESS style attribute
+// of addr in a message with transactionID.
+func xorAddressValue(addr *net.UDPAddr, transactionID [12]byte) []byte {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:], stunMagicCookie)
+	copy(key[4:], transactionID[:])
+	ip, family := addr.IP.To4(), byte(1)
+	if ip == nil {
+		ip, family = addr.IP.To16(), 2
+	}
+	value := []byte{0, family, 0, 0}
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		value = append(value, ip[i]^key[i])
+	}
+	return value
+}
+
+// errorCodeValue returns the value of an ERROR-CODE attribute.
+func errorCodeValue(code int, reason string) []byte {
+	return append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...)
+}
+
+// stunConn sends STUN requests over a connection.
+type stunConn struct {
+	conn   net.Conn
+	stream bool
+}
+
+// parseURN returns the scheme, the address and the transport of a STUN or
+// TURN urn as defined in RFC 7064 and RFC 7065.
+func parseURN(urn string) (scheme, address, transport string, err error) {
+	idx := strings.Index(urn, ":")
+	if idx == -1 {
+		return "", "", "", fmt.Errorf("invalid URN %q", urn)
+	}
+	scheme = strings.ToLower(urn[:idx])
+	hostport := urn[idx+1:]
+	var port string
+	switch scheme {
+	case "stun", "turn":
+		transport, port = "udp", "3478"
+	case "stuns", "turns":
+		transport, port = "tcp", "5349"
+	default:
+		return "", "", "", fmt.Errorf("unsupported scheme of URN %q", urn)
+	}
+	if idx := strings.Index(hostport, "?"); idx != -1 {
+		for _, param := range strings.Split(hostport[idx+1:], "&") {
+			if strings.HasPrefix(param, "transport=") {
+				transport = strings.ToLower(strings.TrimPrefix(param, "transport="))
+			}
+		}
+		hostport = hostport[:idx]
+	}
+	if transport != "udp" && transport != "tcp" {
+		return "", "", "", fmt.Errorf("unsupported transport %q", transport)
+	}
+	host, p, splitErr := net.SplitHostPort(hostport)
+	if splitErr == nil {
+		port = p
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+	if host == "" {
+		return "", "", "", fmt.Errorf("invalid URN %q", urn)
+	}
+	return scheme, net.JoinHostPort(host, port), transport, nil
+}
+
+// dial connects to the server of urn.
+func dial(ctx context.Context, urn string) (*stunConn, error) {
+	scheme, address, transport, err := parseURN(urn)
+	if err != nil {
+		return nil, err
+	}
+	secure := scheme == "stuns" || scheme == "turns"
+	if secure && transport != "tcp" {
+		return nil, fmt.Errorf("unsupported transport %q for %s", transport, scheme)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, transport, address)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &stunConn{conn: conn, stream: transport == "tcp"}, nil
+}
+
+func (c *stunConn) Close() error {
+	return c.conn.Close()
+}
+
+// roundTrip sends the request with integrity key and returns the response
+// with the same transaction ID and the time since the last transmission of
+// the request. Requests over UDP are retransmitted until the deadline.
+func (c *stunConn) roundTrip(request *stunMessage, key []byte, deadline time.Time) (*stunMessage, time.Duration, error) {
+	buf := request.encode(key)
+	sent := time.Now()
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, 0, err
+	}
+
+	rto := stunRTO
+	for {
+		readDeadline := deadline
+		if next := sent.Add(rto); !c.stream && next.Before(deadline) {
+			readDeadline = next
+		}
+		c.conn.SetReadDeadline(readDeadline)
+		response, err := c.read()
+		if err != nil {
+			var netErr net.Error
+			if !c.stream && errors.As(err, &netErr) && netErr.Timeout() && time.Now().Before(deadline) {
+				// Retransmit, see RFC 5389 section 7.2.1.
+				sent = time.Now()
+				if _, err := c.conn.Write(buf); err != nil {
+					return nil, 0, err
+				}
+				rto *= 2
+				continue
+			}
+			return nil, 0, err
+		}
+		if response.transactionID == request.transactionID {
+			return response, time.Since(sent), nil
+		}
+	}
+}
+
+func (c *stunConn) read() (*stunMessage, error) {
+	if !c.stream {
+		buf := make([]byte, 1500)
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return decodeSTUNMessage(buf[:n])
+	}
+
+	header := make([]byte, stunHeaderSize)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, stunHeaderSize+int(binary.BigEndian.Uint16(header[2:])))
+	copy(buf, header)
+	if _, err := io.ReadFull(c.conn, buf[stunHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return decodeSTUNMessage(buf)
+}
+
+// binding sends a Binding request to the server and returns the server
+// reflexive address and the round trip time.
+func (c *stunConn) binding(deadline time.Time) (*net.UDPAddr, time.Duration, error) {
+	response, rtt, err := c.roundTrip(newSTUNMessage(stunBindingRequest), nil, deadline)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch response.typ {
+	case stunBindingSuccess:
+		mapped, ok := response.xorAddress(stunAttrXORMappedAddress)
+		if !ok {
+			return nil, 0, errors.New("missing mapped address in binding response")
+		}
+		return mapped, rtt, nil
+	case stunBindingError:
+		code, reason := response.errorCode()
+		return nil, 0, fmt.Errorf("binding failed: %d %s", code, reason)
+	}
+	return nil, 0, fmt.Errorf("unexpected STUN message type 0x%04x", response.typ)
+}
+
+// allocate allocates a UDP relay on the server with long-term credentials
+// and releases it again. It returns the relayed and the server reflexive
+// address and the round trip time of the first request.
+func (c *stunConn) allocate(username, password string, deadline time.Time) (relayed, mapped *net.UDPAddr, rtt time.Duration, err error) {
+	var key, realm, nonce []byte
+	// Send without credentials first to learn realm and nonce, once more if
+	// the nonce is stale.
+	for attempt := 0; attempt < 3; attempt++ {
+		request := newSTUNMessage(stunAllocateRequest)
+		request.add(stunAttrRequestedTransport, []byte{protocolUDP, 0, 0, 0})
+		if key != nil {
+			request.add(stunAttrUsername, []byte(username))
+			request.add(stunAttrRealm, realm)
+			request.add(stunAttrNonce, nonce)
+		}
+		response, d, err := c.roundTrip(request, key, deadline)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if attempt == 0 {
+			rtt = d
+		}
+
+		switch response.typ {
+		case stunAllocateSuccess:
+			if key == nil || !response.checkIntegrity(key) {
+				return nil, nil, 0, errors.New("invalid message integrity of allocate response")
+			}
+			relayed, ok := response.xorAddress(stunAttrXORRelayedAddress)
+			if !ok {
+				return nil, nil, 0, errors.New("missing relayed address in allocate response")
+			}
+			mapped, _ := response.xorAddress(stunAttrXORMappedAddress)
+			// Release the allocation, failures only let it time out.
+			refresh := newSTUNMessage(stunRefreshRequest)
+			refresh.add(stunAttrLifetime, []byte{0, 0, 0, 0})
+			refresh.add(stunAttrUsername, []byte(username))
+			refresh.add(stunAttrRealm, realm)
+			refresh.add(stunAttrNonce, nonce)
+			c.roundTrip(refresh, key, deadline)
+			return relayed, mapped, rtt, nil
+		case stunAllocateError:
+			code, reason := response.errorCode()
+			if (code == 401 && key == nil) || code == 438 {
+				realm, nonce = response.get(stunAttrRealm), response.get(stunAttrNonce)
+				if realm == nil || nonce == nil {
+					return nil, nil, 0, errors.New("missing realm or nonce in allocate response")
+				}
+				realm, nonce = append([]byte(nil), realm...), append([]byte(nil), nonce...)
+				key = stunLongTermKey(username, string(realm), password)
+				continue
+			}
+			return nil, nil, 0, fmt.Errorf("allocate failed: %d %s", code, reason)
+		default:
+			return nil, nil, 0, fmt.Errorf("unexpected STUN message type 0x%04x", response.typ)
+		}
+	}
+	return nil, nil, 0, errors.New("allocate failed: too many attempts")
+}
@@ -0,0 +1,118 @@
+package probe
+
+import (
+	"net"
+	"sync"
+)
+
+// TestServer is a minimal STUN and TURN server over UDP for use in tests. It
+// answers Binding requests and allocates relays with long-term credentials
+// of the realm "example.com". The relayed address of allocations is the
+// address of the TestServer, no data is relayed.
+type TestServer struct {
+	sync.Mutex
+
+	conn        net.PacketConn
+	key         []byte
+	username    string
+	requests    int
+	allocations int
+}
+
+// NewTestServer starts a TestServer on the loopback interface which accepts
+// username and password. The caller should call Close when finished.
+func NewTestServer(username, password string) (*TestServer, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &TestServer{
+		conn:     conn,
+		key:      stunLongTermKey(username, "example.com", password),
+		username: username,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address of the TestServer.
+func (s *TestServer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close stops the TestServer.
+func (s *TestServer) Close() error {
+	return s.conn.Close()
+}
+
+// Requests returns the number of requests the TestServer received.
+func (s *TestServer) Requests() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.requests
+}
+
+// Allocations returns the number of allocations which were not released.
+func (s *TestServer) Allocations() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.allocations
+}
+
+func (s *TestServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		request, err := decodeSTUNMessage(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			continue
+		}
+		s.Lock()
+		s.requests++
+		s.Unlock()
+		if response := s.handle(request, addr.(*net.UDPAddr)); response != nil {
+			s.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// handle returns the encoded response to request from addr.
+func (s *TestServer) handle(request *stunMessage, addr *net.UDPAddr) []byte {
+	response := &stunMessage{transactionID: request.transactionID}
+	switch request.typ {
+	case stunBindingRequest:
+		response.typ = stunBindingSuccess
+		response.add(stunAttrXORMappedAddress, xorAddressValue(addr, request.transactionID))
+		return response.encode(nil)
+	case stunAllocateRequest, stunRefreshRequest:
+	default:
+		return nil
+	}
+
+	response.typ = request.typ | 0x0110
+	switch {
+	case request.get(stunAttrMessageIntegrity) == nil:
+		response.add(stunAttrErrorCode, errorCodeValue(401, "Unauthorized"))
+		response.add(stunAttrRealm, []byte("example.com"))
+		response.add(stunAttrNonce, []byte("nonce"))
+		return response.encode(nil)
+	case string(request.get(stunAttrUsername)) != s.username || !request.checkIntegrity(s.key):
+		response.add(stunAttrErrorCode, errorCodeValue(401, "Unauthorized"))
+		return response.encode(nil)
+	}
+
+	response.typ = request.typ | 0x0100
+	s.Lock()
+	if request.typ == stunAllocateRequest {
+		s.allocations++
+		response.add(stunAttrXORRelayedAddress, xorAddressValue(s.conn.LocalAddr().(*net.UDPAddr), request.transactionID))
+		response.add(stunAttrXORMappedAddress, xorAddressValue(addr, request.transactionID))
+	} else if s.allocations > 0 {
+		s.allocations--
+	}
+	s.Unlock()
+	return response.encode(s.key)
+}
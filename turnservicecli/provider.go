@@ -0,0 +1,183 @@
+package turnservicecli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// A Provider fetches credentials for a TURNService with a protocol other
+// than the one of the Spreed TURN service, see SetProvider.
+type Provider interface {
+	// FetchCredentials fetches credentials for request.
+	FetchCredentials(ctx context.Context, request *ProviderRequest) (*CredentialsData, error)
+}
+
+// ProviderRequest defines a request of a TURNService to a Provider.
+type ProviderRequest struct {
+	// URI is the URI of the endpoint of the TURNService.
+	URI string
+	// AccessToken and ClientID are the values passed to Open.
+	AccessToken string
+	ClientID    string
+	// Client is the http.Client of the TURNService.
+	Client *http.Client
+	// UserAgent is the User-Agent header to send, empty for the default.
+	UserAgent string
+	// Header are further headers to send, for example the trace context of
+	// a PropagatingTracer.
+	Header http.Header
+}
+
+// SetProvider sets the Provider used to fetch credentials instead of the API
+// of the Spreed TURN service. Fetched credentials are cached and refreshed
+// as usual, sessions and nonces are not used. Passing nil restores the API
+// of the Spreed TURN service.
+func (service *TURNService) SetProvider(provider Provider) {
+	service.Lock()
+	defer service.Unlock()
+	service.provider = provider
+}
+
+// fetchFromProvider fetches credentials with provider from the endpoint at
+// uri.
+func (service *TURNService) fetchFromProvider(ctx context.Context, provider Provider, uri, accessToken, clientID string) (*CredentialsResponse, error) {
+	service.Lock()
+	service.reloadRootCAs()
+	service.Unlock()
+	service.RLock()
+	client := service.client
+	if service.customClient != nil {
+		client = service.customClient
+	}
+	request := &ProviderRequest{
+		URI:         uri,
+		AccessToken: accessToken,
+		ClientID:    clientID,
+		Client:      client,
+		UserAgent:   service.userAgent,
+		Header:      make(http.Header),
+	}
+	service.RUnlock()
+
+	ctx, span := service.startSpan(ctx, "turnservicecli.request", map[string]string{
+		"endpoint": "provider",
+		"uri":      uri,
+	})
+	service.injectTrace(ctx, request.Header)
+	turn, err := provider.FetchCredentials(ctx, request)
+	span.End(err)
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialsResponse{
+		Success: true,
+		Turn:    turn,
+	}, nil
+}
+
+// RESTProvider is a Provider for the TURN REST API of
+// draft-uberti-behave-turn-rest as served by coturn and others. Credentials
+// are requested with a GET request to the URI of the TURNService with the
+// parameters "service=turn", "username" and "key".
+type RESTProvider struct {
+	// Username is sent as username parameter, the client ID of the
+	// TURNService if empty.
+	Username string
+	// Key is sent as key parameter, the access token of the TURNService if
+	// empty. The parameter is omitted if both are empty.
+	Key string
+}
+
+// restResponse defines a response of the TURN REST API.
+type restResponse struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int64    `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+// FetchCredentials implements Provider. The URIs of the response become a
+// single server group with the ID "default".
+func (p *RESTProvider) FetchCredentials(ctx context.Context, request *ProviderRequest) (*CredentialsData, error) {
+	query := url.Values{}
+	query.Set("service", "turn")
+	username := p.Username
+	if username == "" {
+		username = request.ClientID
+	}
+	if username != "" {
+		query.Set("username", username)
+	}
+	key := p.Key
+	if key == "" {
+		key = request.AccessToken
+	}
+	if key != "" {
+		query.Set("key", key)
+	}
+
+	uri, err := url.Parse(request.URI)
+	if err != nil {
+		return nil, err
+	}
+	values := uri.Query()
+	for k, v := range query {
+		values[k] = v
+	}
+	uri.RawQuery = values.Encode()
+
+	httpRequest, err := http.NewRequest("GET", uri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	for key, values := range request.Header {
+		httpRequest.Header[key] = values
+	}
+	httpRequest.Header.Set("Accept", "application/json")
+	if request.UserAgent != "" {
+		httpRequest.Header.Set("User-Agent", request.UserAgent)
+	}
+	client := request.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	result, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	switch result.StatusCode {
+	case http.StatusOK:
+		// Success.
+	case http.StatusForbidden, http.StatusUnauthorized:
+		content, _ := ioutil.ReadAll(io.LimitReader(result.Body, maxErrorBodySize))
+		return nil, fmt.Errorf("%w: %s", ErrForbidden, content)
+	default:
+		content, _ := ioutil.ReadAll(io.LimitReader(result.Body, maxErrorBodySize))
+		return nil, &StatusError{"rest", result.StatusCode, content}
+	}
+
+	var response restResponse
+	if err := json.NewDecoder(result.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	turn := &CredentialsData{
+		TTL:      response.TTL,
+		Username: response.Username,
+		Password: response.Password,
+	}
+	if len(response.URIs) > 0 {
+		turn.Servers = []*URNsWithID{
+			{ID: "default", URNs: response.URIs},
+		}
+	}
+	return turn, nil
+}
@@ -0,0 +1,40 @@
+package turnservicecli
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// WithProxy sets the proxy for requests to the remote service, instead of
+// the proxy of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables. The scheme of proxyURL selects the protocol, http, https or
+// socks5, its user info authenticates with the proxy. A nil proxyURL
+// connects directly.
+func WithProxy(proxyURL *url.URL) Option {
+	return func(service *TURNService) {
+		if proxyURL == nil {
+			service.proxy = noProxy
+			return
+		}
+		service.proxy = http.ProxyURL(proxyURL)
+	}
+}
+
+// WithSOCKS5Proxy sets the SOCKS5 proxy at address for requests to the
+// remote service, see WithProxy. An empty username connects without
+// authentication.
+func WithSOCKS5Proxy(address, username, password string) Option {
+	proxyURL := &url.URL{
+		Scheme: "socks5",
+		Host:   address,
+	}
+	if username != "" {
+		proxyURL.User = url.UserPassword(username, password)
+	}
+	return WithProxy(proxyURL)
+}
+
+// noProxy connects requests directly.
+func noProxy(*http.Request) (*url.URL, error) {
+	return nil, nil
+}
@@ -0,0 +1,73 @@
+package turnservicecli
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"time"
+)
+
+// DefaultSecretTTL is the default TTL of credentials of a SecretProvider.
+const DefaultSecretTTL = 24 * time.Hour
+
+// SecretProvider is a Provider which derives time-limited credentials from
+// the shared secret of a TURN server, as configured with static-auth-secret
+// and use-auth-secret in coturn, without any request. The username is the
+// expiry timestamp of the credentials and the client ID, separated by a
+// colon, the password the base64 encoded HMAC of the username.
+type SecretProvider struct {
+	// Secret is the shared secret of the TURN server.
+	Secret string
+	// Servers are the server groups of the credentials.
+	Servers []*URNsWithID
+	// TTL is the time the credentials are valid, DefaultSecretTTL if zero.
+	TTL time.Duration
+	// Hash is the hash of the HMAC, sha1.New if nil. TURN servers which use
+	// SHA-256 for the secret need sha256.New.
+	Hash func() hash.Hash
+	// Clock provides the current time, the system clock if nil.
+	Clock Clock
+}
+
+// FetchCredentials implements Provider.
+func (p *SecretProvider) FetchCredentials(ctx context.Context, request *ProviderRequest) (*CredentialsData, error) {
+	if p.Secret == "" {
+		return nil, errors.New("missing secret")
+	}
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = DefaultSecretTTL
+	}
+	clock := p.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	h := p.Hash
+	if h == nil {
+		h = sha1.New
+	}
+
+	username := strconv.FormatInt(clock.Now().Add(ttl).Unix(), 10)
+	if request.ClientID != "" {
+		username += ":" + request.ClientID
+	}
+	mac := hmac.New(h, []byte(p.Secret))
+	mac.Write([]byte(username))
+
+	servers := make([]*URNsWithID, 0, len(p.Servers))
+	for _, server := range p.Servers {
+		s := *server
+		s.URNs = append([]string(nil), server.URNs...)
+		servers = append(servers, &s)
+	}
+	return &CredentialsData{
+		TTL:      int64(ttl / time.Second),
+		Username: username,
+		Password: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		Servers:  servers,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package turnservicecli
+
+// Session returns the session of the endpoint which last returned
+// credentials, or of the URI of the TURNService if there was none. It is
+// empty if no session has been established yet.
+func (service *TURNService) Session() string {
+	service.RLock()
+	defer service.RUnlock()
+	uri := service.lastEndpoint
+	if uri == "" {
+		uri = service.uri
+	}
+	return service.endpointSession(uri)
+}
+
+// ResetSession forgets the sessions of all endpoints, so the next fetch
+// starts a new session. Cached credentials are kept.
+func (service *TURNService) ResetSession() {
+	service.Lock()
+	defer service.Unlock()
+	service.resetSessions()
+}
+
+// Sessions returns the sessions of all endpoints by their URI. Together with
+// SetSessions it can be used to keep sessions across restarts, for example
+// by storing the sessions from a handler registered with BindOnCredentials,
+// which is called after the session of a fetch has been applied.
+func (service *TURNService) Sessions() map[string]string {
+	service.RLock()
+	defer service.RUnlock()
+	sessions := make(map[string]string)
+	if service.session != "" {
+		sessions[service.uri] = service.session
+	}
+	for uri, session := range service.sessions {
+		if session != "" {
+			sessions[uri] = session
+		}
+	}
+	return sessions
+}
+
+// SetSessions restores sessions returned by Sessions, replacing the sessions
+// of all endpoints. Other than Open it keeps the access token and client ID.
+// Sessions of URIs which are not endpoints of the TURNService are ignored
+// when fetching.
+func (service *TURNService) SetSessions(sessions map[string]string) {
+	service.Lock()
+	defer service.Unlock()
+	service.resetSessions()
+	for uri, session := range sessions {
+		if uri == service.uri {
+			service.session = session
+			continue
+		}
+		if service.sessions == nil {
+			service.sessions = make(map[string]string)
+		}
+		service.sessions[uri] = session
+	}
+}
@@ -0,0 +1,28 @@
+//go:build go1.21
+// +build go1.21
+
+package turnservicecli
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// slogLogger is a Logger which writes to a slog.Logger.
+type slogLogger struct {
+	logger *slog.Logger
+	level  slog.Level
+}
+
+// NewSlogLogger returns a Logger which writes diagnostic messages to logger
+// at level, for use with SetLogger or WithLogger.
+func NewSlogLogger(logger *slog.Logger, level slog.Level) Logger {
+	return &slogLogger{logger, level}
+}
+
+func (l *slogLogger) Printf(format string, v ...interface{}) {
+	msg := strings.TrimPrefix(fmt.Sprintf(format, v...), "turnservicecli: ")
+	l.logger.Log(context.Background(), l.level, msg, "component", "turnservicecli")
+}
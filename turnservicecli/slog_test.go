@@ -0,0 +1,22 @@
+//go:build go1.21
+// +build go1.21
+
+package turnservicecli
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, nil)), slog.LevelWarn)
+	logger.Printf("turnservicecli: fetch %d: failed", 1)
+
+	line := buf.String()
+	if !strings.Contains(line, "level=WARN") || !strings.Contains(line, `msg="fetch 1: failed"`) || !strings.Contains(line, "component=turnservicecli") {
+		t.Errorf("unexpected log line: %s", line)
+	}
+}
@@ -0,0 +1,190 @@
+package turnservicecli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StoredCredentials defines credentials in a CredentialStore. Refresh is the
+// time when the credentials expire at their expiration percentile and should
+// be refreshed, Expires is the time when their TTL passes.
+type StoredCredentials struct {
+	Turn    *CredentialsData `json:"turn"`
+	Refresh time.Time        `json:"refresh"`
+	Expires time.Time        `json:"expires"`
+}
+
+// A CredentialStore stores the credentials fetched by a TURNService, for
+// example to share them between processes or to keep them across restarts.
+// Implementations must be safe for concurrent use.
+type CredentialStore interface {
+	// Get returns the credentials stored for key, nil if there are none or
+	// they have expired.
+	Get(key string) (*StoredCredentials, error)
+	// Put stores credentials for key, replacing any stored credentials.
+	Put(key string, credentials *StoredCredentials) error
+	// Delete removes the credentials stored for key.
+	Delete(key string) error
+}
+
+// memoryCredentialStore is a CredentialStore in memory.
+type memoryCredentialStore struct {
+	sync.Mutex
+
+	credentials map[string]*StoredCredentials
+}
+
+// NewMemoryCredentialStore returns a CredentialStore which keeps credentials
+// in memory. It is the default CredentialStore of a TURNService.
+func NewMemoryCredentialStore() CredentialStore {
+	return &memoryCredentialStore{
+		credentials: make(map[string]*StoredCredentials),
+	}
+}
+
+func (s *memoryCredentialStore) Get(key string) (*StoredCredentials, error) {
+	s.Lock()
+	defer s.Unlock()
+	credentials, ok := s.credentials[key]
+	if !ok {
+		return nil, nil
+	}
+	if !time.Now().Before(credentials.Expires) {
+		delete(s.credentials, key)
+		return nil, nil
+	}
+	return credentials, nil
+}
+
+func (s *memoryCredentialStore) Put(key string, credentials *StoredCredentials) error {
+	s.Lock()
+	defer s.Unlock()
+	s.credentials[key] = credentials
+	return nil
+}
+
+func (s *memoryCredentialStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.credentials, key)
+	return nil
+}
+
+// SetCredentialStore sets the CredentialStore to which fetched credentials
+// are written. Credentials in the store which do not need to be refreshed
+// yet are restored by Open and when a fetch fails, so the store must be set
+// before Open. Credentials are stored for the URI and the access token, client ID
+// and session passed to Open. Stored credentials are deleted when they are
+// expired early, for example by NotifyNetworkChanged, but kept when the
+// TURNService is closed. Passing nil restores the default in-memory store,
+// which is cleared by Open and Close.
+func (service *TURNService) SetCredentialStore(store CredentialStore) {
+	shared := store != nil
+	if store == nil {
+		store = NewMemoryCredentialStore()
+	}
+	service.Lock()
+	defer service.Unlock()
+	service.store = store
+	service.sharedStore = shared
+}
+
+// resetStore clears the default in-memory store, so credentials are not
+// restored for another identity, the caller must hold the lock.
+func (service *TURNService) resetStore() {
+	if !service.sharedStore {
+		service.store = NewMemoryCredentialStore()
+	}
+}
+
+// storeKey returns the key of the credentials of the TURNService in the
+// CredentialStore, the caller must hold the lock.
+func (service *TURNService) storeKey() string {
+	identity := sha256.Sum256([]byte(service.accessToken + "\x00" + service.openSession))
+	return fmt.Sprintf("%s|%s|%s", service.uri, service.clientID, hex.EncodeToString(identity[:]))
+}
+
+// persistCredentials writes credentials to the CredentialStore.
+func (service *TURNService) persistCredentials(credentials *CachedCredentialsData) {
+	service.RLock()
+	store := service.store
+	key := service.storeKey()
+	service.RUnlock()
+
+	credentials.RLock()
+	stored := &StoredCredentials{
+		Turn:    credentials.Turn,
+		Refresh: credentials.clock.Now().Add(time.Until(credentials.expiresAt)),
+		Expires: time.Unix(credentials.expires, 0),
+	}
+	credentials.RUnlock()
+	if err := store.Put(key, stored); err != nil {
+		service.logger.Printf("turnservicecli: failed to store credentials: %s", err)
+	}
+}
+
+// forgetCredentials removes the credentials from the CredentialStore, so
+// they are not restored after being expired.
+func (service *TURNService) forgetCredentials() {
+	service.RLock()
+	store := service.store
+	key := service.storeKey()
+	service.RUnlock()
+
+	if err := store.Delete(key); err != nil {
+		service.logger.Printf("turnservicecli: failed to delete stored credentials: %s", err)
+	}
+}
+
+// restoreCredentials caches and returns the credentials of the
+// CredentialStore if they do not need to be refreshed yet and the cached
+// credentials are still current, otherwise it returns nil.
+func (service *TURNService) restoreCredentials(current *CachedCredentialsData) *CachedCredentialsData {
+	service.RLock()
+	store := service.store
+	key := service.storeKey()
+	clock := service.clock
+	service.RUnlock()
+
+	stored, err := store.Get(key)
+	if err != nil {
+		service.logger.Printf("turnservicecli: failed to read stored credentials: %s", err)
+		return nil
+	}
+	if stored == nil || stored.Turn == nil {
+		return nil
+	}
+	now := clock.Now()
+	refresh := stored.Refresh.Sub(now)
+	ttl := stored.Expires.Unix() - now.Unix()
+	if refresh <= 0 || ttl < minCredentialsTTL {
+		return nil
+	}
+	turn := *stored.Turn
+	turn.TTL = ttl
+
+	service.Lock()
+	if service.credentials != current || service.static {
+		// Replaced in the meantime.
+		service.Unlock()
+		return nil
+	}
+	// Expire when they need to be refreshed, as with the percentile limit.
+	credentials := newCachedCredentialsData(&turn, 100, refresh, clock, 0, nil)
+	if current != nil {
+		current.Close()
+	}
+	service.credentials = credentials
+	handlers, synchronous := service.handlers, service.syncHandlers
+	service.Unlock()
+
+	service.emit(Event{Type: EventCached})
+	service.watchExpiry(credentials, 0)
+	service.watchExpiring(credentials)
+	service.watchLatency(credentials)
+	triggerHandlers(handlers, synchronous, credentials, nil)
+	return credentials
+}
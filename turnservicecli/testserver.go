@@ -0,0 +1,301 @@
+package turnservicecli
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestServer is a mock of the remote TURN service for use in tests. It serves
+// the credentials and geo endpoints, echoes the nonce of each request and
+// records the requests it received.
+type TestServer struct {
+	*httptest.Server
+	sync.Mutex
+
+	requests      int
+	times         []time.Time
+	status        int
+	failures      int
+	failStatus    int
+	geoStatus     int
+	release       <-chan struct{}
+	headers       []http.Header
+	turn          *CredentialsData
+	session       string
+	cacheable     *bool
+	authorization string
+	geo           *GeoData
+	geoRequests   int
+	nonces        []string
+	nonce         string
+	sessions      []string
+	forms         []url.Values
+}
+
+// NewTestServer starts a TestServer which responds with turn and the session
+// "test-session". The caller should call Close when finished.
+func NewTestServer(turn *CredentialsData) *TestServer {
+	s := &TestServer{
+		status:    http.StatusOK,
+		geoStatus: http.StatusOK,
+		turn:      turn,
+		session:   "test-session",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/turn/credentials", s.serveCredentials)
+	mux.HandleFunc("/api/v1/turn/geo", s.serveGeo)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *TestServer) serveGeo(w http.ResponseWriter, r *http.Request) {
+	if !validBearer(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	s.Lock()
+	s.geoRequests++
+	s.headers = append(s.headers, r.Header)
+	geo := s.geo
+	status := s.geoStatus
+	s.Unlock()
+
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&GeoResponse{
+		Success: geo != nil,
+		Nonce:   r.PostFormValue("nonce"),
+		Geo:     geo,
+	})
+}
+
+func (s *TestServer) serveCredentials(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests++
+	s.times = append(s.times, time.Now())
+	s.nonces = append(s.nonces, r.PostFormValue("nonce"))
+	s.sessions = append(s.sessions, requestSession(r))
+	s.forms = append(s.forms, r.PostForm)
+	s.authorization = r.Header.Get("Authorization")
+	s.headers = append(s.headers, r.Header)
+	status := s.status
+	if s.failures > 0 {
+		s.failures--
+		status = s.failStatus
+	}
+	turn := s.turn
+	session := s.session
+	cacheable := s.cacheable
+	nonce := s.nonce
+	release := s.release
+	s.Unlock()
+
+	if release != nil {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if status == http.StatusOK && !validBearer(r) {
+		status = http.StatusForbidden
+	}
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if nonce == "" {
+		nonce = r.PostFormValue("nonce")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&CredentialsResponse{
+		Success:   true,
+		Nonce:     nonce,
+		Turn:      turn,
+		Session:   session,
+		Cacheable: cacheable,
+	})
+}
+
+// validBearer returns if the Authorization header of r is either absent or
+// a Bearer token with an encoded accessToken and session.
+func validBearer(r *http.Request) bool {
+	values, ok := r.Header["Authorization"]
+	if !ok {
+		return true
+	}
+	if len(values) != 1 || !strings.HasPrefix(values[0], "Bearer ") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(values[0], "Bearer "))
+	return err == nil && strings.Count(string(decoded), ":") == 1
+}
+
+// requestSession returns the session encoded in the Authorization header of
+// r, empty if there is none.
+func requestSession(r *http.Request) string {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// SetStatus makes the credentials endpoint respond with the HTTP status code
+// status, any other than http.StatusOK responds with an error.
+func (s *TestServer) SetStatus(status int) {
+	s.Lock()
+	defer s.Unlock()
+	s.status = status
+}
+
+// FailNext makes the credentials endpoint respond to the next n requests
+// with the HTTP status code status, regardless of SetStatus.
+func (s *TestServer) FailNext(n, status int) {
+	s.Lock()
+	defer s.Unlock()
+	s.failures = n
+	s.failStatus = status
+}
+
+// SetGeoStatus makes the geo endpoint respond with the HTTP status code
+// status, any other than http.StatusOK responds with an error.
+func (s *TestServer) SetGeoStatus(status int) {
+	s.Lock()
+	defer s.Unlock()
+	s.geoStatus = status
+}
+
+// Hold makes requests to the credentials endpoint wait until release is
+// closed, or the request is cancelled, before they are answered. Requests
+// are counted before they wait. Passing nil answers new requests right away.
+func (s *TestServer) Hold(release <-chan struct{}) {
+	s.Lock()
+	defer s.Unlock()
+	s.release = release
+}
+
+// SetNonce makes the server reply with nonce instead of echoing the nonce of
+// the request.
+func (s *TestServer) SetNonce(nonce string) {
+	s.Lock()
+	defer s.Unlock()
+	s.nonce = nonce
+}
+
+// SetTurn sets the CredentialsData returned by the credentials endpoint.
+func (s *TestServer) SetTurn(turn *CredentialsData) {
+	s.Lock()
+	defer s.Unlock()
+	s.turn = turn
+}
+
+// SetTTL sets the TTL in seconds of the returned CredentialsData.
+func (s *TestServer) SetTTL(ttl int64) {
+	s.Lock()
+	defer s.Unlock()
+	if s.turn != nil {
+		turn := *s.turn
+		turn.TTL = ttl
+		s.turn = &turn
+	}
+}
+
+// SetSession sets the session returned by the credentials endpoint.
+func (s *TestServer) SetSession(session string) {
+	s.Lock()
+	defer s.Unlock()
+	s.session = session
+}
+
+// SetCacheable sets the cacheable hint returned by the credentials endpoint,
+// nil omits it.
+func (s *TestServer) SetCacheable(cacheable *bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.cacheable = cacheable
+}
+
+// SetGeo sets the GeoData returned by the geo endpoint, nil responds without
+// success.
+func (s *TestServer) SetGeo(geo *GeoData) {
+	s.Lock()
+	defer s.Unlock()
+	s.geo = geo
+}
+
+// Requests returns the number of requests to the credentials endpoint.
+func (s *TestServer) Requests() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.requests
+}
+
+// GeoRequests returns the number of requests to the geo endpoint.
+func (s *TestServer) GeoRequests() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.geoRequests
+}
+
+// Forms returns the forms of the requests to the credentials endpoint.
+func (s *TestServer) Forms() []url.Values {
+	s.Lock()
+	defer s.Unlock()
+	return append([]url.Values(nil), s.forms...)
+}
+
+// Sessions returns the sessions of the requests to the credentials endpoint.
+func (s *TestServer) Sessions() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.sessions...)
+}
+
+// Nonces returns the nonces of the requests to the credentials endpoint.
+func (s *TestServer) Nonces() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.nonces...)
+}
+
+// Times returns the times of the requests to the credentials endpoint.
+func (s *TestServer) Times() []time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return append([]time.Time(nil), s.times...)
+}
+
+// Headers returns the headers of the requests to the credentials and geo
+// endpoints.
+func (s *TestServer) Headers() []http.Header {
+	s.Lock()
+	defer s.Unlock()
+	return append([]http.Header(nil), s.headers...)
+}
+
+// Authorization returns the Authorization header of the last request to the
+// credentials endpoint.
+func (s *TestServer) Authorization() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.authorization
+}
@@ -0,0 +1,290 @@
+package turnservicecli
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configureTLS applies the TLS options of the TURNService to tlsConfig, which
+// must not be shared with the caller.
+func (service *TURNService) configureTLS(tlsConfig *tls.Config) {
+	if service.rootCAs != nil {
+		tlsConfig.RootCAs = service.loadRootCAs(service.rootCAs.pem)
+	} else if service.rootCAFile != nil {
+		pemCerts, err := service.rootCAFile.read()
+		if err != nil {
+			service.logger.Printf("turnservicecli: failed to read CA bundle: %s", err)
+		}
+		tlsConfig.RootCAs = service.loadRootCAs(pemCerts)
+	}
+	if service.clientCertificate != nil {
+		tlsConfig.GetClientCertificate = service.clientCertificate
+	}
+	if len(service.publicKeyPins) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifyPins(service.publicKeyPins, tlsConfig.VerifyPeerCertificate)
+	}
+	if service.clientCertificateFiles != nil {
+		tlsConfig.GetClientCertificate = service.clientCertificateFiles.get
+		// Resumed sessions keep the certificate of the full handshake.
+		tlsConfig.ClientSessionCache = &certificateSessionCache{
+			ClientSessionCache: tlsConfig.ClientSessionCache,
+			files:              service.clientCertificateFiles,
+		}
+	}
+}
+
+// rootCAs is a CA bundle, read again from file if it is modified.
+type rootCAs struct {
+	pem     []byte
+	path    string
+	modTime time.Time
+}
+
+// read reads the bundle from its file.
+func (r *rootCAs) read() ([]byte, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	r.modTime = info.ModTime()
+	return ioutil.ReadFile(r.path)
+}
+
+// modified returns if the file of the bundle has been modified since it
+// was read.
+func (r *rootCAs) modified() bool {
+	info, err := os.Stat(r.path)
+	return err == nil && !info.ModTime().Equal(r.modTime)
+}
+
+// loadRootCAs returns a CertPool with the PEM encoded certificates. An empty
+// pool is returned if there are none, so no certificate is trusted.
+func (service *TURNService) loadRootCAs(pemCerts []byte) *x509.CertPool {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		service.logger.Printf("turnservicecli: no certificates in CA bundle, certificate verification will fail")
+	}
+	return pool
+}
+
+// WithRootCAs sets the PEM encoded certificates of the CAs trusted for the
+// remote service, instead of the CAs of the system. It takes precedence over
+// the RootCAs of WithTLSConfig.
+func WithRootCAs(pemCerts []byte) Option {
+	return func(service *TURNService) {
+		service.rootCAs = &rootCAs{pem: pemCerts}
+		service.rootCAFile = nil
+	}
+}
+
+// WithRootCAFile is like WithRootCAs with the certificates read from the
+// file at path. The file is read again before a request when it has been
+// modified, new connections then use the updated CAs. If the bundle can not
+// be read or has no certificates, no certificate is trusted.
+func WithRootCAFile(path string) Option {
+	return func(service *TURNService) {
+		service.rootCAs = nil
+		service.rootCAFile = &rootCAs{path: path}
+	}
+}
+
+// reloadRootCAs reads the CA bundle file again if it has been modified and
+// replaces the transport with one trusting the new CAs, the service lock
+// must be held.
+func (service *TURNService) reloadRootCAs() {
+	bundle := service.rootCAFile
+	if bundle == nil || !bundle.modified() {
+		return
+	}
+	pemCerts, err := bundle.read()
+	if err != nil {
+		service.logger.Printf("turnservicecli: failed to read CA bundle: %s", err)
+		return
+	}
+
+	tlsConfig := service.tlsConfig.Clone()
+	tlsConfig.RootCAs = service.loadRootCAs(pemCerts)
+	// Do not resume sessions verified with the previous CAs.
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	if service.clientCertificateFiles != nil {
+		tlsConfig.ClientSessionCache = &certificateSessionCache{
+			ClientSessionCache: tlsConfig.ClientSessionCache,
+			files:              service.clientCertificateFiles,
+		}
+	}
+	previous := service.transport
+	service.tlsConfig = tlsConfig
+	service.transport = previous.Clone()
+	service.transport.TLSClientConfig = tlsConfig
+	service.client = service.newClient()
+	previous.CloseIdleConnections()
+	service.logger.Printf("turnservicecli: reloaded CA bundle %s", bundle.path)
+}
+
+// WithClientCertificate sets the client certificate presented to the remote
+// service for mutual TLS.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(service *TURNService) {
+		service.clientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+		service.clientCertificateFiles = nil
+	}
+}
+
+// WithClientCertificateFiles sets the client certificate presented to the
+// remote service for mutual TLS, loaded from the PEM encoded certFile and
+// keyFile as with tls.LoadX509KeyPair. The files are read at the first
+// handshake and again whenever one of them is modified, so new connections
+// use a rotated certificate. If the files can not be read, the previously
+// loaded certificate is used.
+func WithClientCertificateFiles(certFile, keyFile string) Option {
+	files := &certificateFiles{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	return func(service *TURNService) {
+		service.clientCertificate = nil
+		service.clientCertificateFiles = files
+	}
+}
+
+// PublicKeyPin returns the pin of the public key of cert, the base64 encoded
+// SHA-256 hash of its SubjectPublicKeyInfo, see WithPinnedPublicKeys.
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WithPinnedPublicKeys pins the public keys of the remote service, so a
+// compromised CA can not be used to intercept fetches. Connections are only
+// established if a certificate of a verified chain of the remote service has
+// a public key with one of pins, otherwise requests fail with a PinningError. Pins
+// are returned by PublicKeyPin and may be prefixed with "sha256/". Regular
+// certificate verification still applies, pinning the key of an
+// intermediate CA or a backup key allows rotating the certificate.
+func WithPinnedPublicKeys(pins ...string) Option {
+	return func(service *TURNService) {
+		service.publicKeyPins = make(map[string]bool, len(pins))
+		for _, pin := range pins {
+			service.publicKeyPins[strings.TrimPrefix(pin, "sha256/")] = true
+		}
+	}
+}
+
+// verifyPins returns a tls.Config.VerifyPeerCertificate function which
+// checks the verified chains against pins after verify. Certificates which
+// are presented but not part of a verified chain are never matched, so a
+// pinned certificate can not be appended to another chain. Without verified
+// chains, with InsecureSkipVerify, only the leaf certificate is matched.
+func verifyPins(pins map[string]bool, verify func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		chains := verifiedChains
+		if len(chains) == 0 {
+			if len(rawCerts) == 0 {
+				return &PinningError{}
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			chains = [][]*x509.Certificate{{leaf}}
+		}
+
+		var presented []string
+		seen := make(map[string]bool)
+		for _, chain := range chains {
+			for _, cert := range chain {
+				pin := PublicKeyPin(cert)
+				if pins[pin] {
+					return nil
+				}
+				if !seen[pin] {
+					seen[pin] = true
+					presented = append(presented, pin)
+				}
+			}
+		}
+		return &PinningError{Pins: presented}
+	}
+}
+
+// certificateFiles loads a certificate from files when they are modified.
+type certificateFiles struct {
+	sync.Mutex
+
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func (f *certificateFiles) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.Lock()
+	defer f.Unlock()
+	modTime, err := latestModTime(f.certFile, f.keyFile)
+	if err == nil && (f.cert == nil || !modTime.Equal(f.modTime)) {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(f.certFile, f.keyFile); err == nil {
+			f.cert = &cert
+			f.modTime = modTime
+		}
+	}
+	if f.cert == nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	return f.cert, nil
+}
+
+// changed returns if the files have been modified since the certificate
+// was loaded.
+func (f *certificateFiles) changed() bool {
+	f.Lock()
+	defer f.Unlock()
+	modTime, err := latestModTime(f.certFile, f.keyFile)
+	return err == nil && f.cert != nil && !modTime.Equal(f.modTime)
+}
+
+// certificateSessionCache is a tls.ClientSessionCache which does not resume
+// sessions after the files of the client certificate have been modified, so
+// the new certificate is presented in a full handshake.
+type certificateSessionCache struct {
+	tls.ClientSessionCache
+
+	files *certificateFiles
+}
+
+func (c *certificateSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	if c.files.changed() {
+		return nil, false
+	}
+	return c.ClientSessionCache.Get(sessionKey)
+}
+
+// latestModTime returns the latest modification time of files.
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,69 @@
+package turnservicecli
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// Exchange the access token again when it is valid for less than this
+	// many seconds.
+	minAccessTokenTTL = 10
+)
+
+// ComputeAccessToken returns the access token for clientID derived from the
+// shared secret of the TURN service, "h" followed by the hex encoded
+// HMAC-SHA256 of clientID.
+func ComputeAccessToken(secret, clientID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(clientID))
+	return "h" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// A TokenExchanger is a function which exchanges a long lived token for a
+// short lived access token, returning the access token and its expiry.
+type TokenExchanger func(ctx context.Context) (accessToken string, expiry time.Time, err error)
+
+// exchangedToken caches the access token obtained from a TokenExchanger.
+type exchangedToken struct {
+	sync.Mutex
+
+	exchanger   TokenExchanger
+	accessToken string
+	expiry      time.Time
+}
+
+func (t *exchangedToken) set(exchanger TokenExchanger) {
+	t.Lock()
+	defer t.Unlock()
+	t.exchanger = exchanger
+	t.accessToken = ""
+	t.expiry = time.Time{}
+}
+
+// get returns the cached access token, or exchanges a new one if the cached
+// token is about to expire. If no exchanger is set, accessToken is returned
+// unchanged.
+func (t *exchangedToken) get(ctx context.Context, accessToken string) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.exchanger == nil {
+		return accessToken, nil
+	}
+
+	if t.accessToken != "" && t.expiry.Sub(time.Now()) >= minAccessTokenTTL*time.Second {
+		return t.accessToken, nil
+	}
+
+	accessToken, expiry, err := t.exchanger(ctx)
+	if err != nil {
+		return "", err
+	}
+	t.accessToken = accessToken
+	t.expiry = expiry
+	return accessToken, nil
+}
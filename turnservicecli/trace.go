@@ -0,0 +1,62 @@
+package turnservicecli
+
+import (
+	"context"
+	"net/http"
+)
+
+// A Span is a traced operation started by a Tracer.
+type Span interface {
+	// End ends the span, err is the error of the operation if it failed.
+	End(err error)
+}
+
+// A Tracer starts spans for the requests of a TURNService, see the
+// turnserviceotel package for OpenTelemetry. The returned context carries
+// the span and is used for the operation.
+type Tracer interface {
+	Start(ctx context.Context, name string, attributes map[string]string) (context.Context, Span)
+}
+
+// A PropagatingTracer is a Tracer which propagates the trace context to the
+// remote service. Inject is called with the context of the span of each
+// request to add the trace context to its headers, for example as W3C
+// traceparent header.
+type PropagatingTracer interface {
+	Tracer
+	Inject(ctx context.Context, header http.Header)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(error) {}
+
+// SetTracer sets the Tracer which traces fetches and requests to the remote
+// service. Passing nil disables tracing.
+func (service *TURNService) SetTracer(tracer Tracer) {
+	service.Lock()
+	defer service.Unlock()
+	service.tracer = tracer
+}
+
+// startSpan starts a span with the Tracer if one is set.
+func (service *TURNService) startSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, Span) {
+	service.RLock()
+	tracer := service.tracer
+	service.RUnlock()
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name, attributes)
+}
+
+// injectTrace adds the trace context of ctx to header if the Tracer
+// propagates it.
+func (service *TURNService) injectTrace(ctx context.Context, header http.Header) {
+	service.RLock()
+	tracer, ok := service.tracer.(PropagatingTracer)
+	service.RUnlock()
+	if ok {
+		tracer.Inject(ctx, header)
+	}
+}
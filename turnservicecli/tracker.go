@@ -0,0 +1,75 @@
+package turnservicecli
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+type trackedCredentials struct {
+	fingerprint [sha256.Size]byte
+	fetched     time.Time
+}
+
+// credentialsTracker records the fingerprints of fetched credentials in a
+// bounded ring.
+type credentialsTracker struct {
+	sync.Mutex
+
+	entries []trackedCredentials
+	next    int
+}
+
+func credentialsFingerprint(turn *CredentialsData) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(turn.Username))
+	h.Write([]byte{0})
+	h.Write([]byte(turn.Password))
+	var fingerprint [sha256.Size]byte
+	copy(fingerprint[:], h.Sum(nil))
+	return fingerprint
+}
+
+// reset discards all recorded entries and keeps at most size entries from
+// now on. A size of zero disables tracking.
+func (tracker *credentialsTracker) reset(size int) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	if size <= 0 {
+		tracker.entries = nil
+	} else {
+		tracker.entries = make([]trackedCredentials, 0, size)
+	}
+	tracker.next = 0
+}
+
+func (tracker *credentialsTracker) record(turn *CredentialsData, fetched time.Time) {
+	tracker.Lock()
+	defer tracker.Unlock()
+	if cap(tracker.entries) == 0 {
+		return
+	}
+
+	entry := trackedCredentials{
+		fingerprint: credentialsFingerprint(turn),
+		fetched:     fetched,
+	}
+	if len(tracker.entries) < cap(tracker.entries) {
+		tracker.entries = append(tracker.entries, entry)
+	} else {
+		tracker.entries[tracker.next] = entry
+	}
+	tracker.next = (tracker.next + 1) % cap(tracker.entries)
+}
+
+func (tracker *credentialsTracker) distinctSince(t time.Time) int {
+	tracker.Lock()
+	defer tracker.Unlock()
+	distinct := make(map[[sha256.Size]byte]bool)
+	for _, entry := range tracker.entries {
+		if !entry.fetched.Before(t) {
+			distinct[entry.fingerprint] = true
+		}
+	}
+	return len(distinct)
+}
@@ -2,13 +2,20 @@ package turnservicecli
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,198 +23,1211 @@ import (
 const (
 	requestTimeoutSeconds = 30
 
+	// Default timeouts of requests to the remote service, to connect, to
+	// receive the response headers and to complete the request.
+	defaultConnectTimeout        = 30 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultRequestTimeout        = 60 * time.Second
+
+	// Check for refresh at this interval by default.
+	defaultRefreshInterval = 1 * time.Minute
+
 	// Still return "expired" credentials if they are valid for at least this
 	// many seconds (but trigger refresh).
 	minCredentialsTTL = 10
+
+	// Keep at most this many bytes of the body of unexpected responses.
+	maxErrorBodySize = 4096
+
+	// Interval at which the warning about disabled TLS certificate
+	// verification is repeated.
+	insecureWarningInterval = 1 * time.Hour
 )
 
 // A TURNCredentialsHandler is a function handler which can be registered to
 // get called when the cached TURN credentials change.
 type TURNCredentialsHandler func(*CachedCredentialsData, error)
 
+// A RefreshFailurePolicy defines how the TURNService treats its cached
+// credentials when an automatic refresh fails to fetch new credentials.
+type RefreshFailurePolicy int
+
+const (
+	// RefreshFailureKeep keeps the last credentials until their TTL has
+	// passed. This is the default.
+	RefreshFailureKeep RefreshFailurePolicy = iota
+	// RefreshFailureInvalidate drops the last credentials immediately.
+	RefreshFailureInvalidate
+	// RefreshFailureCallback keeps the last credentials and invokes the
+	// handler registered with SetRefreshFailurePolicy.
+	RefreshFailureCallback
+)
+
 // A TURNService provides the TURN service remote API.
 type TURNService struct {
 	sync.RWMutex
+	fetching *credentialsCall
 
-	uri                  string
-	tlsConfig            *tls.Config
-	expirationPercentile uint
+	uri                    string
+	uris                   []string
+	tlsConfig              *tls.Config
+	clientCertificate      func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	clientCertificateFiles *certificateFiles
+	publicKeyPins          map[string]bool
+	proxy                  func(*http.Request) (*url.URL, error)
+	dialContext            func(ctx context.Context, network, address string) (net.Conn, error)
+	http3                  http.RoundTripper
+	connectTimeout         time.Duration
+	responseHeaderTimeout  time.Duration
+	requestTimeout         time.Duration
+	rootCAs                *rootCAs
+	rootCAFile             *rootCAs
+	expirationPercentile   uint
+	maxCredentialsTTL      time.Duration
+	transport              *http.Transport
+	client                 *http.Client
+	customClient           *http.Client
+	codec                  ResponseCodec
+	provider               Provider
+	random                 io.Reader
+	clientIDOnlyAuth       bool
+	networkSessionReset    bool
+	externalIPHint         func() string
+	warnNoTransport        bool
+	nonceMode              NonceMode
+	skipValidation         bool
+	userAgent              string
+	headers                http.Header
+	defaultFetchTimeout    time.Duration
+	staleGrace             time.Duration
 
-	session     string
-	accessToken string
-	clientID    string
+	insecureWarningLock sync.Mutex
+	insecureWarning     time.Time
 
-	credentials *CachedCredentialsData
-	err         error
-	autorefresh bool
+	session        string
+	openSession    string
+	sessions       map[string]string
+	lastEndpoint   string
+	stickyEndpoint bool
+	accessToken    string
+	clientID       string
+	token          exchangedToken
+	logger         serviceLogger
+	tracker        credentialsTracker
+
+	credentials   *CachedCredentialsData
+	uncached      *CachedCredentialsData
+	store         CredentialStore
+	sharedStore   bool
+	err           error
+	geo           cachedGeoData
+	autorefresh   bool
+	static        bool
+	refreshing    int
+	revalidating  bool
+	fetches       uint64
+	metrics       fetchMetrics
+	tracer        Tracer
+	prober        LatencyProber
+	latencies     *latencies
+	probeStop     chan struct{}
+	probeInterval time.Duration
+	nonces        recentNonces
+	events        serviceEvents
 
-	handlers []TURNCredentialsHandler
-	refresh  chan bool
-	quit     chan bool
+	clock                 Clock
+	cachePredicate        func(*CredentialsResponse) bool
+	refreshFailurePolicy  RefreshFailurePolicy
+	refreshFailureHandler TURNCredentialsHandler
+	refreshBackoffBase    time.Duration
+	refreshBackoffMax     time.Duration
+	refreshInterval       time.Duration
+	refreshJitter         float64
+	retryMaxAttempts      int
+	retryBase             time.Duration
+
+	handlers         []boundHandler
+	bindings         uint64
+	expiringHandlers []expiringHandler
+	syncHandlers     bool
+	refresh          chan bool
+	quit             chan bool // nil while the refresh loop is not running
+	done             chan bool // closed when the refresh loop has stopped
+	closed           bool
+	ctx              context.Context
+	released         chan bool // closed by Close
 }
 
-// NewTURNService creates a TURNService.
-func NewTURNService(uri string, expirationPercentile uint, tlsConfig *tls.Config) *TURNService {
-	if expirationPercentile == 0 {
-		expirationPercentile = 80
+// NewTURNService creates a TURNService for the remote service at uri,
+// configured with opts.
+func NewTURNService(uri string, opts ...Option) *TURNService {
+	service := &TURNService{
+		uri:                uri,
+		maxCredentialsTTL:  DefaultMaxCredentialsTTL,
+		codec:              JSONCodec,
+		random:             rand.Reader,
+		clock:              systemClock{},
+		refreshBackoffBase: defaultRefreshBackoffBase,
+		refreshBackoffMax:  defaultRefreshBackoffMax,
+		refreshInterval:    defaultRefreshInterval,
+		retryMaxAttempts:   1,
+		refresh:            make(chan bool, 1),
+		store:              NewMemoryCredentialStore(),
+		ctx:                context.Background(),
+		released:           make(chan bool),
 	}
-	if tlsConfig == nil {
-		tlsConfig = &tls.Config{
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
-			InsecureSkipVerify: false,
-		}
+	for _, opt := range opts {
+		opt(service)
 	}
 
-	service := &TURNService{
-		uri:                  uri,
-		tlsConfig:            tlsConfig,
-		expirationPercentile: expirationPercentile,
-		quit:                 make(chan bool),
-		refresh:              make(chan bool, 1),
+	if service.expirationPercentile == 0 {
+		service.expirationPercentile = 80
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: false,
+	}
+	if service.tlsConfig != nil {
+		// Configure the shared transport without modifying the
+		// configuration of the caller.
+		tlsConfig = service.tlsConfig.Clone()
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		// Enable TLS session resumption for the shared transport.
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
 	}
+	service.configureTLS(tlsConfig)
+	service.tlsConfig = tlsConfig
+	if service.proxy == nil {
+		service.proxy = http.ProxyFromEnvironment
+	}
+	service.connectTimeout = timeoutOrDefault(service.connectTimeout, defaultConnectTimeout)
+	service.responseHeaderTimeout = timeoutOrDefault(service.responseHeaderTimeout, defaultResponseHeaderTimeout)
+	service.requestTimeout = timeoutOrDefault(service.requestTimeout, defaultRequestTimeout)
+	service.transport = &http.Transport{
+		Proxy:                 service.proxy,
+		DialContext:           service.dialer(),
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Second * requestTimeoutSeconds,
+		ResponseHeaderTimeout: service.responseHeaderTimeout,
+	}
+	service.client = service.newClient()
+
+	return service
+}
+
+// NewTURNServiceContext creates a TURNService like NewTURNService, which is
+// closed when ctx is done. Background fetches of the TURNService, for example
+// of the refresh loop, are cancelled with ctx.
+func NewTURNServiceContext(ctx context.Context, uri string, opts ...Option) *TURNService {
+	service := NewTURNService(uri, opts...)
+	service.ctx = ctx
 	go func() {
-		// Check for refresh every minute.
-		ticker := time.NewTicker(1 * time.Minute)
-		autorefresh := false
-		for {
-			select {
-			case <-service.quit:
-				ticker.Stop()
-				return
-			case <-service.refresh:
-			case <-ticker.C:
-			}
+		select {
+		case <-ctx.Done():
+			service.Close()
+		case <-service.released:
+		}
+	}()
+	return service
+}
+
+// startLoop starts the refresh loop if it is not running, the service lock
+// must be held.
+func (service *TURNService) startLoop() {
+	if service.quit != nil || service.closed {
+		return
+	}
+	service.quit = make(chan bool)
+	service.done = make(chan bool)
+	go service.run(service.quit, service.done)
+}
+
+// stopLoop stops the refresh loop if it is running, the service lock must be
+// held. The loop exits asynchronously, after a pending fetch has completed.
+func (service *TURNService) stopLoop() {
+	if service.quit == nil {
+		return
+	}
+	close(service.quit)
+	service.quit = nil
+}
+
+func (service *TURNService) run(quit <-chan bool, done chan<- bool) {
+	defer close(done)
 
-			service.RLock()
-			autorefresh = service.autorefresh
-			service.RUnlock()
-			if autorefresh {
-				service.Credentials(true)
+	service.RLock()
+	interval := service.refreshInterval
+	service.RUnlock()
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+	}()
+
+	var jumps clockJumpDetector
+	var failures int
+	var nextAttempt time.Time
+	var retry <-chan time.Time
+	var jitterTimer <-chan time.Time
+	var jittered bool
+	for {
+		select {
+		case <-quit:
+			return
+		case <-service.refresh:
+		case <-ticker.C:
+		case <-retry:
+			retry = nil
+		case <-jitterTimer:
+			jitterTimer = nil
+			jittered = true
+		}
+
+		service.RLock()
+		autorefresh := service.autorefresh && !service.static
+		clock := service.clock
+		backoffBase := service.refreshBackoffBase
+		backoffMax := service.refreshBackoffMax
+		refreshInterval := service.refreshInterval
+		service.RUnlock()
+		if refreshInterval != interval {
+			interval = refreshInterval
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
+		}
+		if jumps.check(clock) {
+			// Expiry timers are unreliable after clock jumps (e.g.
+			// resume from sleep), so expire to trigger refresh.
+			service.logger.Printf("turnservicecli: clock jump detected, expiring credentials")
+			service.expireCredentials()
+		}
+		if !autorefresh {
+			continue
+		}
+		if failures > 0 && time.Now().Before(nextAttempt) {
+			// Backing off after failed refresh.
+			continue
+		}
+		if !jittered && failures == 0 {
+			if delay := service.refreshJitterDelay(); delay > 0 {
+				// Spread refreshes of many services.
+				if jitterTimer == nil {
+					if service.logger.enabled() {
+						service.logger.Printf("turnservicecli: delaying refresh by %s", delay)
+					}
+					jitterTimer = time.After(delay)
+				}
+				continue
 			}
 		}
-	}()
+		jittered = false
 
-	return service
+		_, fetched, err := service.getCredentials(service.ctx, true)
+		if !fetched {
+			continue
+		}
+		if err != nil {
+			failures++
+			delay := backoffDelay(backoffBase, backoffMax, failures)
+			nextAttempt = time.Now().Add(delay)
+			if delay > 0 {
+				retry = time.After(delay)
+			}
+			if service.logger.enabled() {
+				service.logger.Printf("turnservicecli: refresh failed %d times, next attempt in %s: %s", failures, delay, err)
+			}
+			service.refreshFailed(err)
+		} else {
+			failures = 0
+			retry = nil
+		}
+	}
 }
 
 // Open sets the data to use for requests to the TURNService.
 func (service *TURNService) Open(accessToken, clientID, session string) {
 	service.Lock()
-	defer service.Unlock()
 	service.accessToken = accessToken
 	service.clientID = clientID
 	service.session = session
+	service.openSession = session
+	service.sessions = nil
+	service.resetStore()
+	current := service.credentials
+	service.Unlock()
+
+	if current == nil || current.Expired() {
+		// Use the stored credentials of the new identity.
+		service.restoreCredentials(current)
+	}
 }
 
 // Close expires all data and resets the data to use with the TURNService.
 func (service *TURNService) Close() {
 	service.Lock()
 	defer service.Unlock()
-	close(service.quit)
+	if !service.closed {
+		close(service.released)
+	}
+	service.closed = true
+	service.stopLoop()
 	if service.credentials != nil {
 		service.credentials.Close()
 	}
+	if service.uncached != nil {
+		service.uncached.Close()
+		service.uncached = nil
+	}
 	service.accessToken = ""
 	service.clientID = ""
-	service.session = ""
+	service.openSession = ""
+	service.resetSessions()
+	service.resetStore()
 }
 
+// scheduleRefresh triggers the refresh loop, the service lock must not be
+// held.
 func (service *TURNService) scheduleRefresh() {
 	select {
 	case service.refresh <- true:
+		service.emit(Event{Type: EventRefreshTriggered})
+		if service.logger.enabled() {
+			service.logger.Printf("turnservicecli: refresh triggered")
+		}
 	default:
 	}
 }
 
-// Autorefresh enables or disables automatic refresh of TURNService credentials.
+// Autorefresh enables or disables automatic refresh of TURNService
+// credentials. The background refresh loop is started when autorefresh is
+// enabled and stopped when it is disabled, it does not run before.
 func (service *TURNService) Autorefresh(autorefresh bool) {
 	service.Lock()
-	defer service.Unlock()
 	if autorefresh == service.autorefresh {
+		service.Unlock()
 		return
 	}
 	service.autorefresh = autorefresh
-	if autorefresh {
-		// Trigger instant refresh, do not care if already pending.
+	if !autorefresh {
+		service.stopLoop()
+		service.Unlock()
+		return
+	}
+	service.startLoop()
+	service.Unlock()
+
+	// Trigger instant refresh, do not care if already pending.
+	service.scheduleRefresh()
+}
+
+// SetTokenExchanger sets a TokenExchanger which is used to obtain the access
+// token for requests to the remote service, instead of the access token set
+// with Open. Exchanged access tokens are cached until they are about to
+// expire.
+func (service *TURNService) SetTokenExchanger(exchanger TokenExchanger) {
+	service.token.set(exchanger)
+}
+
+// IsInsecure returns if TLS certificate verification is disabled for requests
+// to the remote service.
+func (service *TURNService) IsInsecure() bool {
+	service.RLock()
+	defer service.RUnlock()
+	return service.isInsecure()
+}
+
+func (service *TURNService) isInsecure() bool {
+	transport := service.transport
+	if service.customClient != nil {
+		roundTripper := service.customClient.Transport
+		if roundTripper == nil {
+			roundTripper = http.DefaultTransport
+		}
+		var ok bool
+		if transport, ok = roundTripper.(*http.Transport); !ok {
+			return false
+		}
+	}
+	tlsConfig := transport.TLSClientConfig
+	return tlsConfig != nil && tlsConfig.InsecureSkipVerify
+}
+
+// warnInsecure logs a warning if TLS certificate verification is disabled,
+// at most once per insecureWarningInterval.
+func (service *TURNService) warnInsecure() {
+	service.RLock()
+	insecure := service.isInsecure()
+	uri := service.uri
+	service.RUnlock()
+	if !insecure {
+		return
+	}
+
+	service.insecureWarningLock.Lock()
+	defer service.insecureWarningLock.Unlock()
+	now := time.Now()
+	if !service.insecureWarning.IsZero() && now.Sub(service.insecureWarning) < insecureWarningInterval {
+		return
+	}
+	service.insecureWarning = now
+	service.logger.Printf("turnservicecli: WARNING: TLS certificate verification is disabled for %s", uri)
+}
+
+// SetClientIDOnlyAuth enables or disables authentication with only a clientID
+// and no access token, for services which authenticate clients by clientID.
+// It is disabled by default.
+func (service *TURNService) SetClientIDOnlyAuth(enabled bool) {
+	service.Lock()
+	defer service.Unlock()
+	service.clientIDOnlyAuth = enabled
+}
+
+// SetWarnRelaysWithoutTransport enables or disables a warning which is logged
+// for fetched relay URNs without an explicit transport parameter, see
+// CredentialsData.RelaysWithoutTransport.
+func (service *TURNService) SetWarnRelaysWithoutTransport(warn bool) {
+	service.Lock()
+	defer service.Unlock()
+	service.warnNoTransport = warn
+}
+
+// SetExternalIPHint sets the external IP address of the client, which is sent
+// with requests so the remote service can select relays close to the
+// client. An empty ip disables the hint.
+func (service *TURNService) SetExternalIPHint(ip string) {
+	if ip == "" {
+		service.SetExternalIPHintFunc(nil)
+		return
+	}
+	service.SetExternalIPHintFunc(func() string {
+		return ip
+	})
+}
+
+// SetExternalIPHintFunc sets a function which returns the external IP
+// address of the client for each request, see SetExternalIPHint. The hint is
+// omitted when the function returns an empty string.
+func (service *TURNService) SetExternalIPHintFunc(f func() string) {
+	service.Lock()
+	defer service.Unlock()
+	service.externalIPHint = f
+}
+
+// WithDefaultFetchTimeout sets a default deadline for fetches whose context
+// has no deadline of its own. A deadline set on the context of the caller
+// always wins, even if it is later than d. Passing 0 disables the default.
+// It returns the TURNService to allow chaining.
+func (service *TURNService) WithDefaultFetchTimeout(d time.Duration) *TURNService {
+	service.Lock()
+	defer service.Unlock()
+	service.defaultFetchTimeout = d
+	return service
+}
+
+// fetchContext returns ctx with the default fetch timeout applied if ctx has
+// no deadline.
+func (service *TURNService) fetchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	service.RLock()
+	timeout := service.defaultFetchTimeout
+	service.RUnlock()
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// SetStaleWhileRevalidate enables serving expired credentials for up to grace
+// after their expiration percentile has passed. Such stale credentials are
+// returned immediately while new credentials are fetched in the background.
+// Credentials are never served after their TTL has passed. Passing 0
+// disables stale credentials, which is the default.
+func (service *TURNService) SetStaleWhileRevalidate(grace time.Duration) {
+	service.Lock()
+	defer service.Unlock()
+	service.staleGrace = grace
+}
+
+// serveStale returns if the expired credentials may be served while they are
+// revalidated, and starts the revalidation if so.
+func (service *TURNService) serveStale(credentials *CachedCredentialsData) bool {
+	service.Lock()
+	defer service.Unlock()
+	if service.staleGrace <= 0 || !credentials.usableStale(service.staleGrace) {
+		return false
+	}
+	if !service.revalidating {
+		service.revalidating = true
+		go func() {
+			service.updateCredentials(service.ctx, credentials, func(current *CachedCredentialsData) bool {
+				return current != nil && !current.Expired()
+			})
+			service.Lock()
+			service.revalidating = false
+			service.Unlock()
+		}()
+	}
+	return true
+}
+
+// SetRandom sets the source of randomness used for nonces and jitter, for
+// example for FIPS compliance or deterministic tests. The Reader must be safe
+// for concurrent use. Passing nil restores the default crypto/rand Reader.
+func (service *TURNService) SetRandom(random io.Reader) {
+	if random == nil {
+		random = rand.Reader
+	}
+	service.Lock()
+	defer service.Unlock()
+	service.random = random
+}
+
+// SetResponseCodec sets the ResponseCodec used to negotiate and decode the
+// responses of the remote service. Passing nil restores the default JSONCodec.
+func (service *TURNService) SetResponseCodec(codec ResponseCodec) {
+	if codec == nil {
+		codec = JSONCodec
+	}
+	service.Lock()
+	defer service.Unlock()
+	service.codec = codec
+}
+
+// ConfigureTransport calls f with the http.Transport which is used for all
+// requests to the remote service, to allow tuning of settings like
+// MaxIdleConns or IdleConnTimeout. Changes must be made before the first
+// request is made. The transport is not used while a custom client is set
+// with SetHTTPClient.
+func (service *TURNService) ConfigureTransport(f func(*http.Transport)) {
+	service.Lock()
+	defer service.Unlock()
+	f(service.transport)
+}
+
+// SetValidateCredentials enables or disables the validation of fetched
+// credentials with CredentialsData.Validate, credentials which fail the
+// validation are not cached and the error is returned. Validation is enabled
+// by default, disable it for services which legitimately return credentials
+// without servers, for example with only a GeoURI.
+func (service *TURNService) SetValidateCredentials(validate bool) {
+	service.Lock()
+	defer service.Unlock()
+	service.skipValidation = !validate
+}
+
+// SetHTTPClient sets the http.Client used for all requests to the remote
+// service, for example with custom dialers or instrumented round trippers.
+// The Transport and timeouts of client are used as is, the TLS configuration
+// set with WithTLSConfig does not apply. Passing nil restores the internal
+// client.
+func (service *TURNService) SetHTTPClient(client *http.Client) {
+	service.Lock()
+	defer service.Unlock()
+	service.customClient = client
+}
+
+// SetRoundTripper is like SetHTTPClient with a client using roundTripper,
+// for example to wrap an instrumented or shared transport. Passing nil
+// restores the internal client.
+func (service *TURNService) SetRoundTripper(roundTripper http.RoundTripper) {
+	var client *http.Client
+	if roundTripper != nil {
+		client = &http.Client{Transport: roundTripper}
+	}
+	service.SetHTTPClient(client)
+}
+
+// SetUserAgent sets the User-Agent header sent with requests to the remote
+// service, to identify the client in access logs. An empty userAgent
+// restores the default of the http package.
+func (service *TURNService) SetUserAgent(userAgent string) {
+	service.Lock()
+	defer service.Unlock()
+	service.userAgent = userAgent
+}
+
+// SetHeader sets an additional header sent with requests to the remote
+// service, an empty value removes the header. The Authorization and
+// Content-Type headers are set by the TURNService and can not be overridden.
+func (service *TURNService) SetHeader(key, value string) {
+	service.Lock()
+	defer service.Unlock()
+	// Copy, the previous headers may be in use by a request.
+	headers := make(http.Header, len(service.headers)+1)
+	for k, v := range service.headers {
+		headers[k] = v
+	}
+	if value == "" {
+		headers.Del(key)
+	} else {
+		headers.Set(key, value)
+	}
+	service.headers = headers
+}
+
+// SetRefreshFailurePolicy sets the policy applied when an automatic refresh
+// fails to fetch new credentials. The handler is only used with the
+// RefreshFailureCallback policy.
+func (service *TURNService) SetRefreshFailurePolicy(policy RefreshFailurePolicy, h TURNCredentialsHandler) {
+	service.Lock()
+	defer service.Unlock()
+	service.refreshFailurePolicy = policy
+	service.refreshFailureHandler = h
+}
+
+// SetRefreshInterval sets the interval at which the refresh loop checks if
+// the credentials need to be refreshed, which should be well below the
+// expiry of short-lived credentials. An interval of zero or less restores
+// the default of one minute.
+func (service *TURNService) SetRefreshInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+	service.Lock()
+	changed := interval != service.refreshInterval
+	service.refreshInterval = interval
+	service.Unlock()
+
+	if changed {
+		// Wake up a running refresh loop to apply the interval.
 		service.scheduleRefresh()
 	}
 }
 
+// SetRefreshJitter sets the fraction of the remaining TTL of expired
+// credentials by which automatic refreshes are delayed randomly, so many
+// services with similar credentials do not refresh at the same time. Fetched
+// credentials also expire randomly earlier by up to this fraction of their
+// expiry. The fraction is clamped to [0,1), 0 disables the jitter which is
+// the default. A fraction of 0.1 is a reasonable choice for large
+// deployments.
+func (service *TURNService) SetRefreshJitter(fraction float64) {
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction >= 1 {
+		fraction = math.Nextafter(1, 0)
+	}
+	service.Lock()
+	defer service.Unlock()
+	service.refreshJitter = fraction
+}
+
+// refreshJitterDelay returns the random delay of an automatic refresh of the
+// current credentials, zero if they have not expired.
+func (service *TURNService) refreshJitterDelay() time.Duration {
+	service.RLock()
+	credentials := service.credentials
+	fraction := service.refreshJitter
+	random := service.random
+	service.RUnlock()
+	if credentials == nil || !credentials.Expired() {
+		return 0
+	}
+	delay, err := jitter(random, time.Duration(credentials.TTL())*time.Second, fraction)
+	if err != nil {
+		return 0
+	}
+	return delay
+}
+
+// SetRefreshBackoff sets the backoff of automatic refreshes after failed
+// fetches. The delay before the next attempt starts at base and doubles with
+// each consecutive failure up to max, which becomes the refresh interval
+// during sustained outages. The normal refresh cadence resumes after the next
+// successful fetch. A base of zero disables the backoff.
+func (service *TURNService) SetRefreshBackoff(base, max time.Duration) {
+	service.Lock()
+	defer service.Unlock()
+	service.refreshBackoffBase = base
+	service.refreshBackoffMax = max
+}
+
+func (service *TURNService) refreshFailed(err error) {
+	service.Lock()
+	credentials := service.credentials
+	policy := service.refreshFailurePolicy
+	h := service.refreshFailureHandler
+	if policy == RefreshFailureInvalidate && credentials != nil {
+		credentials.Close()
+		service.credentials = nil
+	}
+	service.Unlock()
+
+	if policy == RefreshFailureCallback && h != nil {
+		h(credentials, err)
+	}
+}
+
+// SetResetSessionOnNetworkChange enables or disables the reset of the session
+// on NotifyNetworkChanged. It is disabled by default.
+func (service *TURNService) SetResetSessionOnNetworkChange(reset bool) {
+	service.Lock()
+	defer service.Unlock()
+	service.networkSessionReset = reset
+}
+
+// NotifyNetworkChanged notifies the TURNService that the network of the
+// client has changed, for example from wifi to cellular. The cached
+// credentials are expired and new credentials are fetched in the background,
+// optionally with a new session (see SetResetSessionOnNetworkChange).
+func (service *TURNService) NotifyNetworkChanged() {
+	service.Lock()
+	if service.static {
+		service.Unlock()
+		return
+	}
+	if service.networkSessionReset {
+		service.resetSessions()
+	}
+	service.Unlock()
+
+	service.expireCredentials()
+	go service.getCredentials(service.ctx, true)
+}
+
+// SetStaticCredentials sets the provided CredentialsData as the current
+// credentials of the TURNService. In static mode no requests are made to the
+// remote service, credentials are returned until their TTL has passed and
+// autorefresh is a no-op.
+func (service *TURNService) SetStaticCredentials(turn *CredentialsData) {
+	service.Lock()
+	credentials := newCachedCredentialsData(turn, 100, DefaultMaxCredentialsTTL, service.clock, 0, nil)
+	if service.credentials != nil {
+		service.credentials.Close()
+	}
+	service.credentials = credentials
+	service.err = nil
+	service.static = true
+	handlers, synchronous := service.handlers, service.syncHandlers
+	service.Unlock()
+
+	service.watchExpiring(credentials)
+	service.watchLatency(credentials)
+	triggerHandlers(handlers, synchronous, credentials, nil)
+}
+
+// SetLogger sets the Logger used for diagnostic messages. Passing nil
+// disables logging.
+func (service *TURNService) SetLogger(logger Logger) {
+	service.logger.set(logger)
+}
+
+// SetMaxCredentialsTTL sets the maximum time after which fetched credentials
+// expire, regardless of the TTL returned by the remote service. Passing zero
+// or a negative duration disables the limit.
+func (service *TURNService) SetMaxCredentialsTTL(maxTTL time.Duration) {
+	service.Lock()
+	defer service.Unlock()
+	service.maxCredentialsTTL = maxTTL
+}
+
+// SetCachePredicate sets a function which decides if the credentials of a
+// response are cached. Credentials which are not cached are returned to the
+// caller, but fetched again on the next call, and closed after the next
+// fetch or when the TURNService is closed. Without predicate credentials are
+// cached unless the response has its cacheable hint set to false. The
+// predicate is called without holding locks of the TURNService, so it may
+// use its methods.
+func (service *TURNService) SetCachePredicate(predicate func(*CredentialsResponse) bool) {
+	service.Lock()
+	defer service.Unlock()
+	service.cachePredicate = predicate
+}
+
+// cacheable returns if the credentials of response are cached, the service
+// lock must not be held as the predicate may use the TURNService.
+func (service *TURNService) cacheable(response *CredentialsResponse) bool {
+	service.RLock()
+	predicate := service.cachePredicate
+	service.RUnlock()
+	if predicate != nil {
+		return predicate(response)
+	}
+	return response.Cacheable == nil || *response.Cacheable
+}
+
+// TrackCredentials enables tracking of the last size fetched credentials for
+// DistinctCredentialsSince. A size of zero disables tracking.
+func (service *TURNService) TrackCredentials(size int) {
+	service.tracker.reset(size)
+}
+
+// DistinctCredentialsSince returns the number of distinct credentials fetched
+// since t. Only credentials recorded while tracking is enabled are counted.
+func (service *TURNService) DistinctCredentialsSince(t time.Time) int {
+	return service.tracker.distinctSince(t)
+}
+
+// SetClock sets the Clock used by the TURNService to detect wall clock jumps,
+// to compute the TTL of cached credentials and to timestamp tracked
+// credentials.
+func (service *TURNService) SetClock(clock Clock) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	service.Lock()
+	defer service.Unlock()
+	service.clock = clock
+}
+
+// ForceExpireForTesting marks the current cached credentials as expired
+// immediately, so the next call to Credentials with fetch fetches new
+// credentials. It is intended to be used by tests only.
+func (service *TURNService) ForceExpireForTesting() {
+	service.expireCredentials()
+}
+
+func (service *TURNService) expireCredentials() {
+	service.RLock()
+	static := service.static
+	if service.credentials != nil && !static {
+		service.credentials.expire()
+	}
+	service.RUnlock()
+	if !static {
+		service.forgetCredentials()
+	}
+}
+
+// boundHandler is a TURNCredentialsHandler registered with BindOnCredentials.
+type boundHandler struct {
+	id uint64
+	h  TURNCredentialsHandler
+}
+
 // BindOnCredentials triggeres whenever new TURN credentials become available.
-func (service *TURNService) BindOnCredentials(h TURNCredentialsHandler) {
+// It returns a function which unbinds the handler again, calling it more than
+// once is a no-op.
+func (service *TURNService) BindOnCredentials(h TURNCredentialsHandler) func() {
+	service.Lock()
+	defer service.Unlock()
+	service.bindings++
+	id := service.bindings
+	service.handlers = append(service.handlers, boundHandler{id, h})
+	return func() {
+		service.unbind(id)
+	}
+}
+
+// SetSynchronousHandlers enables or disables synchronous handlers. When
+// enabled, handlers registered with BindOnCredentials are called in the order
+// of registration and have returned before the call which fetched the
+// credentials returns. Otherwise each handler is called in its own
+// goroutine, which is the default.
+func (service *TURNService) SetSynchronousHandlers(enabled bool) {
 	service.Lock()
 	defer service.Unlock()
-	service.handlers = append(service.handlers, h)
+	service.syncHandlers = enabled
+}
+
+// triggerHandlers calls the handlers with the result of a fetch, the service
+// lock must not be held.
+func triggerHandlers(handlers []boundHandler, synchronous bool, credentials *CachedCredentialsData, err error) {
+	for _, b := range handlers {
+		if synchronous {
+			b.h(credentials, err)
+		} else {
+			go b.h(credentials, err)
+		}
+	}
+}
+
+func (service *TURNService) unbind(id uint64) {
+	service.Lock()
+	defer service.Unlock()
+	// Copy, the previous slice may be in use by triggering handlers.
+	handlers := make([]boundHandler, 0, len(service.handlers))
+	for _, b := range service.handlers {
+		if b.id != id {
+			handlers = append(handlers, b)
+		}
+	}
+	service.handlers = handlers
 }
 
 // Credentials implements the credentials API call to the TURNService returning
-// cached credential data when those are not yet expired.
+// cached credential data when those are not yet expired. Expired credentials
+// can be served while they are refreshed, see SetStaleWhileRevalidate.
 func (service *TURNService) Credentials(fetch bool) *CachedCredentialsData {
+	credentials, _, _ := service.getCredentials(context.Background(), fetch)
+	return credentials
+}
+
+// CredentialsContext is like Credentials, but a fetch is cancelled when ctx
+// is done. The error of the fetch is returned if it fails.
+func (service *TURNService) CredentialsContext(ctx context.Context, fetch bool) (*CachedCredentialsData, error) {
+	credentials, _, err := service.getCredentials(ctx, fetch)
+	return credentials, err
+}
+
+func (service *TURNService) getCredentials(ctx context.Context, fetch bool) (*CachedCredentialsData, bool, error) {
 	service.RLock()
 	credentials := service.credentials
-	accessToken := service.accessToken
-	clientID := service.clientID
-	session := service.session
+	static := service.static
 	service.RUnlock()
 
-	var err error
-	var fetched bool
-	var response *CredentialsResponse
+	if static {
+		// Static credentials are never fetched.
+		if credentials != nil && credentials.Expired() {
+			return nil, false, nil
+		}
+		return credentials, false, nil
+	}
 
 	if credentials == nil {
 		// No credentials.
 		if !fetch {
+			return nil, false, nil
+		}
+	} else if !credentials.Expired() {
+		return credentials, false, nil
+	} else if service.serveStale(credentials) {
+		return credentials, false, nil
+	} else if !fetch {
+		// Expired credentials.
+		if credentials.TTL() >= minCredentialsTTL {
+			// Credentials are about to expire, schedule refresh
+			service.scheduleRefresh()
+			return credentials, false, nil
+		}
+		return nil, false, nil
+	}
+
+	updated, fetched, err := service.updateCredentials(ctx, credentials, func(current *CachedCredentialsData) bool {
+		return current != nil && !current.Expired()
+	})
+	if err != nil && updated != nil && updated == credentials && updated.Remaining() <= 0 {
+		service.RLock()
+		stale := service.staleGrace > 0
+		service.RUnlock()
+		if stale {
+			// Never serve stale credentials whose TTL has passed.
+			return nil, fetched, err
+		}
+	}
+	return updated, fetched, err
+}
+
+// CredentialsValidFor returns cached credentials if they are valid for at
+// least d, otherwise new credentials are fetched. An error is returned if the
+// fetch fails or even the new credentials are not valid for d.
+func (service *TURNService) CredentialsValidFor(ctx context.Context, d time.Duration) (*CachedCredentialsData, error) {
+	valid := func(current *CachedCredentialsData) bool {
+		return current != nil && !current.Expired() && time.Duration(current.TTL())*time.Second >= d
+	}
+
+	service.RLock()
+	credentials := service.credentials
+	static := service.static
+	service.RUnlock()
+
+	if valid(credentials) {
+		return credentials, nil
+	}
+	if static {
+		return nil, fmt.Errorf("static credentials are not valid for %s", d)
+	}
+
+	credentials, _, err := service.updateCredentials(ctx, nil, valid)
+	if err != nil {
+		return nil, err
+	}
+	if !valid(credentials) {
+		return nil, fmt.Errorf("credentials are not valid for %s", d)
+	}
+	return credentials, nil
+}
+
+// WaitForCredentials returns the cached credentials if they have not
+// expired, otherwise it fetches new credentials and blocks until they are
+// available or ctx is done. Concurrent callers share a single fetch, which
+// is not cancelled when ctx of one of them is done. The error of the fetch
+// is returned if it fails, ErrNoCredentials if no credentials are available
+// without error, for example when static credentials have expired.
+func (service *TURNService) WaitForCredentials(ctx context.Context) (*CachedCredentialsData, error) {
+	type result struct {
+		credentials *CachedCredentialsData
+		err         error
+	}
+	done := make(chan result, 1)
+	go func() {
+		credentials, _, err := service.getCredentials(service.ctx, true)
+		done <- result{credentials, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err == nil && r.credentials == nil {
+			return nil, ErrNoCredentials
+		}
+		return r.credentials, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// WaitHealthy blocks until valid credentials are available, fetching them
+// every retryInterval until a fetch succeeds or ctx is done. The error of ctx
+// is returned if ctx is done first, LastError returns the error of the last
+// fetch. A retryInterval of zero or less retries after one second.
+func (service *TURNService) WaitHealthy(ctx context.Context, retryInterval time.Duration) error {
+	if retryInterval <= 0 {
+		retryInterval = time.Second
+	}
+
+	for {
+		credentials, _, _ := service.getCredentials(ctx, true)
+		if credentials != nil && !credentials.Expired() {
 			return nil
 		}
 
+		timer := time.NewTimer(retryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// A credentialsCall is an in-flight updateCredentials call whose result is
+// shared with all callers which wait for it.
+type credentialsCall struct {
+	done        chan struct{}
+	credentials *CachedCredentialsData
+	fetched     bool
+	cancelled   bool
+	err         error
+	waiters     int
+}
+
+// updateCredentials fetches new credentials unless the current credentials
+// are valid. On errors stale is returned.
+func (service *TURNService) updateCredentials(ctx context.Context, stale *CachedCredentialsData, valid func(*CachedCredentialsData) bool) (*CachedCredentialsData, bool, error) {
+	for {
+		// Only one fetch at a time, others wait for its result.
 		service.Lock()
-		defer service.Unlock()
-		if service.credentials == nil {
-			response, err = service.fetchCredentials(accessToken, clientID, session)
-			if err != nil {
-				service.err = err
+		call := service.fetching
+		if call == nil {
+			call = &credentialsCall{done: make(chan struct{})}
+			service.fetching = call
+			service.Unlock()
+			break
+		}
+		call.waiters++
+		service.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return stale, false, ctx.Err()
+		case <-call.done:
+		}
+		switch {
+		case call.cancelled:
+			// The context of the caller was done, try again.
+			continue
+		case call.err != nil:
+			return stale, false, call.err
+		case !call.fetched && !valid(call.credentials):
+			// Valid for the caller only, try again.
+			continue
+		}
+		return call.credentials, false, nil
+	}
+
+	service.RLock()
+	call := service.fetching
+	service.RUnlock()
+	defer func() {
+		service.Lock()
+		service.fetching = nil
+		service.Unlock()
+		close(call.done)
+	}()
+	call.credentials, call.fetched, call.err = service.doUpdateCredentials(ctx, stale, valid)
+	call.cancelled = ctx.Err() != nil
+	return call.credentials, call.fetched, call.err
+}
+
+func (service *TURNService) doUpdateCredentials(ctx context.Context, stale *CachedCredentialsData, valid func(*CachedCredentialsData) bool) (*CachedCredentialsData, bool, error) {
+	service.RLock()
+	current := service.credentials
+	accessToken := service.accessToken
+	clientID := service.clientID
+	endpoints := service.endpointSessions()
+	service.RUnlock()
+
+	if valid(current) {
+		// Fetched while waiting.
+		return current, false, nil
+	}
+
+	credentials := stale
+	response, uri, fetchID, err := service.fetchCredentials(ctx, accessToken, clientID, endpoints)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// Never apply any part of a cancelled fetch, even if the response
+		// was complete, so credentials and session stay consistent.
+		return stale, true, ctxErr
+	}
+	if err != nil {
+		if restored := service.restoreCredentials(current); valid(restored) {
+			// Fetched by another user of the CredentialStore.
+			service.Lock()
+			service.err = err
+			service.Unlock()
+			return restored, true, nil
+		}
+	}
+
+	cached := false
+	cacheable := err == nil && service.cacheable(response)
+	service.Lock()
+	service.err = err
+	if err == nil {
+		credentials = newCachedCredentialsData(response.Turn, service.expirationPercentile, service.maxCredentialsTTL, service.clock, service.refreshJitter, service.random)
+		if credentials.clamped {
+			service.logger.Printf("turnservicecli: credentials TTL %ds exceeds maximum, expiring after %s", response.Turn.TTL, credentials.expiry)
+		}
+		if service.uncached != nil {
+			// Release the timer of the previous credentials which were
+			// not cached.
+			service.uncached.Close()
+			service.uncached = nil
+		}
+		if cacheable {
+			if service.credentials != nil {
+				// Release the timer of the replaced credentials.
+				service.credentials.Close()
 			}
-			fetched = true
+			service.credentials = credentials
+			cached = true
 		} else {
-			credentials = service.credentials
+			service.uncached = credentials
 		}
-	} else {
-		if credentials.Expired() {
-			// Expired credentials.
-			if fetch {
-				service.Lock()
-				defer service.Unlock()
-				if service.credentials == nil || service.credentials.Expired() {
-					response, err = service.fetchCredentials(accessToken, clientID, session)
-					service.err = err
-				} else {
-					credentials = service.credentials
-				}
-				fetched = true
-			} else if credentials.TTL() >= minCredentialsTTL {
-				// Credentials are about to expire, schedule refresh
-				service.scheduleRefresh()
-			} else {
-				credentials = nil
+		service.tracker.record(response.Turn, service.clock.Now())
+		if service.warnNoTransport {
+			if urns := response.Turn.RelaysWithoutTransport(); len(urns) > 0 {
+				service.logger.Printf("turnservicecli: relays without transport parameter: %s", strings.Join(urns, ", "))
 			}
 		}
+		service.setEndpointSession(uri, response.Session)
 	}
+	handlers, synchronous := service.handlers, service.syncHandlers
+	service.Unlock()
 
-	if response != nil && err == nil {
-		credentials = NewCachedCredentialsData(response.Turn, service.expirationPercentile)
-		// Already locked from above if response is not nil.
-		service.credentials = credentials
-		service.session = response.Session
+	if cached {
+		service.persistCredentials(credentials)
+		service.emit(Event{Type: EventCached, FetchID: fetchID, Endpoint: uri})
+		service.watchExpiry(credentials, fetchID)
+		service.watchExpiring(credentials)
+		service.watchLatency(credentials)
 	}
 
-	if fetched {
-		// Trigger registered handlers.
-		for _, h := range service.handlers {
-			go h(credentials, err)
-		}
+	if len(handlers) > 0 && service.logger.enabled() {
+		service.logger.Printf("turnservicecli: fetch %d: dispatching to %d handlers", fetchID, len(handlers))
 	}
+	triggerHandlers(handlers, synchronous, credentials, err)
 
-	return credentials
+	return credentials, true, err
 }
 
 // LastError returns the last occured Error if any.
@@ -219,53 +1239,255 @@ func (service *TURNService) LastError() error {
 
 // FetchCredentials fetches new TURN credentials via the remote service.
 func (service *TURNService) FetchCredentials() (*CredentialsResponse, error) {
+	return service.FetchCredentialsContext(context.Background())
+}
+
+// FetchCredentialsContext is like FetchCredentials, but the fetch is
+// cancelled when ctx is done.
+func (service *TURNService) FetchCredentialsContext(ctx context.Context) (*CredentialsResponse, error) {
 	service.RLock()
 	accessToken := service.accessToken
 	clientID := service.clientID
-	session := service.session
+	endpoints := service.endpointSessions()
 	service.RUnlock()
 
-	return service.fetchCredentials(accessToken, clientID, session)
+	response, _, _, err := service.fetchCredentials(ctx, accessToken, clientID, endpoints)
+	return response, err
 }
 
-func (service *TURNService) fetchCredentials(accessToken, clientID, session string) (*CredentialsResponse, error) {
-	if accessToken == "" && clientID == "" {
-		return nil, fmt.Errorf("missign one of accessToken/clientId")
+// validateAuth checks if accessToken and clientID can be used to authenticate
+// with the remote service. Valid combinations are an accessToken alone, an
+// accessToken with a clientID, and, only if clientIDOnlyAuth is set, a
+// clientID alone. An empty clientID is not sent, the Authorization header is
+// omitted if there is neither an accessToken nor a session.
+func validateAuth(accessToken, clientID string, clientIDOnlyAuth bool) error {
+	switch {
+	case accessToken != "":
+		return nil
+	case clientID == "":
+		return fmt.Errorf("missing accessToken and clientID")
+	case !clientIDOnlyAuth:
+		return fmt.Errorf("missing accessToken: authentication with clientID only is not enabled")
 	}
+	return nil
+}
 
-	var body *bytes.Buffer
-	nonce, err := makeNonce()
+// encodeAuthorization returns the Authorization header value for accessToken
+// and session. The remote service splits the decoded value on the colon, so
+// neither of them may contain one.
+func encodeAuthorization(accessToken, session string) (string, error) {
+	if strings.Contains(accessToken, ":") {
+		return "", fmt.Errorf("invalid accessToken: must not contain ':'")
+	}
+	if strings.Contains(session, ":") {
+		return "", fmt.Errorf("invalid session: must not contain ':'")
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", accessToken, session)))
+	return fmt.Sprintf("Bearer %s", auth), nil
+}
+
+// Refreshing returns if credentials are currently being fetched.
+func (service *TURNService) Refreshing() bool {
+	service.RLock()
+	defer service.RUnlock()
+	return service.refreshing > 0
+}
+
+// fetchCredentials fetches credentials from the first endpoint which
+// responds, returning the URI of the endpoint and the ID of the fetch.
+func (service *TURNService) fetchCredentials(ctx context.Context, accessToken, clientID string, endpoints []endpointSession) (*CredentialsResponse, string, uint64, error) {
+	service.Lock()
+	service.refreshing++
+	service.fetches++
+	fetchID := service.fetches
+	service.Unlock()
+	defer func() {
+		service.Lock()
+		service.refreshing--
+		service.Unlock()
+	}()
+
+	ctx, cancel := service.fetchContext(ctx)
+	defer cancel()
+	ctx, span := service.startSpan(ctx, "turnservicecli.FetchCredentials", map[string]string{
+		"fetch_id": strconv.FormatUint(fetchID, 10),
+	})
+
+	service.emit(Event{Type: EventFetchStart, FetchID: fetchID})
+	if service.logger.enabled() {
+		service.logger.Printf("turnservicecli: fetch %d: fetching credentials from %s", fetchID, endpoints[0].uri)
+	}
+	var response *CredentialsResponse
+	var uri string
+	start := time.Now()
+	err := service.retry(ctx, func() error {
+		var err error
+		uri, err = service.failover(ctx, endpoints, func(endpoint endpointSession) error {
+			var err error
+			response, err = service.fetchCredentialsFrom(ctx, endpoint.uri, accessToken, clientID, endpoint.session)
+			return err
+		})
+		return err
+	})
+	service.metrics.record(time.Since(start), err)
+	span.End(err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make nonce: %s", err.Error())
+		service.emit(Event{Type: EventFetchFailure, FetchID: fetchID, Endpoint: uri, Err: err})
+		if service.logger.enabled() {
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) {
+				service.logger.Printf("turnservicecli: fetch %d: failed with status %d: %s", fetchID, statusErr.StatusCode, err)
+			} else {
+				service.logger.Printf("turnservicecli: fetch %d: failed: %s", fetchID, err)
+			}
+		}
+	} else {
+		service.emit(Event{Type: EventFetchSuccess, FetchID: fetchID, Endpoint: uri})
+		if service.logger.enabled() {
+			service.logger.Printf("turnservicecli: fetch %d: received credentials from %s with TTL %ds", fetchID, uri, response.Turn.TTL)
+		}
 	}
+	return response, uri, fetchID, err
+}
 
-	data := url.Values{}
-	data.Set("nonce", nonce)
-	data.Set("client_id", clientID)
-	auth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", accessToken, session)))
-	body = bytes.NewBufferString(data.Encode())
+func (service *TURNService) fetchCredentialsFrom(ctx context.Context, uri, accessToken, clientID, session string) (*CredentialsResponse, error) {
+	service.RLock()
+	provider := service.provider
+	service.RUnlock()
+	if provider != nil {
+		response, err := service.fetchFromProvider(ctx, provider, uri, accessToken, clientID)
+		if err != nil {
+			return nil, err
+		}
+		return service.checkTurn(response)
+	}
 
-	request, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/turn/credentials", service.uri), body)
+	var response CredentialsResponse
+	nonce, err := service.doRequest(ctx, uri, "credentials", accessToken, clientID, session, &response)
 	if err != nil {
 		return nil, err
 	}
 
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", auth))
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if !response.Success {
+		return &response, fmt.Errorf("credentials %w", ErrUnsuccessful)
+	}
+
+	if err := service.checkNonce(nonce, response.Nonce); err != nil {
+		return &response, err
+	}
+
+	if session != "" && response.Session == "" {
+		return &response, ErrMissingSession
+	}
+
+	return service.checkTurn(&response)
+}
+
+// checkTurn checks that response has valid credentials.
+func (service *TURNService) checkTurn(response *CredentialsResponse) (*CredentialsResponse, error) {
+	if response.Turn == nil {
+		return response, fmt.Errorf("%w: missing turn data", ErrInvalidCredentials)
+	}
+	service.RLock()
+	skipValidation := service.skipValidation
+	service.RUnlock()
+	if !skipValidation {
+		if err := response.Turn.Validate(); err != nil {
+			return response, err
+		}
+	}
+
+	return response, nil
+}
+
+// doRequest performs a request to the endpoint of the remote service at uri
+// and decodes the response into v. It returns the nonce sent with the request.
+func (service *TURNService) doRequest(ctx context.Context, uri, endpoint, accessToken, clientID, session string, v interface{}) (string, error) {
+	ctx, span := service.startSpan(ctx, "turnservicecli.request", map[string]string{
+		"endpoint": endpoint,
+		"uri":      uri,
+	})
+	nonce, err := service.sendRequest(ctx, uri, endpoint, accessToken, clientID, session, v)
+	span.End(err)
+	return nonce, err
+}
+
+func (service *TURNService) sendRequest(ctx context.Context, uri, endpoint, accessToken, clientID, session string, v interface{}) (string, error) {
+	accessToken, err := service.token.get(ctx, accessToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to exchange access token: %w", err)
+	}
+
+	service.warnInsecure()
+	service.Lock()
+	service.reloadRootCAs()
+	service.Unlock()
+	service.RLock()
+	codec := service.codec
+	random := service.random
+	clientIDOnlyAuth := service.clientIDOnlyAuth
+	externalIPHint := service.externalIPHint
+	nonceMode := service.nonceMode
+	client := service.client
+	if service.customClient != nil {
+		client = service.customClient
+	}
+	userAgent := service.userAgent
+	headers := service.headers
+	service.RUnlock()
+
+	if err := validateAuth(accessToken, clientID, clientIDOnlyAuth); err != nil {
+		return "", err
+	}
 
-	transport := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		TLSClientConfig:     service.tlsConfig,
-		TLSHandshakeTimeout: time.Second * requestTimeoutSeconds,
+	var body *bytes.Buffer
+	data := url.Values{}
+	var nonce string
+	if nonceMode != NonceDisabled {
+		nonce, err = service.nonces.issue(random)
+		if err != nil {
+			return "", fmt.Errorf("failed to make nonce: %w", err)
+		}
+		data.Set("nonce", nonce)
+	}
+	if clientID != "" {
+		data.Set("client_id", clientID)
 	}
+	if externalIPHint != nil {
+		if ip := externalIPHint(); ip != "" {
+			data.Set("external_ip", ip)
+		}
+	}
+	auth, err := encodeAuthorization(accessToken, session)
+	if err != nil {
+		return "", err
+	}
+	body = bytes.NewBufferString(data.Encode())
 
-	client := &http.Client{
-		Transport: transport,
+	request, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/turn/%s", uri, endpoint), body)
+	if err != nil {
+		return "", err
 	}
 
+	request = request.WithContext(ctx)
+	for key, values := range headers {
+		request.Header[key] = values
+	}
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	if accessToken != "" || session != "" {
+		request.Header.Set("Authorization", auth)
+	} else {
+		request.Header.Del("Authorization")
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", codec.ContentType())
+	service.injectTrace(ctx, request.Header)
+
 	result, err := client.Do(request)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer result.Body.Close()
 
@@ -273,25 +1495,17 @@ func (service *TURNService) fetchCredentials(accessToken, clientID, session stri
 	case http.StatusOK:
 		// Success.
 	case http.StatusForbidden:
-		content, _ := ioutil.ReadAll(result.Body)
-		return nil, fmt.Errorf("forbidden: %s", content)
+		content, _ := ioutil.ReadAll(io.LimitReader(result.Body, maxErrorBodySize))
+		return "", fmt.Errorf("%w: %s", ErrForbidden, content)
 	default:
-		return nil, fmt.Errorf("credentials return wrong status: %d", result.StatusCode)
+		content, _ := ioutil.ReadAll(io.LimitReader(result.Body, maxErrorBodySize))
+		return "", &StatusError{endpoint, result.StatusCode, content}
 	}
 
-	var response CredentialsResponse
-	err = json.NewDecoder(result.Body).Decode(&response)
+	err = codec.Decode(result.Body, v)
 	if err != nil {
-		return nil, err
-	}
-
-	if !response.Success {
-		return &response, fmt.Errorf("credentials response unsuccessfull")
-	}
-
-	if response.Nonce != nonce {
-		return &response, fmt.Errorf("nonce mismatch")
+		return "", err
 	}
 
-	return &response, nil
+	return nonce, nil
 }
@@ -1,15 +1,43 @@
 package turnservicecli
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
-	"encoding/hex"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// testServers are the servers returned by test servers.
+var testServers = []*URNsWithID{
+	&URNsWithID{ID: "test", URNs: []string{"turn:turn.example.com:3478?transport=udp"}},
+}
+
 var ServiceURI string
 var ClientID string
 var AccessToken string
@@ -26,18 +54,17 @@ func TestMain(m *testing.M) {
 }
 
 func TestTURNServiceCredentials(t *testing.T) {
-	if ServiceURI == "" {
-		t.SkipNow()
-	}
-
-	if HMacSecret != "" {
-		mac := hmac.New(sha256.New, []byte(HMacSecret))
-		mac.Write([]byte(ClientID))
-		AccessToken = fmt.Sprintf("h%s", hex.EncodeToString(mac.Sum(nil)))
+	serviceURI, accessToken, clientID := ServiceURI, AccessToken, ClientID
+	if serviceURI == "" {
+		server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+		defer server.Close()
+		serviceURI, accessToken, clientID = server.URL, "token", "client"
+	} else if HMacSecret != "" {
+		accessToken = ComputeAccessToken(HMacSecret, clientID)
 	}
 
-	turnService := NewTURNService(ServiceURI, 0, nil)
-	turnService.Open(AccessToken, ClientID, "")
+	turnService := NewTURNService(serviceURI)
+	turnService.Open(accessToken, clientID, "")
 
 	turn := turnService.Credentials(false)
 	if turn != nil {
@@ -86,3 +113,3847 @@ func TestTURNServiceCredentials(t *testing.T) {
 	}
 
 }
+
+func TestTURNServiceAutorefreshCycle(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 2, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	// Credentials expire after 200ms.
+	turnService := NewTURNService(server.URL, WithExpirationPercentile(10))
+	defer turnService.Close()
+	turnService.SetRefreshInterval(20 * time.Millisecond)
+	turnService.Open("token", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+
+	server.SetTurn(&CredentialsData{TTL: 3600, Username: "refreshed", Password: "password", Servers: testServers})
+	turnService.Autorefresh(true)
+	waitFor(t, 2*time.Second, func() bool {
+		refreshed := turnService.Credentials(false)
+		return refreshed != nil && refreshed.Turn.Username == "refreshed"
+	})
+	if !turn.Expired() {
+		t.Error("replaced credentials must be expired")
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) < 2 || sessions[0] != "" || sessions[1] != "test-session" {
+		t.Errorf("refresh must resume the session, got %q", sessions)
+	}
+	for i, nonce := range server.Nonces() {
+		if nonce == "" {
+			t.Errorf("request %d: nonce must not be empty", i)
+		}
+	}
+}
+
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout while waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitRefreshLoop waits until the refresh loop of service has completed an
+// iteration which started after the call. Triggers are buffered once, so the
+// third trigger is only accepted after the loop received the second one.
+func waitRefreshLoop(t *testing.T, service *TURNService) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for i := 0; i < 3; i++ {
+		select {
+		case service.refresh <- true:
+		case <-timeout:
+			t.Fatal("timeout while waiting for the refresh loop")
+		}
+	}
+}
+
+func TestTURNServiceStaticCredentials(t *testing.T) {
+	server := NewTestServer(nil)
+	server.SetStatus(http.StatusInternalServerError)
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	turnService.SetStaticCredentials(&CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+	})
+
+	turn := turnService.Credentials(false)
+	if turn == nil {
+		t.Fatal("static credentials must not be nil")
+	}
+	if turn.Turn.Username != "user" {
+		t.Errorf("unexpected username: %s", turn.Turn.Username)
+	}
+	if turn2 := turnService.Credentials(true); turn2 != turn {
+		t.Error("fetch must return the static credentials")
+	}
+
+	turnService.Autorefresh(true)
+	waitRefreshLoop(t, turnService)
+
+	if requests := server.Requests(); requests != 0 {
+		t.Errorf("no request must be made in static mode, got %d", requests)
+	}
+	if err := turnService.LastError(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func newRefreshFailureService(t *testing.T, server *TestServer) *TURNService {
+	// Credentials expire after one second but remain usable for their TTL.
+	turnService := NewTURNService(server.URL, WithExpirationPercentile(5))
+	turnService.Open("token", "client", "")
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	waitFor(t, 2*time.Second, turn.Expired)
+	server.SetStatus(http.StatusInternalServerError)
+	return turnService
+}
+
+func TestTURNServiceRefreshFailureKeep(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 20, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := newRefreshFailureService(t, server)
+	defer turnService.Close()
+	turn := turnService.Credentials(false)
+
+	turnService.Autorefresh(true)
+	waitFor(t, time.Second, func() bool {
+		return server.Requests() >= 2
+	})
+	waitFor(t, time.Second, func() bool {
+		return turnService.LastError() != nil
+	})
+
+	if turn2 := turnService.Credentials(false); turn2 != turn {
+		t.Error("last credentials must be kept after failed refresh")
+	}
+}
+
+func TestTURNServiceRefreshFailureInvalidate(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 20, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := newRefreshFailureService(t, server)
+	defer turnService.Close()
+	turnService.SetRefreshFailurePolicy(RefreshFailureInvalidate, nil)
+
+	turnService.Autorefresh(true)
+	waitFor(t, time.Second, func() bool {
+		return turnService.Credentials(false) == nil
+	})
+	if turnService.LastError() == nil {
+		t.Error("last error must be set after failed refresh")
+	}
+}
+
+func TestTURNServiceRefreshFailureCallback(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 20, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := newRefreshFailureService(t, server)
+	defer turnService.Close()
+	turn := turnService.Credentials(false)
+
+	failed := make(chan error, 1)
+	turnService.SetRefreshFailurePolicy(RefreshFailureCallback, func(credentials *CachedCredentialsData, err error) {
+		if credentials != turn {
+			t.Error("callback must receive the last credentials")
+		}
+		failed <- err
+	})
+
+	turnService.Autorefresh(true)
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Error("callback must receive the error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback must be called after failed refresh")
+	}
+	if turn2 := turnService.Credentials(false); turn2 != turn {
+		t.Error("last credentials must be kept after failed refresh")
+	}
+}
+
+func TestTURNServiceConfigureTransport(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.ConfigureTransport(func(transport *http.Transport) {
+		transport.MaxIdleConns = 7
+	})
+
+	if turnService.client.Transport != turnService.transport {
+		t.Fatal("client must use the configured transport")
+	}
+	if turnService.transport.MaxIdleConns != 7 {
+		t.Errorf("unexpected MaxIdleConns: %d", turnService.transport.MaxIdleConns)
+	}
+
+	turnService.Open("token", "client", "")
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Errorf("turn data must not be nil: %s", turnService.LastError())
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestTURNServiceHTTPClient(t *testing.T) {
+	var requests int
+	client := &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			if err := r.ParseForm(); err != nil {
+				return nil, err
+			}
+			body, _ := json.Marshal(&CredentialsResponse{
+				Success: true,
+				Nonce:   r.PostFormValue("nonce"),
+				Turn:    &CredentialsData{TTL: 3600, Username: "canned", Password: "password", Servers: testServers},
+			})
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       ioutil.NopCloser(strings.NewReader(string(body))),
+				Request:    r,
+			}, nil
+		}),
+	}
+
+	turnService := NewTURNService("https://turn.invalid")
+	defer turnService.Close()
+	turnService.SetHTTPClient(client)
+	turnService.Open("token", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if turn.Turn.Username != "canned" || requests != 1 {
+		t.Errorf("custom client not used: %v, %d requests", turn.Turn, requests)
+	}
+	if client.Timeout != 0 {
+		t.Error("custom client must not be modified")
+	}
+
+	turnService.SetHTTPClient(nil)
+	if _, err := turnService.FetchCredentials(); err == nil || requests != 1 {
+		t.Errorf("internal client must be used after reset: %v", err)
+	}
+
+	turnService.SetRoundTripper(client.Transport)
+	if _, err := turnService.FetchCredentials(); err != nil || requests != 2 {
+		t.Errorf("custom round tripper not used: %v, %d requests", err, requests)
+	}
+
+	turnService2 := NewTURNService("https://turn.invalid", WithRoundTripper(client.Transport))
+	defer turnService2.Close()
+	turnService2.Open("token", "client", "")
+	if _, err := turnService2.FetchCredentials(); err != nil || requests != 3 {
+		t.Errorf("custom round tripper option not used: %v, %d requests", err, requests)
+	}
+}
+
+func TestTURNServiceHeaders(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	server.SetGeo(&GeoData{Prefer: []string{"a"}})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetUserAgent("test-client/1.0")
+	turnService.SetHeader("X-Deployment", "staging")
+	turnService.SetHeader("X-Removed", "value")
+	turnService.SetHeader("X-Removed", "")
+	turnService.SetHeader("Authorization", "Bearer forged")
+	turnService.SetHeader("Content-Type", "text/plain")
+	turnService.Open("token", "client", "")
+
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := turnService.Geo(true); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := server.Headers()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+	expectedAuth, _ := encodeAuthorization("token", "")
+	for i, header := range requests {
+		if ua := header.Get("User-Agent"); ua != "test-client/1.0" {
+			t.Errorf("request %d: unexpected User-Agent %q", i, ua)
+		}
+		if value := header.Get("X-Deployment"); value != "staging" {
+			t.Errorf("request %d: unexpected X-Deployment %q", i, value)
+		}
+		if _, ok := header["X-Removed"]; ok {
+			t.Errorf("request %d: removed header must not be sent", i)
+		}
+		if auth := header.Get("Authorization"); auth != expectedAuth {
+			t.Errorf("request %d: Authorization must not be overridden, got %q", i, auth)
+		}
+		if ct := header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+			t.Errorf("request %d: Content-Type must not be overridden, got %q", i, ct)
+		}
+	}
+}
+
+func TestComputeAccessToken(t *testing.T) {
+	if token := ComputeAccessToken("secret", "client"); token != "hd0c6e48fa6742da86d2538cfd7e0112e458a5d2a53284bbb4d98b60002ab09b7" {
+		t.Errorf("unexpected access token %s", token)
+	}
+}
+
+func TestTURNServiceForbiddenErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(bytes.Repeat([]byte("x"), 2*maxErrorBodySize))
+	}))
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	_, err := turnService.FetchCredentials()
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+	if len(err.Error()) > maxErrorBodySize+len(ErrForbidden.Error())+2 {
+		t.Errorf("forbidden body must be limited, got %d bytes", len(err.Error()))
+	}
+
+	// Errors of the token exchanger keep their chain.
+	turnService.SetTokenExchanger(func(ctx context.Context) (string, time.Time, error) {
+		return "", time.Time{}, fmt.Errorf("%w: token revoked", ErrForbidden)
+	})
+	if _, err := turnService.FetchCredentials(); !errors.Is(err, ErrForbidden) || !strings.Contains(err.Error(), "failed to exchange access token") {
+		t.Errorf("expected wrapped exchanger error, got %v", err)
+	}
+}
+
+func TestTURNServiceTokenExchanger(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("refresh-token", "client", "")
+
+	var exchanges int
+	expiry := time.Now().Add(time.Hour)
+	turnService.SetTokenExchanger(func(ctx context.Context) (string, time.Time, error) {
+		exchanges++
+		return fmt.Sprintf("exchanged-%d", exchanges), expiry, nil
+	})
+
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if exchanges != 1 {
+		t.Errorf("exchanged token must be cached, got %d exchanges", exchanges)
+	}
+	expected := "Bearer " + base64.StdEncoding.EncodeToString([]byte("exchanged-1:"))
+	if auth := server.Authorization(); auth != expected {
+		t.Errorf("exchanged token must be used, got %s", auth)
+	}
+
+	// Exchange again when the token is about to expire.
+	expiry = time.Now().Add(time.Second)
+	turnService.SetTokenExchanger(func(ctx context.Context) (string, time.Time, error) {
+		exchanges++
+		return fmt.Sprintf("exchanged-%d", exchanges), expiry, nil
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := turnService.FetchCredentials(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exchanges != 3 {
+		t.Errorf("token about to expire must be exchanged again, got %d exchanges", exchanges)
+	}
+}
+
+func TestTURNServiceForceExpireForTesting(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if turn2 := turnService.Credentials(true); turn2 != turn {
+		t.Error("cached credentials must be returned before expiry")
+	}
+
+	turnService.ForceExpireForTesting()
+	if !turn.Expired() {
+		t.Error("turn must be expired after ForceExpireForTesting")
+	}
+
+	turn2 := turnService.Credentials(true)
+	if turn2 == nil || turn2 == turn {
+		t.Error("expired credentials must be fetched again")
+	}
+	if requests := server.Requests(); requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+type fakeCodec struct{}
+
+func (codec fakeCodec) ContentType() string {
+	return "application/x-fake"
+}
+
+func (codec fakeCodec) Decode(r io.Reader, v interface{}) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	response := v.(*CredentialsResponse)
+	response.Turn = &CredentialsData{Servers: testServers}
+	_, err = fmt.Sscanf(string(content), "%s %s %s %d", &response.Nonce, &response.Turn.Username, &response.Turn.Password, &response.Turn.TTL)
+	response.Success = err == nil
+	return err
+}
+
+func TestTURNServiceResponseCodec(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accept := r.Header.Get("Accept"); accept != "application/x-fake" {
+			t.Errorf("unexpected Accept header: %s", accept)
+		}
+		w.Header().Set("Content-Type", "application/x-fake")
+		fmt.Fprintf(w, "%s user password 3600", r.PostFormValue("nonce"))
+	}))
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	turnService.SetResponseCodec(fakeCodec{})
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if turn.Turn.Username != "user" || turn.Turn.Password != "password" || turn.Turn.TTL != 3600 {
+		t.Errorf("unexpected turn data: %+v", turn.Turn)
+	}
+}
+
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+}
+
+func (clock *fakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	clock.Lock()
+	defer clock.Unlock()
+	ticker := &fakeTicker{c: make(chan time.Time, 1), interval: d, next: clock.now.Add(d)}
+	clock.tickers = append(clock.tickers, ticker)
+	return ticker.c, func() {
+		clock.Lock()
+		defer clock.Unlock()
+		ticker.stopped = true
+	}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(d)
+	for _, ticker := range clock.tickers {
+		if ticker.stopped || clock.now.Before(ticker.next) {
+			continue
+		}
+		select {
+		case ticker.c <- clock.now:
+		default:
+		}
+		for !clock.now.Before(ticker.next) {
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+	}
+}
+
+func TestTURNServiceClockJump(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Now().Round(0)}
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetClock(clock)
+	turnService.Open("token", "client", "")
+
+	turnService.Autorefresh(true)
+	waitFor(t, time.Second, func() bool {
+		return turnService.Credentials(false) != nil
+	})
+
+	// No refresh without a clock jump.
+	waitRefreshLoop(t, turnService)
+	if requests := server.Requests(); requests != 1 {
+		t.Fatalf("expected 1 request, got %d", requests)
+	}
+
+	// Simulate resume from a one hour sleep.
+	clock.Advance(time.Hour)
+	turnService.scheduleRefresh()
+	waitFor(t, time.Second, func() bool {
+		return server.Requests() == 2
+	})
+}
+
+func TestTURNServiceClockJumpWithoutAutorefresh(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Now().Round(0)}
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetClock(clock)
+	turnService.Open("token", "client", "")
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+
+	// Simulate resume from a sleep longer than the TTL.
+	clock.Advance(2 * time.Hour)
+	if !turn.Expired() {
+		t.Error("credentials must expire after the wall clock passed their expiry")
+	}
+	if stale := turnService.Credentials(false); stale != nil {
+		t.Errorf("expired credentials must not be returned, got %v", stale)
+	}
+	select {
+	case <-turn.done:
+	case <-time.After(time.Second):
+		t.Error("expiry must be signalled")
+	}
+}
+
+func TestTURNServiceLazyRefreshLoop(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	running := func(service *TURNService) (bool, chan bool) {
+		service.RLock()
+		defer service.RUnlock()
+		return service.quit != nil, service.done
+	}
+
+	turnService := NewTURNService(server.URL)
+	turnService.Open("token", "client", "")
+	if ok, _ := running(turnService); ok {
+		t.Fatal("refresh loop must not run before autorefresh is enabled")
+	}
+
+	turnService.Autorefresh(true)
+	ok, done := running(turnService)
+	if !ok {
+		t.Fatal("refresh loop must run with autorefresh enabled")
+	}
+	waitFor(t, time.Second, func() bool {
+		return server.Requests() == 1
+	})
+
+	turnService.Autorefresh(false)
+	if ok, _ := running(turnService); ok {
+		t.Fatal("refresh loop must not run with autorefresh disabled")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresh loop did not stop")
+	}
+
+	turnService.Autorefresh(true)
+	_, done = running(turnService)
+	turnService.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresh loop did not stop on close")
+	}
+	turnService.Autorefresh(false)
+	turnService.Autorefresh(true)
+	if ok, _ := running(turnService); ok {
+		t.Error("refresh loop must not start after close")
+	}
+
+	// Closing without ever starting the loop must work.
+	NewTURNService(server.URL).Close()
+}
+
+func TestTURNServiceConnectionReuse(t *testing.T) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+
+	var lock sync.Mutex
+	var connections int
+	server := httptest.NewUnstartedServer(turnServer.Config.Handler)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			connections++
+			lock.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	for i := 0; i < 2; i++ {
+		if _, err := turnService.FetchCredentials(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if connections != 1 {
+		t.Errorf("expected 1 connection for two fetches, got %d", connections)
+	}
+}
+
+func TestTURNServiceClientSessionCache(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	turnService := NewTURNService("https://localhost", WithTLSConfig(tlsConfig))
+	defer turnService.Close()
+
+	if turnService.transport.TLSClientConfig.ClientSessionCache == nil {
+		t.Error("transport must use a client session cache")
+	}
+	if tlsConfig.ClientSessionCache != nil {
+		t.Error("the tls config of the caller must not be modified")
+	}
+
+	cache := tls.NewLRUClientSessionCache(1)
+	turnService2 := NewTURNService("https://localhost", WithTLSConfig(&tls.Config{ClientSessionCache: cache}))
+	defer turnService2.Close()
+	if turnService2.transport.TLSClientConfig.ClientSessionCache != cache {
+		t.Error("transport must use the configured client session cache")
+	}
+}
+
+func TestTURNServiceEvents(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	var lock sync.Mutex
+	var events []Event
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetEventHandler(func(event Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	})
+	turnService.Open("token", "client", "")
+
+	getEvents := func() []Event {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]Event(nil), events...)
+	}
+
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	turnService.ForceExpireForTesting()
+	waitFor(t, time.Second, func() bool {
+		return len(getEvents()) == 4
+	})
+
+	expected := []EventType{EventFetchStart, EventFetchSuccess, EventCached, EventExpired}
+	for i, event := range getEvents() {
+		if event.Type != expected[i] {
+			t.Errorf("event %d: expected %s, got %s", i, expected[i], event.Type)
+		}
+		if event.FetchID != 1 {
+			t.Errorf("event %d: expected fetch ID 1, got %d", i, event.FetchID)
+		}
+		if event.Time.IsZero() {
+			t.Errorf("event %d: time must be set", i)
+		}
+	}
+	if endpoint := getEvents()[1].Endpoint; endpoint != server.URL {
+		t.Errorf("expected endpoint %s, got %s", server.URL, endpoint)
+	}
+
+	server.SetStatus(http.StatusInternalServerError)
+	turnService.Credentials(true)
+	failed := getEvents()
+	if len(failed) != 6 || failed[4].Type != EventFetchStart || events[5].Type != EventFetchFailure || events[5].Err == nil || events[5].FetchID != 2 {
+		t.Errorf("unexpected events for failed fetch: %+v", events[4:])
+	}
+}
+
+func TestTURNServiceWaitHealthy(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	server.SetStatus(http.StatusInternalServerError)
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := turnService.WaitHealthy(ctx, 20*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if requests := server.Requests(); requests < 2 {
+		t.Errorf("expected retries, got %d requests", requests)
+	}
+	if turnService.LastError() == nil {
+		t.Error("last error must be set")
+	}
+
+	server.SetStatus(http.StatusOK)
+	server.FailNext(2, http.StatusInternalServerError)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	if err := turnService.WaitHealthy(ctx2, 20*time.Millisecond); err != nil {
+		t.Fatalf("expected eventual success, got %v", err)
+	}
+	if turnService.Credentials(false) == nil {
+		t.Error("credentials must be available")
+	}
+}
+
+func TestTURNServiceCloseTwice(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	turnService.Open("token", "client", "")
+	turnService.Autorefresh(true)
+	var turn *CachedCredentialsData
+	waitFor(t, time.Second, func() bool {
+		turn = turnService.Credentials(false)
+		return turn != nil
+	})
+
+	turnService.Close()
+	turnService.Close()
+	if !turn.Expired() {
+		t.Error("turn must be expired after Close")
+	}
+	turn.Close()
+	if !turn.Expired() {
+		t.Error("turn must still be expired after second Close")
+	}
+}
+
+func TestTURNServiceRefreshInterval(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 2, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	// Credentials expire after 200ms.
+	turnService := NewTURNService(server.URL, WithExpirationPercentile(10))
+	defer turnService.Close()
+	turnService.SetRefreshInterval(-1)
+	if turnService.refreshInterval != defaultRefreshInterval {
+		t.Errorf("invalid interval must restore the default, got %s", turnService.refreshInterval)
+	}
+	turnService.SetRefreshInterval(50 * time.Millisecond)
+	turnService.Open("token", "client", "")
+	turnService.Autorefresh(true)
+
+	waitFor(t, 2*time.Second, func() bool {
+		return server.Requests() >= 3
+	})
+}
+
+func TestTURNServiceUnbindOnCredentials(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	var lock sync.Mutex
+	calls := make(map[string]int)
+	handler := func(name string) TURNCredentialsHandler {
+		return func(*CachedCredentialsData, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			calls[name]++
+		}
+	}
+	getCalls := func(name string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return calls[name]
+	}
+
+	unbind1 := turnService.BindOnCredentials(handler("first"))
+	turnService.BindOnCredentials(handler("second"))
+	turnService.Credentials(true)
+	waitFor(t, time.Second, func() bool {
+		return getCalls("first") == 1 && getCalls("second") == 1
+	})
+
+	unbind1()
+	unbind1()
+	turnService.ForceExpireForTesting()
+	turnService.Credentials(true)
+	waitFor(t, time.Second, func() bool {
+		return getCalls("second") == 2
+	})
+	if calls := getCalls("first"); calls != 1 {
+		t.Errorf("unbound handler must not be called, got %d calls", calls)
+	}
+}
+
+// waitForWaiters waits until n callers wait for the pending fetch of
+// service.
+func waitForWaiters(t *testing.T, service *TURNService, n int) {
+	t.Helper()
+	waitFor(t, time.Second, func() bool {
+		service.RLock()
+		defer service.RUnlock()
+		return service.fetching != nil && service.fetching.waiters == n
+	})
+}
+
+func TestTURNServiceWaitForCredentials(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	release := make(chan struct{})
+	server.Hold(release)
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	// Cancelled while waiting.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := turnService.WaitForCredentials(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	// Concurrent waiters join the pending fetch.
+	var wg sync.WaitGroup
+	results := make([]*CachedCredentialsData, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if results[i], err = turnService.WaitForCredentials(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	// The fetch of the cancelled call is still pending.
+	waitForWaiters(t, turnService, len(results))
+	close(release)
+	wg.Wait()
+	if requests := server.Requests(); requests != 1 {
+		t.Errorf("expected a single fetch, got %d", requests)
+	}
+	for _, turn := range results {
+		if turn == nil || turn != results[0] {
+			t.Errorf("waiters must receive the same credentials: %v", results)
+			break
+		}
+	}
+
+	// Cached credentials are returned immediately.
+	turn, err := turnService.WaitForCredentials(context.Background())
+	if err != nil || turn != results[0] {
+		t.Errorf("cached credentials must be returned: %v %v", turn, err)
+	}
+	if requests := server.Requests(); requests != 1 {
+		t.Errorf("cached credentials must not be fetched, got %d requests", requests)
+	}
+
+	// Fetch errors are returned.
+	server.Close()
+	turnService.ForceExpireForTesting()
+	if _, err := turnService.WaitForCredentials(context.Background()); err == nil || errors.Is(err, ErrNoCredentials) {
+		t.Errorf("fetch error must be returned, got %v", err)
+	}
+
+	// Expired static credentials are never fetched.
+	turnService.SetStaticCredentials(&CredentialsData{TTL: 0, Username: "user", Password: "password", Servers: testServers})
+	if _, err := turnService.WaitForCredentials(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+}
+
+func TestTURNServiceSynchronousHandlers(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetSynchronousHandlers(true)
+	turnService.Open("token", "client", "")
+
+	type call struct {
+		name        string
+		credentials *CachedCredentialsData
+		err         error
+	}
+	var calls []call
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		turnService.BindOnCredentials(func(credentials *CachedCredentialsData, err error) {
+			calls = append(calls, call{name, credentials, err})
+		})
+	}
+
+	// Handlers have returned when Credentials returns.
+	turn := turnService.Credentials(true)
+	if len(calls) != 3 || calls[0].name != "first" || calls[1].name != "second" || calls[2].name != "third" {
+		t.Fatalf("handlers must be called in registration order: %v", calls)
+	}
+	for _, c := range calls {
+		if c.credentials != turn || c.err != nil {
+			t.Errorf("%s: unexpected result %v / %v", c.name, c.credentials, c.err)
+		}
+	}
+
+	// Cache hits do not trigger handlers.
+	calls = nil
+	if turnService.Credentials(true) != turn || len(calls) != 0 {
+		t.Errorf("cache hit must not trigger handlers: %v", calls)
+	}
+
+	// Failed fetches pass the error of the fetch.
+	server.SetStatus(http.StatusInternalServerError)
+	turnService.ForceExpireForTesting()
+	turnService.Credentials(true)
+	if len(calls) != 3 {
+		t.Fatalf("expected 3 calls, got %v", calls)
+	}
+	for _, c := range calls {
+		if c.credentials != turn || c.err == nil || c.err != turnService.LastError() {
+			t.Errorf("%s: expected stale credentials with fetch error, got %v / %v", c.name, c.credentials, c.err)
+		}
+	}
+
+	// A successful fetch after the failure passes no stale error.
+	calls = nil
+	server.SetStatus(http.StatusOK)
+	turn2 := turnService.Credentials(true)
+	if len(calls) != 3 || calls[0].credentials != turn2 || calls[0].err != nil {
+		t.Errorf("expected new credentials without error, got %v", calls)
+	}
+}
+
+func TestTURNServiceCloseReplacedCredentials(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	var replaced []*CachedCredentialsData
+	for i := 0; i < 5; i++ {
+		turn, err := turnService.CredentialsValidFor(context.Background(), 2*time.Hour)
+		if err == nil || turn != nil {
+			t.Fatalf("credentials must not be valid for 2 hours: %v %v", turn, err)
+		}
+		replaced = append(replaced, turnService.Credentials(false))
+	}
+
+	current := replaced[len(replaced)-1]
+	for i, turn := range replaced[:len(replaced)-1] {
+		turn.RLock()
+		closed := turn.closed
+		turn.RUnlock()
+		if !closed {
+			t.Errorf("replaced credentials %d must be closed", i)
+		}
+		select {
+		case <-turn.done:
+		case <-time.After(time.Second):
+			t.Errorf("timer of replaced credentials %d must be released", i)
+		}
+	}
+	if current.Expired() {
+		t.Error("current credentials must not be expired")
+	}
+}
+
+func TestTURNServiceBindOnExpiring(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 2, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	// Credentials expire after one second.
+	turnService := NewTURNService(server.URL, WithExpirationPercentile(50))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	type result struct {
+		credentials *CachedCredentialsData
+		expired     bool
+		at          time.Time
+	}
+	expiring := make(chan result, 1)
+	clamped := make(chan result, 1)
+	turnService.BindOnExpiring(500*time.Millisecond, func(credentials *CachedCredentialsData) {
+		expiring <- result{credentials, credentials.Expired(), time.Now()}
+	})
+	unbind := turnService.BindOnExpiring(100*time.Millisecond, func(credentials *CachedCredentialsData) {
+		t.Error("unbound handler must not be called")
+	})
+	unbind()
+
+	start := time.Now()
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	// Bound after caching, with a lead exceeding the TTL.
+	turnService.BindOnExpiring(time.Hour, func(credentials *CachedCredentialsData) {
+		clamped <- result{credentials, credentials.Expired(), time.Now()}
+	})
+
+	select {
+	case r := <-clamped:
+		if r.credentials != turn || r.expired {
+			t.Errorf("clamped handler called with %v, expired %v", r.credentials, r.expired)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("clamped handler not called")
+	}
+
+	select {
+	case r := <-expiring:
+		if r.credentials != turn {
+			t.Errorf("expected %v, got %v", turn, r.credentials)
+		}
+		if r.expired {
+			t.Error("handler must be called before credentials expire")
+		}
+		if elapsed := r.at.Sub(start); elapsed < 400*time.Millisecond {
+			t.Errorf("handler called too early after %s", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expiring handler not called")
+	}
+
+	waitFor(t, 2*time.Second, turn.Expired)
+}
+
+func TestEncodeAuthorization(t *testing.T) {
+	testcases := []struct {
+		accessToken string
+		session     string
+		valid       bool
+	}{
+		{"token", "", true},
+		{"token", "session", true},
+		{"to:ken", "session", false},
+		{"token", "ses:sion", false},
+		{":", "", false},
+	}
+
+	for _, testcase := range testcases {
+		auth, err := encodeAuthorization(testcase.accessToken, testcase.session)
+		if !testcase.valid {
+			if err == nil {
+				t.Errorf("%q/%q: expected error, got %s", testcase.accessToken, testcase.session, auth)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q/%q: unexpected error: %s", testcase.accessToken, testcase.session, err)
+			continue
+		}
+		expected := "Bearer " + base64.StdEncoding.EncodeToString([]byte(testcase.accessToken+":"+testcase.session))
+		if auth != expected {
+			t.Errorf("%q/%q: expected %s, got %s", testcase.accessToken, testcase.session, expected, auth)
+		}
+	}
+}
+
+func TestTURNServiceAccessTokenWithColon(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("to:ken", "client", "")
+
+	if _, err := turnService.FetchCredentials(); err == nil {
+		t.Error("access token with colon must be rejected")
+	}
+	if requests := server.Requests(); requests != 0 {
+		t.Errorf("no request must be made, got %d", requests)
+	}
+}
+
+type testLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (logger *testLogger) Printf(format string, v ...interface{}) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.messages = append(logger.messages, fmt.Sprintf(format, v...))
+}
+
+func (logger *testLogger) Messages() []string {
+	logger.Lock()
+	defer logger.Unlock()
+	return append([]string(nil), logger.messages...)
+}
+
+// Matching returns the messages containing substr.
+func (logger *testLogger) Matching(substr string) []string {
+	var messages []string
+	for _, message := range logger.Messages() {
+		if strings.Contains(message, substr) {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func TestTURNServiceLogger(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	logger := &testLogger{}
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	turnService.BindOnCredentials(func(*CachedCredentialsData, error) {})
+
+	// No logger, no output and no allocations.
+	turnService.Credentials(true)
+	allocs := testing.AllocsPerRun(100, func() {
+		if turnService.logger.enabled() {
+			turnService.logger.Printf("turnservicecli: fetch %d: %s", 1, "message")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("disabled logging must not allocate, got %f allocations", allocs)
+	}
+	turnService.SetLogger(logger)
+
+	turnService.ForceExpireForTesting()
+	turnService.Credentials(true)
+	for _, substr := range []string{"fetch 2: fetching credentials", "fetch 2: received credentials from " + server.URL + " with TTL 3600s", "fetch 2: dispatching to 1 handlers"} {
+		if messages := logger.Matching(substr); len(messages) != 1 {
+			t.Errorf("expected message %q, got %v", substr, logger.Messages())
+		}
+	}
+
+	server.SetStatus(http.StatusServiceUnavailable)
+	turnService.ForceExpireForTesting()
+	turnService.Credentials(true)
+	if messages := logger.Matching("fetch 3: failed with status 503"); len(messages) != 1 {
+		t.Errorf("expected failure with status code, got %v", logger.Messages())
+	}
+
+	turnService.Autorefresh(true)
+	if messages := logger.Matching("refresh triggered"); len(messages) != 1 {
+		t.Errorf("expected autorefresh trigger, got %v", logger.Messages())
+	}
+}
+
+func TestTURNServiceMaxCredentialsTTL(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 1000000000000, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	logger := &testLogger{}
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetLogger(logger)
+	turnService.SetMaxCredentialsTTL(time.Second)
+	turnService.Open("token", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if turn.expiry != time.Second {
+		t.Errorf("expiry must be clamped, got %s", turn.expiry)
+	}
+	if turn.TTL() < 1000000000000-10 {
+		t.Errorf("TTL of the server must be reported, got %d", turn.TTL())
+	}
+	if messages := logger.Matching("exceeds maximum"); len(messages) != 1 {
+		t.Errorf("expected warning on clamping, got %v", logger.Messages())
+	}
+	waitFor(t, 2*time.Second, turn.Expired)
+}
+
+func TestTURNServiceCacheable(t *testing.T) {
+	for _, cacheable := range []bool{true, false} {
+		server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+		server.SetCacheable(&cacheable)
+
+		turnService := NewTURNService(server.URL)
+		turnService.Open("token", "client", "")
+
+		turn := turnService.Credentials(true)
+		if turn == nil {
+			t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+		}
+		turn2 := turnService.Credentials(true)
+		if cacheable && (turn2 != turn || server.Requests() != 1) {
+			t.Errorf("cacheable credentials must be cached, got %d requests", server.Requests())
+		} else if !cacheable && (turn2 == turn || server.Requests() != 2) {
+			t.Errorf("non-cacheable credentials must not be cached, got %d requests", server.Requests())
+		}
+		if !cacheable && turnService.Credentials(false) != nil {
+			t.Error("non-cacheable credentials must not be returned from cache")
+		}
+
+		turnService.Close()
+		server.Close()
+	}
+}
+
+func TestTURNServiceCachePredicate(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	turnService.SetCachePredicate(func(response *CredentialsResponse) bool {
+		// The predicate may use the service.
+		turnService.LastError()
+		turnService.Credentials(false)
+		return response.Turn.Username != "user"
+	})
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if turn.Expired() {
+		t.Error("credentials which are not cached must be usable")
+	}
+	if turn := turnService.Credentials(false); turn != nil {
+		t.Error("credentials rejected by predicate must not be cached")
+	}
+
+	// The next fetch releases credentials which were not cached.
+	if turn2 := turnService.Credentials(true); turn2 == nil || turn2 == turn {
+		t.Fatalf("credentials must be fetched again, got %v", turn2)
+	}
+	if !turn.Expired() {
+		t.Error("credentials which were not cached must be closed after the next fetch")
+	}
+}
+
+func TestTURNServiceCredentialsValidFor(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	turn, err := turnService.CredentialsValidFor(context.Background(), 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached credentials are sufficient.
+	turn2, err := turnService.CredentialsValidFor(context.Background(), 30*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turn2 != turn || server.Requests() != 1 {
+		t.Errorf("cached credentials must be returned, got %d requests", server.Requests())
+	}
+
+	// Cached credentials are insufficient.
+	server.SetTurn(&CredentialsData{TTL: 10800, Username: "user", Password: "password", Servers: testServers})
+	turn3, err := turnService.CredentialsValidFor(context.Background(), 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turn3 == turn || turn3.Turn.TTL != 10800 || server.Requests() != 2 {
+		t.Errorf("new credentials must be fetched, got %d requests", server.Requests())
+	}
+	if turnService.Credentials(false) != turn3 {
+		t.Error("new credentials must be cached")
+	}
+
+	// Even new credentials are insufficient.
+	if _, err := turnService.CredentialsValidFor(context.Background(), 4*time.Hour); err == nil {
+		t.Error("expected error for impossible duration")
+	}
+	if server.Requests() != 3 {
+		t.Errorf("new credentials must be fetched, got %d requests", server.Requests())
+	}
+}
+
+func TestTURNServiceInsecure(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	if turnService.IsInsecure() {
+		t.Error("default configuration must not be insecure")
+	}
+	turnService.Close()
+
+	logger := &testLogger{}
+	turnService = NewTURNService(server.URL, WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	defer turnService.Close()
+	turnService.SetLogger(logger)
+	turnService.Open("token", "client", "")
+	if !turnService.IsInsecure() {
+		t.Error("configuration must be insecure")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := turnService.FetchCredentials(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if messages := logger.Matching("WARNING"); len(messages) != 1 {
+		t.Errorf("expected one rate limited warning, got %v", logger.Messages())
+	}
+}
+
+func TestTURNServiceDistinctCredentialsSince(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user1", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	start := time.Now().Round(0)
+	clock := &fakeClock{now: start}
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetClock(clock)
+	turnService.TrackCredentials(3)
+	turnService.Open("token", "client", "")
+
+	fetch := func(username string) {
+		server.SetTurn(&CredentialsData{TTL: 3600, Username: username, Password: "password", Servers: testServers})
+		turnService.ForceExpireForTesting()
+		if turn := turnService.Credentials(true); turn == nil {
+			t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+		}
+		clock.Advance(time.Minute)
+	}
+
+	fetch("user1")
+	fetch("user1")
+	fetch("user2")
+	if distinct := turnService.DistinctCredentialsSince(start); distinct != 2 {
+		t.Errorf("expected 2 distinct credentials, got %d", distinct)
+	}
+	if distinct := turnService.DistinctCredentialsSince(start.Add(90 * time.Second)); distinct != 1 {
+		t.Errorf("expected 1 distinct credentials, got %d", distinct)
+	}
+
+	// Only the last three fetches are kept.
+	fetch("user3")
+	fetch("user3")
+	if distinct := turnService.DistinctCredentialsSince(start); distinct != 2 {
+		t.Errorf("expected 2 distinct credentials, got %d", distinct)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base := time.Second
+	max := 10 * time.Second
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, max, max}
+	for failures, delay := range expected {
+		if d := backoffDelay(base, max, failures); d != delay {
+			t.Errorf("failures %d: expected %s, got %s", failures, delay, d)
+		}
+	}
+	if d := backoffDelay(0, max, 3); d != 0 {
+		t.Errorf("disabled backoff must not delay, got %s", d)
+	}
+}
+
+func TestTURNServiceRefreshBackoff(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	server.SetStatus(http.StatusServiceUnavailable)
+	defer server.Close()
+
+	base := 50 * time.Millisecond
+	max := 200 * time.Millisecond
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetRefreshBackoff(base, max)
+	turnService.Open("token", "client", "")
+
+	checkSpacing := func(times []time.Time) {
+		expected := []time.Duration{base, 2 * base, max, max}
+		for i, delay := range expected {
+			spacing := times[i+1].Sub(times[i])
+			if spacing < delay || spacing > delay+150*time.Millisecond {
+				t.Errorf("attempt %d: expected spacing of %s, got %s", i+1, delay, spacing)
+			}
+		}
+	}
+
+	turnService.Autorefresh(true)
+	waitFor(t, 2*time.Second, func() bool {
+		return server.Requests() >= 5
+	})
+	checkSpacing(server.Times())
+
+	// Recover, credentials are fetched on the next attempt.
+	server.SetStatus(http.StatusOK)
+	waitFor(t, time.Second, func() bool {
+		return turnService.Credentials(false) != nil
+	})
+	recovered := server.Requests()
+
+	// Backoff starts again from base after recovery.
+	server.SetStatus(http.StatusServiceUnavailable)
+	turnService.ForceExpireForTesting()
+	turnService.scheduleRefresh()
+	waitFor(t, 2*time.Second, func() bool {
+		return server.Requests() >= recovered+5
+	})
+	checkSpacing(server.Times()[recovered:])
+}
+
+func TestTURNServiceRetryPolicy(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	server.FailNext(2, http.StatusServiceUnavailable)
+
+	turnService := NewTURNService(server.URL, WithRetryPolicy(3, 10*time.Millisecond))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatalf("fetch must succeed after retries: %s", err)
+	}
+	if attempts := server.Requests(); attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	// Exhausted attempts.
+	server.FailNext(10, http.StatusServiceUnavailable)
+	var statusErr *StatusError
+	if _, err := turnService.FetchCredentials(); !errors.As(err, &statusErr) {
+		t.Errorf("expected status error after exhausting attempts, got %v", err)
+	} else if statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, statusErr.StatusCode)
+	} else if !strings.Contains(string(statusErr.Body), http.StatusText(http.StatusServiceUnavailable)) {
+		t.Errorf("status error must contain the response body, got %q", statusErr.Body)
+	} else if !errors.Is(err, ErrUnexpectedStatus) {
+		t.Error("status error must match ErrUnexpectedStatus")
+	}
+	if attempts := server.Requests(); attempts != 6 {
+		t.Errorf("expected 3 attempts, got %d", attempts-3)
+	}
+
+	// Forbidden is never retried.
+	server.FailNext(10, http.StatusForbidden)
+	if _, err := turnService.FetchCredentials(); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected forbidden, got %v", err)
+	} else if !strings.Contains(err.Error(), http.StatusText(http.StatusForbidden)) {
+		t.Errorf("forbidden error must contain the response body: %s", err)
+	}
+	if attempts := server.Requests(); attempts != 7 {
+		t.Errorf("forbidden must not be retried, got %d attempts", attempts-6)
+	}
+
+	// Nonce mismatches are never retried.
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	turnServer.SetNonce("wrong")
+	turnService2 := NewTURNService(turnServer.URL)
+	defer turnService2.Close()
+	turnService2.Open("token", "client", "")
+	turnService2.SetRetryPolicy(3, 10*time.Millisecond)
+	if _, err := turnService2.FetchCredentials(); !errors.Is(err, ErrInvalidNonce) {
+		t.Errorf("expected invalid nonce, got %v", err)
+	}
+	if requests := turnServer.Requests(); requests != 1 {
+		t.Errorf("nonce mismatch must not be retried, got %d attempts", requests)
+	}
+}
+
+func TestTURNServiceCredentialsWithGeo(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	server.SetGeo(&GeoData{Prefer: []string{"b", "a"}})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	turn, geo, err := turnService.CredentialsWithGeo(context.Background(), false)
+	if err != nil || turn != nil || geo != nil {
+		t.Errorf("nothing must be returned without fetch: %v %v %v", turn, geo, err)
+	}
+
+	turn, geo, err = turnService.CredentialsWithGeo(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turn == nil || turn.Turn.Username != "user" {
+		t.Errorf("unexpected credentials: %v", turn)
+	}
+	if geo == nil || len(geo.Prefer) != 2 || geo.Prefer[0] != "b" || geo.Prefer[1] != "a" {
+		t.Errorf("unexpected geo data: %v", geo)
+	}
+
+	// Both are cached.
+	turn2, geo2, err := turnService.CredentialsWithGeo(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turn2 != turn || geo2 != geo {
+		t.Error("cached data must be returned")
+	}
+	if server.Requests() != 1 || server.GeoRequests() != 1 {
+		t.Errorf("expected one request each, got %d/%d", server.Requests(), server.GeoRequests())
+	}
+}
+
+func TestTURNServiceCredentialsWithGeoFailure(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	server.SetGeoStatus(http.StatusInternalServerError)
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	turn, geo, err := turnService.CredentialsWithGeo(context.Background(), true)
+	var geoErr *GeoError
+	if !errors.As(err, &geoErr) {
+		t.Fatalf("expected geo error, got %v", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("geo error must wrap the status error, got %v", err)
+	}
+	if turn == nil || turn.Turn.Username != "user" {
+		t.Errorf("credentials must be returned without geo data, got %v", turn)
+	}
+	if geo != nil {
+		t.Errorf("geo data must be nil, got %v", geo)
+	}
+}
+
+func TestTURNServiceGeo(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	if _, err := turnService.Geo(true); !errors.Is(err, ErrUnsuccessful) {
+		t.Errorf("expected unsuccessful, got %v", err)
+	}
+
+	server.SetGeo(&GeoData{Prefer: []string{"c", "a", "b"}})
+	if geo, err := turnService.Geo(false); err != nil || geo != nil {
+		t.Errorf("nothing must be returned without fetch: %v %v", geo, err)
+	}
+	geo, err := turnService.GeoContext(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo == nil || strings.Join(geo.Prefer, ",") != "c,a,b" {
+		t.Errorf("unexpected geo data: %v", geo)
+	}
+
+	geo2, err := turnService.Geo(true)
+	if err != nil || geo2 != geo {
+		t.Errorf("cached geo data must be returned: %v %v", geo2, err)
+	}
+	if requests := server.GeoRequests(); requests != 2 {
+		t.Errorf("expected 2 geo requests, got %d", requests)
+	}
+	if requests := server.Requests(); requests != 0 {
+		t.Errorf("geo must not fetch credentials, got %d requests", requests)
+	}
+}
+
+func TestTURNServiceFetchGeo(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	server.SetGeo(&GeoData{Prefer: []string{"a"}})
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	geo, err := turnService.FetchGeo()
+	if err != nil || geo == nil || strings.Join(geo.Prefer, ",") != "a" {
+		t.Fatalf("unexpected geo data: %v %v", geo, err)
+	}
+
+	server.SetGeo(&GeoData{Prefer: []string{"b"}})
+	geo, err = turnService.FetchGeo()
+	if err != nil || geo == nil || strings.Join(geo.Prefer, ",") != "b" {
+		t.Fatalf("geo data must always be fetched: %v %v", geo, err)
+	}
+	if cached, _ := turnService.Geo(false); cached != geo {
+		t.Errorf("fetched geo data must be cached: %v", cached)
+	}
+	if requests := server.GeoRequests(); requests != 2 {
+		t.Errorf("expected 2 geo requests, got %d", requests)
+	}
+}
+
+func TestTURNServiceCancelDuringDecode(t *testing.T) {
+	var slow bool
+	var lock sync.Mutex
+	started := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		isSlow := slow
+		lock.Unlock()
+
+		nonce := r.PostFormValue("nonce")
+		w.Header().Set("Content-Type", "application/json")
+		if !isSlow {
+			fmt.Fprintf(w, `{"success":true,"nonce":%q,"session":"session1","turn":{"ttl":3600,"username":"user1","password":"password","servers":[{"id":"test","urns":["turn:turn.example.com:3478?transport=udp"]}]}}`, nonce)
+			return
+		}
+
+		// Send a partial response and stall until the client gives up.
+		fmt.Fprintf(w, `{"success":true,"nonce":%q,"session":"session2","turn":{"ttl":3600,`, nonce)
+		w.(http.Flusher).Flush()
+		started <- true
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+
+	lock.Lock()
+	slow = true
+	lock.Unlock()
+	turnService.ForceExpireForTesting()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	turn2, _, err := turnService.getCredentials(ctx, true)
+	if err == nil {
+		t.Fatal("cancelled fetch must return an error")
+	}
+	if turn2 != turn {
+		t.Error("cancelled fetch must return the previous credentials")
+	}
+
+	turnService.RLock()
+	credentials := turnService.credentials
+	session := turnService.session
+	lastErr := turnService.err
+	turnService.RUnlock()
+	if credentials != turn || credentials.Turn.Username != "user1" {
+		t.Errorf("previous credentials must be kept, got %+v", credentials.Turn)
+	}
+	if session != "session1" {
+		t.Errorf("previous session must be kept, got %s", session)
+	}
+	if lastErr != nil {
+		t.Errorf("cancelled fetch must not change the last error, got %s", lastErr)
+	}
+}
+
+type lockedReader struct {
+	sync.Mutex
+	r io.Reader
+}
+
+func (r *lockedReader) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.r.Read(p)
+}
+
+func newDeterministicReader(seed int64) io.Reader {
+	return &lockedReader{r: rand.New(rand.NewSource(seed))}
+}
+
+func TestTURNServiceRandom(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		turnService := NewTURNService(server.URL)
+		turnService.SetRandom(newDeterministicReader(1))
+		turnService.Open("token", "client", "")
+		for j := 0; j < 2; j++ {
+			if _, err := turnService.FetchCredentials(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		turnService.Close()
+	}
+
+	nonces := server.Nonces()
+	if nonces[0] != nonces[2] || nonces[1] != nonces[3] {
+		t.Errorf("nonces must be reproducible: %v", nonces)
+	}
+	if nonces[0] == nonces[1] {
+		t.Errorf("nonces must differ between requests: %v", nonces)
+	}
+}
+
+func TestTURNServiceDefaultFetchTimeout(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	release := make(chan struct{})
+	server.Hold(release)
+
+	turnService := NewTURNService(server.URL).WithDefaultFetchTimeout(50 * time.Millisecond)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	if _, _, err := turnService.getCredentials(context.Background(), true); err == nil {
+		t.Fatal("fetch must fail after the default timeout")
+	}
+
+	// Answer after the default timeout has passed.
+	time.AfterFunc(200*time.Millisecond, func() {
+		close(release)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	turn, _, err := turnService.getCredentials(ctx, true)
+	if err != nil {
+		t.Fatalf("explicit deadline must override the default: %s", err)
+	}
+	if turn == nil || turn.Turn.Username != "user" {
+		t.Errorf("unexpected credentials: %+v", turn)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("no randomness")
+}
+
+func TestTURNServiceNonce(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	server.SetNonce("make-me-random")
+	if _, err := turnService.FetchCredentials(); !errors.Is(err, ErrInvalidNonce) {
+		t.Errorf("expected nonce mismatch, got %v", err)
+	}
+	if turnService.Credentials(true) != nil {
+		t.Error("credentials with mismatched nonce must be rejected")
+	}
+
+	turnService.SetRandom(errReader{})
+	requests := server.Requests()
+	if _, err := turnService.FetchCredentials(); err == nil || !strings.HasPrefix(err.Error(), "failed to make nonce") {
+		t.Errorf("expected nonce generation error, got %v", err)
+	}
+	if server.Requests() != requests {
+		t.Error("no request must be sent without nonce")
+	}
+}
+
+func TestTURNServiceNonceMode(t *testing.T) {
+	// Serves responses with a fixed nonce, an empty reply echoes nothing.
+	newServer := func(reply string, sent *[]string, lock *sync.Mutex) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			*sent = append(*sent, r.PostFormValue("nonce"))
+			lock.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&CredentialsResponse{
+				Success: true,
+				Nonce:   reply,
+				Turn:    &CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers},
+			})
+		}))
+	}
+
+	testcases := []struct {
+		name    string
+		mode    NonceMode
+		reply   string
+		sent    bool
+		success bool
+	}{
+		{"required without nonce", NonceRequired, "", true, false},
+		{"required with wrong nonce", NonceRequired, "wrong", true, false},
+		{"optional without nonce", NonceOptional, "", true, true},
+		{"optional with wrong nonce", NonceOptional, "wrong", true, false},
+		{"disabled without nonce", NonceDisabled, "", false, true},
+		{"disabled with wrong nonce", NonceDisabled, "wrong", false, true},
+	}
+
+	for _, testcase := range testcases {
+		var lock sync.Mutex
+		var sent []string
+		server := newServer(testcase.reply, &sent, &lock)
+
+		turnService := NewTURNService(server.URL)
+		turnService.SetNonceMode(testcase.mode)
+		turnService.Open("token", "client", "")
+		_, err := turnService.FetchCredentials()
+		if testcase.success && err != nil {
+			t.Errorf("%s: expected success, got %s", testcase.name, err)
+		} else if !testcase.success && !errors.Is(err, ErrInvalidNonce) {
+			t.Errorf("%s: expected nonce mismatch, got %v", testcase.name, err)
+		}
+		lock.Lock()
+		if len(sent) != 1 || (sent[0] != "") != testcase.sent {
+			t.Errorf("%s: unexpected nonces sent: %v", testcase.name, sent)
+		}
+		lock.Unlock()
+		turnService.Close()
+		server.Close()
+	}
+
+	// Optional mode works with servers echoing the nonce.
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetNonceMode(NonceOptional)
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Errorf("optional mode with echoed nonce: %s", err)
+	}
+}
+
+func TestTURNServiceRefreshJitter(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 1000, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	// The TTL must not change between services, even at second boundaries.
+	clock := &fakeClock{now: time.Now().Round(0)}
+	newService := func(seed int64, fraction float64) *TURNService {
+		turnService := NewTURNService(server.URL)
+		turnService.SetClock(clock)
+		turnService.SetRandom(newDeterministicReader(seed))
+		turnService.SetRefreshJitter(fraction)
+		turnService.Open("token", "client", "")
+		if turnService.Credentials(true) == nil {
+			t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+		}
+		return turnService
+	}
+
+	turnService := newService(1, 0.1)
+	if delay := turnService.refreshJitterDelay(); delay != 0 {
+		t.Errorf("no jitter before expiry, got %s", delay)
+	}
+	turnService.Close()
+
+	delays := make(map[time.Duration]bool)
+	for seed := int64(1); seed <= 5; seed++ {
+		turnService := newService(seed, 0.1)
+		turnService.ForceExpireForTesting()
+		delay := turnService.refreshJitterDelay()
+		if delay < 0 || delay >= 100*time.Second {
+			t.Errorf("seed %d: delay %s out of range", seed, delay)
+		}
+		delays[delay] = true
+
+		turnService2 := newService(seed, 0.1)
+		turnService2.ForceExpireForTesting()
+		if delay2 := turnService2.refreshJitterDelay(); delay2 != delay {
+			t.Errorf("seed %d: delays must be reproducible, got %s and %s", seed, delay, delay2)
+		}
+		turnService.Close()
+		turnService2.Close()
+	}
+	if len(delays) != 5 {
+		t.Errorf("delays must be distributed, got %v", delays)
+	}
+
+	turnService = newService(1, 0)
+	defer turnService.Close()
+	turnService.ForceExpireForTesting()
+	if delay := turnService.refreshJitterDelay(); delay != 0 {
+		t.Errorf("disabled jitter must not delay, got %s", delay)
+	}
+	turnService.SetRefreshJitter(5)
+	if turnService.refreshJitter >= 1 {
+		t.Errorf("fraction must be clamped below 1, got %f", turnService.refreshJitter)
+	}
+
+	// Autorefresh waits for the jitter delay.
+	turnService.SetRefreshJitter(0.5)
+	requests := server.Requests()
+	turnService.Autorefresh(true)
+	waitRefreshLoop(t, turnService)
+	if requests := server.Requests() - requests; requests != 0 {
+		t.Errorf("refresh must be delayed by jitter, got %d requests", requests)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	var values []time.Duration
+	for i := 0; i < 2; i++ {
+		random := newDeterministicReader(1)
+		for j := 0; j < 3; j++ {
+			d, err := jitter(random, time.Minute, 0.5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d < 0 || d >= 30*time.Second {
+				t.Errorf("jitter out of range: %s", d)
+			}
+			values = append(values, d)
+		}
+	}
+	for j := 0; j < 3; j++ {
+		if values[j] != values[j+3] {
+			t.Errorf("jitter must be reproducible: %v", values)
+		}
+	}
+	if values[0] == values[1] && values[1] == values[2] {
+		t.Errorf("jitter must be distributed: %v", values)
+	}
+}
+
+func TestTURNServiceRefreshing(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	release := make(chan bool)
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		handler.ServeHTTP(w, r)
+	})
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	if turnService.Refreshing() {
+		t.Error("must not be refreshing before fetch")
+	}
+
+	done := make(chan *CachedCredentialsData)
+	go func() {
+		done <- turnService.Credentials(true)
+	}()
+	waitFor(t, time.Second, turnService.Refreshing)
+
+	close(release)
+	if turn := <-done; turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if turnService.Refreshing() {
+		t.Error("must not be refreshing after fetch")
+	}
+}
+
+func TestTURNServiceAuthModes(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	testcases := []struct {
+		name         string
+		accessToken  string
+		clientID     string
+		clientIDOnly bool
+		valid        bool
+	}{
+		{"none", "", "", false, false},
+		{"none with clientID only", "", "", true, false},
+		{"token only", "token", "", false, true},
+		{"both", "token", "client", false, true},
+		{"clientID only disabled", "", "client", false, false},
+		{"clientID only enabled", "", "client", true, true},
+	}
+
+	for _, testcase := range testcases {
+		turnService := NewTURNService(server.URL)
+		turnService.SetClientIDOnlyAuth(testcase.clientIDOnly)
+		turnService.Open(testcase.accessToken, testcase.clientID, "")
+
+		requests := server.Requests()
+		_, err := turnService.FetchCredentials()
+		if testcase.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.name, err)
+		} else if !testcase.valid {
+			if err == nil {
+				t.Errorf("%s: expected error", testcase.name)
+			} else if server.Requests() != requests {
+				t.Errorf("%s: no request must be made", testcase.name)
+			}
+		}
+		turnService.Close()
+	}
+}
+
+func TestTURNServiceRequestShapes(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	testcases := []struct {
+		name        string
+		accessToken string
+		clientID    string
+		body        string
+		auth        string
+	}{
+		{"accessToken only", "token", "", "", "Bearer " + base64.StdEncoding.EncodeToString([]byte("token:"))},
+		{"clientID only", "", "client", "client_id=client", ""},
+		{"both", "token", "client", "client_id=client", "Bearer " + base64.StdEncoding.EncodeToString([]byte("token:"))},
+	}
+
+	for _, testcase := range testcases {
+		turnService := NewTURNService(server.URL)
+		turnService.SetClientIDOnlyAuth(true)
+		turnService.SetNonceMode(NonceDisabled)
+		turnService.Open(testcase.accessToken, testcase.clientID, "")
+
+		if _, err := turnService.FetchCredentials(); err != nil {
+			t.Errorf("%s: unexpected error: %s", testcase.name, err)
+		}
+		forms, headers := server.Forms(), server.Headers()
+		body := forms[len(forms)-1].Encode()
+		_, hasAuth := headers[len(headers)-1]["Authorization"]
+		auth := server.Authorization()
+		if body != testcase.body {
+			t.Errorf("%s: expected body %q, got %q", testcase.name, testcase.body, body)
+		}
+		if testcase.auth == "" && hasAuth {
+			t.Errorf("%s: Authorization must be omitted, got %q", testcase.name, auth)
+		} else if auth != testcase.auth {
+			t.Errorf("%s: expected Authorization %q, got %q", testcase.name, testcase.auth, auth)
+		}
+		turnService.Close()
+	}
+}
+
+func TestTURNServiceMissingSession(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	server.SetSession("")
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatalf("a response without a session must be accepted for a new session: %s", err)
+	}
+
+	turnService.Open("token", "client", "previous-session")
+	if _, err := turnService.FetchCredentials(); !errors.Is(err, ErrMissingSession) {
+		t.Errorf("expected ErrMissingSession, got %v", err)
+	}
+}
+
+func TestTURNServiceNotifyNetworkChanged(t *testing.T) {
+	for _, reset := range []bool{false, true} {
+		server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+
+		turnService := NewTURNService(server.URL)
+		turnService.SetResetSessionOnNetworkChange(reset)
+		turnService.Open("token", "client", "")
+
+		turn := turnService.Credentials(true)
+		if turn == nil {
+			t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+		}
+
+		turnService.NotifyNetworkChanged()
+		if !turn.Expired() {
+			t.Error("credentials must be expired after network change")
+		}
+		waitFor(t, time.Second, func() bool {
+			return server.Requests() == 2
+		})
+
+		expected := "test-session"
+		if reset {
+			expected = ""
+		}
+		if sessions := server.Sessions(); sessions[1] != expected {
+			t.Errorf("reset %v: expected session %q, got %q", reset, expected, sessions[1])
+		}
+
+		turnService.Close()
+		server.Close()
+	}
+}
+
+func TestIsFailoverError(t *testing.T) {
+	testcases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"connection refused", &url.Error{Op: "Post", URL: "https://example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, true},
+		{"eof", &url.Error{Op: "Post", URL: "https://example.com", Err: io.EOF}, true},
+		{"server error", &StatusError{"credentials", http.StatusBadGateway, nil}, true},
+		{"wrapped server error", fmt.Errorf("fetch: %w", &StatusError{"credentials", http.StatusBadGateway, nil}), true},
+		{"client error", &StatusError{"credentials", http.StatusNotFound, nil}, false},
+		{"unknown authority", &url.Error{Op: "Post", URL: "https://example.com", Err: x509.UnknownAuthorityError{}}, false},
+		{"hostname", &url.Error{Op: "Post", URL: "https://example.com", Err: x509.HostnameError{Host: "example.com"}}, false},
+		{"pinning", &url.Error{Op: "Post", URL: "https://example.com", Err: &PinningError{Pins: []string{"pin"}}}, false},
+		{"scheme", &url.Error{Op: "Post", URL: "ftp://example.com", Err: errors.New("unsupported protocol scheme \"ftp\"")}, false},
+		{"forbidden", ErrForbidden, false},
+	}
+	for _, testcase := range testcases {
+		if result := isFailoverError(testcase.err); result != testcase.expected {
+			t.Errorf("%s: expected %v, got %v", testcase.name, testcase.expected, result)
+		}
+	}
+
+	// Certificate errors are not retried.
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	server := httptest.NewUnstartedServer(turnServer.Config.Handler)
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	var connections int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	turnService := NewTURNService(server.URL, WithRetryPolicy(3, 10*time.Millisecond))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err == nil {
+		t.Fatal("expected certificate error")
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("certificate errors must not be retried, got %d connections", n)
+	}
+}
+
+func TestTURNServiceFailoverSessions(t *testing.T) {
+	primary := NewTestServer(&CredentialsData{TTL: 3600, Username: "primary", Password: "password", Servers: testServers})
+	primary.session = "primary-session"
+	defer primary.Close()
+	secondary := NewTestServer(&CredentialsData{TTL: 3600, Username: "secondary", Password: "password", Servers: testServers})
+	secondary.session = "secondary-session"
+	defer secondary.Close()
+
+	turnService := NewTURNService(primary.URL)
+	defer turnService.Close()
+	turnService.SetEndpoints([]string{primary.URL, secondary.URL})
+	turnService.Open("token", "client", "")
+
+	fetch := func(username string) {
+		turnService.ForceExpireForTesting()
+		turn := turnService.Credentials(true)
+		if turn == nil {
+			t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+		}
+		if turn.Turn.Username != username {
+			t.Errorf("expected credentials from %s, got %s", username, turn.Turn.Username)
+		}
+	}
+
+	fetch("primary")
+	fetch("primary")
+
+	// Fail over to the secondary, which gets its own session.
+	primary.SetStatus(http.StatusServiceUnavailable)
+	fetch("secondary")
+	fetch("secondary")
+
+	// Recover on the primary with its own session.
+	primary.SetStatus(http.StatusOK)
+	fetch("primary")
+
+	if sessions := primary.Sessions(); len(sessions) != 5 || sessions[1] != "primary-session" || sessions[4] != "primary-session" {
+		t.Errorf("unexpected primary sessions: %v", sessions)
+	}
+	if sessions := secondary.Sessions(); len(sessions) != 2 || sessions[0] != "" || sessions[1] != "secondary-session" {
+		t.Errorf("unexpected secondary sessions: %v", sessions)
+	}
+}
+
+func TestTURNServiceMulti(t *testing.T) {
+	first := NewTestServer(&CredentialsData{TTL: 3600, Username: "first", Password: "password", Servers: testServers})
+	defer first.Close()
+	first.SetStatus(http.StatusServiceUnavailable)
+	second := NewTestServer(&CredentialsData{TTL: 3600, Username: "second", Password: "password", Servers: testServers})
+	defer second.Close()
+
+	turnService := NewTURNServiceMulti([]string{first.URL, second.URL})
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil || turn.Turn.Username != "second" {
+		t.Fatalf("expected credentials from second, got %v: %s", turn, turnService.LastError())
+	}
+	if first.Requests() != 1 || second.Requests() != 1 {
+		t.Errorf("expected one request each, got %d/%d", first.Requests(), second.Requests())
+	}
+
+	// Sticky endpoints try the last successful endpoint first.
+	turnService.SetStickyEndpoint(true)
+	turnService.ForceExpireForTesting()
+	if turn := turnService.Credentials(true); turn == nil || turn.Turn.Username != "second" {
+		t.Fatalf("expected credentials from second, got %v", turn)
+	}
+	if first.Requests() != 1 || second.Requests() != 2 {
+		t.Errorf("sticky endpoint must be tried first, got %d/%d", first.Requests(), second.Requests())
+	}
+
+	// The last error is returned if all endpoints fail.
+	second.SetStatus(http.StatusBadGateway)
+	turnService.ForceExpireForTesting()
+	turnService.Credentials(true)
+	var statusErr *StatusError
+	if err := turnService.LastError(); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status error of first endpoint, got %v", err)
+	}
+	if first.Requests() != 2 || second.Requests() != 3 {
+		t.Errorf("all endpoints must be tried, got %d/%d", first.Requests(), second.Requests())
+	}
+}
+
+func TestTURNServiceValidateCredentials(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password"})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	if turn := turnService.Credentials(true); turn != nil {
+		t.Error("credentials without servers must not be cached")
+	}
+	if err := turnService.LastError(); !errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "no servers") {
+		t.Errorf("expected invalid credentials without servers, got %v", err)
+	}
+
+	server.SetTurn(&CredentialsData{TTL: 3600, Username: "user", Servers: testServers})
+	if turn := turnService.Credentials(true); turn != nil {
+		t.Error("credentials without password must not be cached")
+	}
+	if err := turnService.LastError(); !errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "missing password") {
+		t.Errorf("expected invalid credentials without password, got %v", err)
+	}
+
+	server.SetTurn(nil)
+	if turn := turnService.Credentials(true); turn != nil || !errors.Is(turnService.LastError(), ErrInvalidCredentials) {
+		t.Errorf("response without turn data must be rejected, got %v", turnService.LastError())
+	}
+
+	// Opt-out for services returning only a geo URI.
+	server.SetTurn(&CredentialsData{TTL: 3600, GeoURI: "https://geo.example.com"})
+	turnService.SetValidateCredentials(false)
+	turn := turnService.Credentials(true)
+	if turn == nil || turn.Turn.GeoURI != "https://geo.example.com" {
+		t.Errorf("unvalidated credentials must be cached: %v %v", turn, turnService.LastError())
+	}
+}
+
+func TestTURNServiceExternalIPHint(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	fetch := func() url.Values {
+		if _, err := turnService.FetchCredentials(); err != nil {
+			t.Fatal(err)
+		}
+		forms := server.Forms()
+		return forms[len(forms)-1]
+	}
+
+	if form := fetch(); form.Get("external_ip") != "" {
+		t.Errorf("no hint must be sent by default, got %s", form.Get("external_ip"))
+	}
+
+	turnService.SetExternalIPHint("192.0.2.1")
+	if form := fetch(); form.Get("external_ip") != "192.0.2.1" {
+		t.Errorf("expected static hint, got %s", form.Get("external_ip"))
+	}
+
+	turnService.SetExternalIPHintFunc(func() string {
+		return "2001:db8::1"
+	})
+	if form := fetch(); form.Get("external_ip") != "2001:db8::1" {
+		t.Errorf("expected hint from callback, got %s", form.Get("external_ip"))
+	}
+
+	turnService.SetExternalIPHint("")
+	if form := fetch(); form.Get("external_ip") != "" {
+		t.Errorf("hint must be removed, got %s", form.Get("external_ip"))
+	}
+}
+
+func TestTURNServiceWarnRelaysWithoutTransport(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: []*URNsWithID{
+		&URNsWithID{ID: "a", URNs: []string{"turn:relay.example.com:3478", "turn:relay.example.com:443?transport=tcp"}},
+	}})
+	defer server.Close()
+
+	logger := &testLogger{}
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetLogger(logger)
+	turnService.Open("token", "client", "")
+
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if messages := logger.Matching("without transport"); len(messages) != 0 {
+		t.Errorf("no warning must be logged by default, got %v", messages)
+	}
+
+	turnService.SetWarnRelaysWithoutTransport(true)
+	turnService.ForceExpireForTesting()
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if messages := logger.Matching("without transport"); len(messages) != 1 || !strings.Contains(messages[0], "turn:relay.example.com:3478") || strings.Contains(messages[0], "transport=tcp") {
+		t.Errorf("expected warning for relay without transport, got %v", messages)
+	}
+}
+
+func TestTURNServiceStaleWhileRevalidate(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 2, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	var requests int32
+	release := make(chan bool)
+	transport := http.DefaultTransport
+	turnService := NewTURNService(server.URL, WithExpirationPercentile(10))
+	defer turnService.Close()
+	turnService.SetHTTPClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&requests, 1) > 1 {
+				<-release
+			}
+			return transport.RoundTrip(r)
+		}),
+	})
+	turnService.SetStaleWhileRevalidate(time.Second)
+	turnService.Open("token", "client", "")
+
+	// Credentials expire after 200ms, their TTL passes after 2s.
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	waitFor(t, time.Second, turn.Expired)
+
+	server.SetTurn(&CredentialsData{TTL: 3600, Username: "refreshed", Password: "password", Servers: testServers})
+	if stale := turnService.Credentials(true); stale != turn {
+		t.Fatal("stale credentials must be returned while the refresh is in flight")
+	}
+	waitFor(t, time.Second, turnService.Refreshing)
+	if stale := turnService.Credentials(true); stale != turn {
+		t.Error("stale credentials must be returned while the refresh is in flight")
+	}
+
+	close(release)
+	waitFor(t, time.Second, func() bool {
+		refreshed := turnService.Credentials(false)
+		return refreshed != nil && refreshed.Turn.Username == "refreshed"
+	})
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("concurrent stale reads must share one refresh, got %d requests", n)
+	}
+}
+
+func TestTURNServiceStaleHardExpiry(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 2, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Now().Round(0)}
+	turnService := NewTURNService(server.URL, WithExpirationPercentile(10))
+	defer turnService.Close()
+	turnService.SetClock(clock)
+	turnService.SetStaleWhileRevalidate(time.Hour)
+	turnService.Open("token", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	waitFor(t, time.Second, turn.Expired)
+
+	server.SetStatus(http.StatusInternalServerError)
+	clock.Advance(3 * time.Second)
+	if stale := turnService.Credentials(true); stale != nil {
+		t.Error("credentials must not be served after their TTL has passed")
+	}
+	if stale := turnService.Credentials(false); stale != nil {
+		t.Error("credentials must not be served after their TTL has passed")
+	}
+}
+
+func TestTURNServiceFetchCredentialsContext(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := turnService.FetchCredentialsContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if turn, err := turnService.CredentialsContext(ctx, true); err == nil || turn != nil {
+		t.Errorf("cancelled fetch must fail, got %v, %v", turn, err)
+	}
+
+	turn, err := turnService.CredentialsContext(context.Background(), true)
+	if err != nil || turn == nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTURNServiceParentContext(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	release := make(chan struct{})
+	defer close(release)
+	server.Hold(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	turnService := NewTURNServiceContext(ctx, server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	turnService.Autorefresh(true)
+	waitFor(t, time.Second, turnService.Refreshing)
+
+	cancel()
+	// The pending fetch is cancelled instead of waiting for the response.
+	waitFor(t, time.Second, func() bool {
+		return !turnService.Refreshing()
+	})
+	if requests := server.Requests(); requests != 1 {
+		t.Errorf("expected one request, got %d", requests)
+	}
+	turnService.RLock()
+	closed := turnService.closed
+	turnService.RUnlock()
+	if !closed {
+		t.Error("service must be closed when the parent context is done")
+	}
+}
+
+func TestNewTURNServiceOptions(t *testing.T) {
+	client := &http.Client{}
+	turnService := NewTURNService("https://localhost",
+		WithTLSConfig(&tls.Config{InsecureSkipVerify: true}),
+		WithExpirationPercentile(50),
+		WithRefreshInterval(time.Second),
+		WithHTTPClient(client),
+		WithFetchTimeout(5*time.Second),
+		WithMaxCredentialsTTL(time.Hour),
+		WithUserAgent("test-agent"),
+	)
+	defer turnService.Close()
+
+	if !turnService.tlsConfig.InsecureSkipVerify || turnService.transport.TLSClientConfig != turnService.tlsConfig {
+		t.Error("TLS config must be used for the transport")
+	}
+	if turnService.expirationPercentile != 50 {
+		t.Errorf("unexpected expiration percentile: %d", turnService.expirationPercentile)
+	}
+	if turnService.refreshInterval != time.Second {
+		t.Errorf("unexpected refresh interval: %s", turnService.refreshInterval)
+	}
+	if turnService.customClient != client {
+		t.Error("HTTP client must be used")
+	}
+	if turnService.defaultFetchTimeout != 5*time.Second || turnService.maxCredentialsTTL != time.Hour || turnService.userAgent != "test-agent" {
+		t.Error("options must be applied")
+	}
+
+	defaults := NewTURNService("https://localhost")
+	defer defaults.Close()
+	if defaults.expirationPercentile != 80 || defaults.refreshInterval != defaultRefreshInterval || defaults.maxCredentialsTTL != DefaultMaxCredentialsTTL {
+		t.Error("defaults must be used without options")
+	}
+}
+
+func TestTURNServiceExpiryJitter(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 1000, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	// Without jitter, credentials expire after 800s.
+	expiries := make(map[time.Duration]bool)
+	for seed := int64(1); seed <= 5; seed++ {
+		turnService := NewTURNService(server.URL, WithRefreshJitter(0.1))
+		turnService.SetRandom(newDeterministicReader(seed))
+		turnService.Open("token", "client", "")
+		turn := turnService.Credentials(true)
+		if turn == nil {
+			t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+		}
+		if turn.expiry <= 720*time.Second || turn.expiry > 800*time.Second {
+			t.Errorf("seed %d: expiry %s out of range", seed, turn.expiry)
+		}
+		expiries[turn.expiry] = true
+		turnService.Close()
+	}
+	if len(expiries) != 5 {
+		t.Errorf("expiries must be distributed, got %v", expiries)
+	}
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if turn := turnService.Credentials(true); turn == nil || turn.expiry != 800*time.Second {
+		t.Errorf("disabled jitter must not change the expiry, got %v", turn)
+	}
+}
+
+func TestRecentNonces(t *testing.T) {
+	var nonces recentNonces
+	random := newDeterministicReader(1)
+	nonce, err := nonces.issue(random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nonces.consume(nonce) {
+		t.Error("issued nonce must be accepted")
+	}
+	if nonces.consume(nonce) {
+		t.Error("replayed nonce must be rejected")
+	}
+	if nonces.consume("unknown") {
+		t.Error("unknown nonce must be rejected")
+	}
+
+	// A source which repeats nonces is detected.
+	zeros := bytes.NewReader(make([]byte, 32*(maxNonceAttempts+1)))
+	if _, err := nonces.issue(zeros); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nonces.issue(zeros); err == nil {
+		t.Error("repeated nonce must fail")
+	}
+
+	for i := 0; i < maxRecentNonces+1; i++ {
+		if _, err := nonces.issue(random); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(nonces.answered) != maxRecentNonces || len(nonces.order) != maxRecentNonces {
+		t.Errorf("recent nonces must be limited, got %d", len(nonces.answered))
+	}
+}
+
+func BenchmarkFetchCredentials(b *testing.B) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+
+	var connections int64
+	server := httptest.NewUnstartedServer(turnServer.Config.Handler)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	bench := func(b *testing.B, newTransport bool) {
+		turnService := NewTURNService(server.URL, WithTLSConfig(&tls.Config{RootCAs: roots}))
+		defer turnService.Close()
+		turnService.Open("token", "client", "")
+		atomic.StoreInt64(&connections, 0)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var transport *http.Transport
+			if newTransport {
+				// Emulate a transport per request, without connection reuse.
+				transport = &http.Transport{TLSClientConfig: turnService.tlsConfig}
+				turnService.SetRoundTripper(transport)
+			}
+			if _, err := turnService.FetchCredentials(); err != nil {
+				b.Fatal(err)
+			}
+			if transport != nil {
+				transport.CloseIdleConnections()
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&connections))/float64(b.N), "handshakes/op")
+	}
+
+	b.Run("shared-transport", func(b *testing.B) {
+		bench(b, false)
+	})
+	b.Run("new-transport", func(b *testing.B) {
+		bench(b, true)
+	})
+}
+
+func TestTURNServiceConcurrentCredentials(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	release := make(chan struct{})
+	server.Hold(release)
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	const callers = 10
+	results := make(chan *CachedCredentialsData, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			results <- turnService.Credentials(true)
+		}()
+	}
+	waitForWaiters(t, turnService, callers-1)
+	close(release)
+
+	var first *CachedCredentialsData
+	for i := 0; i < callers; i++ {
+		turn := <-results
+		if turn == nil {
+			t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+		}
+		if first == nil {
+			first = turn
+		} else if turn != first {
+			t.Error("concurrent callers must share the result")
+		}
+	}
+	if requests := server.Requests(); requests != 1 {
+		t.Errorf("concurrent callers must share one fetch, got %d requests", requests)
+	}
+}
+
+func TestTURNServiceConcurrentCredentialsFailure(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+	server.SetStatus(http.StatusServiceUnavailable)
+	release := make(chan struct{})
+	server.Hold(release)
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	const callers = 10
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := turnService.CredentialsContext(context.Background(), true)
+			errs <- err
+		}()
+	}
+	waitForWaiters(t, turnService, callers-1)
+	close(release)
+
+	var first error
+	for i := 0; i < callers; i++ {
+		err := <-errs
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if first == nil {
+			first = err
+		} else if err != first {
+			t.Errorf("concurrent callers must share the error, got %v and %v", first, err)
+		}
+	}
+	if requests := server.Requests(); requests != 1 {
+		t.Errorf("concurrent callers must share one failed fetch, got %d requests", requests)
+	}
+}
+
+func TestTURNServiceCacheFile(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "turnservicecli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/credentials"
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	turnService := NewTURNService(server.URL)
+	if err := turnService.SetCacheFile(path, []byte("short")); err == nil {
+		t.Error("invalid key must be rejected")
+	}
+	if err := turnService.SetCacheFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	turnService.Open("token", "client", "")
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	turnService.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "password") {
+		t.Error("cache file must be encrypted")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("cache file must only be readable by the owner: %v", info.Mode())
+	}
+
+	// A restarted service uses the cached credentials without a fetch.
+	server.SetStatus(http.StatusInternalServerError)
+	restarted := NewTURNService(server.URL)
+	defer restarted.Close()
+	if err := restarted.SetCacheFile(path, key); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Open("token", "client", "")
+	turn := restarted.Credentials(false)
+	if turn == nil || turn.Turn.Username != "user" {
+		t.Fatalf("cached credentials must be restored, got %v", turn)
+	}
+	if ttl := turn.TTL(); ttl <= 3500 || ttl > 3600 {
+		t.Errorf("restored TTL must be the remaining TTL, got %d", ttl)
+	}
+	if requests := server.Requests(); requests != 1 {
+		t.Errorf("restored credentials must not be fetched, got %d requests", requests)
+	}
+
+	// A different key can not decrypt the cache file.
+	other := NewTURNService(server.URL)
+	defer other.Close()
+	if err := other.SetCacheFile(path, []byte("fedcba9876543210fedcba9876543210")); err != nil {
+		t.Fatal(err)
+	}
+	other.Open("token", "client", "")
+	if turn := other.Credentials(false); turn != nil {
+		t.Error("cache file must not be decrypted with a different key")
+	}
+}
+
+func TestTURNServiceCredentialStore(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	store := NewMemoryCredentialStore()
+	newService := func() *TURNService {
+		turnService := NewTURNService(server.URL)
+		turnService.SetCredentialStore(store)
+		turnService.Open("token", "client", "")
+		return turnService
+	}
+
+	first := newService()
+	defer first.Close()
+	turn := first.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", first.LastError())
+	}
+	stored, err := store.Get(first.storeKey())
+	if err != nil || stored == nil || stored.Turn != turn.Turn {
+		t.Fatalf("fetched credentials must be stored, got %v %v", stored, err)
+	}
+	if !stored.Refresh.Before(stored.Expires) {
+		t.Errorf("refresh %s must be before expiry %s", stored.Refresh, stored.Expires)
+	}
+
+	// Another service sharing the store uses the stored credentials.
+	second := newService()
+	defer second.Close()
+	turn2 := second.Credentials(true)
+	if turn2 == nil || turn2.Turn.Username != "user" {
+		t.Fatalf("stored credentials must be used, got %v", turn2)
+	}
+	if requests := server.Requests(); requests != 1 {
+		t.Errorf("stored credentials must not be fetched, got %d requests", requests)
+	}
+	if d := turn2.expiry - turn.expiry; d > time.Second || d < -time.Second {
+		t.Errorf("stored credentials must keep their refresh time, got %s and %s", turn.expiry, turn2.expiry)
+	}
+
+	// Expired credentials are deleted from the store.
+	second.ForceExpireForTesting()
+	if stored, _ := store.Get(second.storeKey()); stored != nil {
+		t.Error("expired credentials must be deleted from the store")
+	}
+	if turn3 := second.Credentials(true); turn3 == nil || turn3 == turn2 {
+		t.Errorf("expired credentials must be fetched, got %v", turn3)
+	}
+	if requests := server.Requests(); requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+// countingCredentialStore counts the calls of Get.
+type countingCredentialStore struct {
+	CredentialStore
+	gets int32
+}
+
+func (s *countingCredentialStore) Get(key string) (*StoredCredentials, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.CredentialStore.Get(key)
+}
+
+func TestTURNServiceCredentialStoreRestore(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	store := &countingCredentialStore{CredentialStore: NewMemoryCredentialStore()}
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.SetCredentialStore(store)
+	turnService.Open("token", "client", "")
+	if gets := atomic.LoadInt32(&store.gets); gets != 1 {
+		t.Errorf("Open must restore once, got %d reads", gets)
+	}
+	for i := 0; i < 3; i++ {
+		if turn := turnService.Credentials(false); turn != nil {
+			t.Fatalf("no credentials must be returned, got %v", turn)
+		}
+	}
+	if gets := atomic.LoadInt32(&store.gets); gets != 1 {
+		t.Errorf("credentials must not be restored on every call, got %d reads", gets)
+	}
+
+	// Another user of the store fetches credentials, they are used when the
+	// fetch fails.
+	other := NewTURNService(server.URL)
+	defer other.Close()
+	other.SetCredentialStore(store)
+	other.Open("token", "client", "")
+	stored := other.Credentials(true)
+	if stored == nil {
+		t.Fatalf("turn data must not be nil: %s", other.LastError())
+	}
+	server.SetStatus(http.StatusServiceUnavailable)
+	turn, err := turnService.CredentialsContext(context.Background(), true)
+	if err != nil || turn == nil || turn.Turn.Username != stored.Turn.Username {
+		t.Fatalf("stored credentials must be used after a failed fetch, got %v %v", turn, err)
+	}
+	if turnService.LastError() == nil {
+		t.Error("the failed fetch must be recorded")
+	}
+}
+
+func TestTURNServiceMetrics(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	if metrics := turnService.Metrics(); metrics.FetchAttempts != 0 || metrics.CredentialsTTL != 0 {
+		t.Errorf("unexpected initial metrics: %+v", metrics)
+	}
+
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	server.SetStatus(http.StatusInternalServerError)
+	if _, err := turnService.FetchCredentials(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	metrics := turnService.Metrics()
+	if metrics.FetchAttempts != 2 || metrics.FetchFailures != 1 {
+		t.Errorf("expected 2 attempts and 1 failure, got %d and %d", metrics.FetchAttempts, metrics.FetchFailures)
+	}
+	if metrics.FetchLatencyCount != 2 || metrics.FetchLatencyBuckets[30] != 2 || metrics.FetchLatencySum <= 0 {
+		t.Errorf("unexpected latency histogram: %+v", metrics)
+	}
+	if metrics.CredentialsTTL <= 3500*time.Second || metrics.CredentialsTTL > 3600*time.Second {
+		t.Errorf("unexpected credentials TTL: %s", metrics.CredentialsTTL)
+	}
+}
+
+type testSpanKey struct{}
+
+type testSpan struct {
+	tracer     *testTracer
+	name       string
+	attributes map[string]string
+	err        error
+}
+
+func (s *testSpan) End(err error) {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.err = err
+	s.tracer.ended = append(s.tracer.ended, s)
+}
+
+type testTracer struct {
+	sync.Mutex
+
+	ended []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attributes map[string]string) (context.Context, Span) {
+	span := &testSpan{tracer: t, name: name, attributes: attributes}
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func (t *testTracer) Ended() []*testSpan {
+	t.Lock()
+	defer t.Unlock()
+	return append([]*testSpan(nil), t.ended...)
+}
+
+func TestTURNServiceTracer(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	tracer := &testTracer{}
+	var propagated []string
+	transport := http.DefaultTransport
+	turnService := NewTURNService(server.URL, WithTracer(tracer), WithRoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if span, ok := r.Context().Value(testSpanKey{}).(*testSpan); ok {
+			propagated = append(propagated, span.name)
+		}
+		return transport.RoundTrip(r)
+	})))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := turnService.FetchGeo(); !errors.Is(err, ErrUnsuccessful) {
+		t.Errorf("expected unsuccessful geo, got %v", err)
+	}
+
+	var names []string
+	for _, span := range tracer.Ended() {
+		names = append(names, span.name)
+	}
+	expected := "turnservicecli.request,turnservicecli.FetchCredentials,turnservicecli.request,turnservicecli.FetchGeo"
+	if strings.Join(names, ",") != expected {
+		t.Errorf("expected spans %s, got %s", expected, strings.Join(names, ","))
+	}
+	ended := tracer.Ended()
+	if ended[0].attributes["endpoint"] != "credentials" || ended[1].attributes["fetch_id"] != "1" {
+		t.Errorf("unexpected attributes: %v %v", ended[0].attributes, ended[1].attributes)
+	}
+	if ended[1].err != nil || !errors.Is(ended[3].err, ErrUnsuccessful) {
+		t.Errorf("spans must end with the error of the operation: %v %v", ended[1].err, ended[3].err)
+	}
+	if strings.Join(propagated, ",") != "turnservicecli.request,turnservicecli.request" {
+		t.Errorf("span context must be propagated to the request, got %v", propagated)
+	}
+}
+
+type testPropagatingTracer struct {
+	testTracer
+}
+
+func (t *testPropagatingTracer) Inject(ctx context.Context, header http.Header) {
+	if span, ok := ctx.Value(testSpanKey{}).(*testSpan); ok {
+		header.Set("X-Test-Span", span.name)
+	}
+}
+
+func TestTURNServicePropagatingTracer(t *testing.T) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	var lock sync.Mutex
+	var propagated []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		propagated = append(propagated, r.Header.Get("X-Test-Span"))
+		lock.Unlock()
+		if r.Method == "GET" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"username":"user","password":"password","ttl":3600,"uris":["turn:turn.example.com"]}`)
+			return
+		}
+		turnServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL, WithTracer(&testPropagatingTracer{}))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	turnService.SetProvider(&RESTProvider{})
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(propagated, ",") != "turnservicecli.request,turnservicecli.request" {
+		t.Errorf("trace context must be injected into requests, got %v", propagated)
+	}
+}
+
+func TestTURNServiceBestServers(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: []*URNsWithID{
+		{ID: "a", Prio: 2, URNs: []string{"turn:a.example.com"}},
+		{ID: "b", Prio: 1, URNs: []string{"turn:b1.example.com", "turn:b2.example.com"}},
+		{ID: "c", URNs: []string{"turn:c.example.com"}},
+	}})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+
+	if servers := turnService.BestServers(0); servers != nil {
+		t.Errorf("expected no servers without credentials, got %v", servers)
+	}
+
+	probed := make(chan *CredentialsData, 10)
+	var lock sync.Mutex
+	var probeCtx context.Context
+	turnService.SetLatencyProbing(func(ctx context.Context, data *CredentialsData) map[string]time.Duration {
+		lock.Lock()
+		probeCtx = ctx
+		lock.Unlock()
+		probed <- data
+		return map[string]time.Duration{
+			"turn:b2.example.com": 10 * time.Millisecond,
+			"turn:c.example.com":  20 * time.Millisecond,
+		}
+	}, 10*time.Millisecond)
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	// Wait for two measurements, the first may not be stored yet.
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-probed:
+			if data != turn.Turn {
+				t.Errorf("cached credentials must be probed, got %v", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("servers must be probed")
+		}
+	}
+
+	var ids []string
+	for _, server := range turnService.BestServers(0) {
+		ids = append(ids, server.ID)
+	}
+	if result := strings.Join(ids, ","); result != "b,c,a" {
+		t.Errorf("expected b,c,a, got %s", result)
+	}
+	if servers := turnService.BestServers(1); len(servers) != 1 || servers[0].ID != "b" {
+		t.Errorf("expected best server b, got %v", servers)
+	}
+
+	// Disabling probing keeps the default order.
+	turnService.SetLatencyProbing(nil, 0)
+	ids = nil
+	for _, server := range turnService.BestServers(2) {
+		ids = append(ids, server.ID)
+	}
+	if result := strings.Join(ids, ","); result != "a,b" {
+		t.Errorf("expected a,b, got %s", result)
+	}
+	// The context of the measurements is cancelled.
+	lock.Lock()
+	ctx := probeCtx
+	lock.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("probing must stop when disabled")
+	}
+}
+
+func TestTURNServiceRESTProvider(t *testing.T) {
+	var queries []url.Values
+	var lock sync.Mutex
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		queries = append(queries, r.URL.Query())
+		s := status
+		lock.Unlock()
+		if r.Method != "GET" {
+			t.Errorf("expected GET request, got %s", r.Method)
+		}
+		if s != http.StatusOK {
+			http.Error(w, http.StatusText(s), s)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"username":"12334939:client","password":"adfsaflsjfldssia","ttl":86400,"uris":["turn:1.2.3.4:9991?transport=udp","turn:1.2.3.4:9992?transport=tcp"]}`)
+	}))
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL+"/turn?realm=example.com", WithProvider(&RESTProvider{}))
+	defer turnService.Close()
+	turnService.Open("api-key", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if turn.Turn.Username != "12334939:client" || turn.Turn.Password != "adfsaflsjfldssia" || turn.Turn.TTL != 86400 {
+		t.Errorf("unexpected credentials %+v", turn.Turn)
+	}
+	if len(turn.Turn.Servers) != 1 || turn.Turn.Servers[0].ID != "default" || len(turn.Turn.Servers[0].URNs) != 2 {
+		t.Errorf("unexpected servers %+v", turn.Turn.Servers)
+	}
+	if turnService.Credentials(true) != turn {
+		t.Error("credentials must be cached")
+	}
+
+	lock.Lock()
+	if len(queries) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(queries))
+	}
+	query := queries[0]
+	lock.Unlock()
+	if query.Get("service") != "turn" || query.Get("username") != "client" || query.Get("key") != "api-key" || query.Get("realm") != "example.com" {
+		t.Errorf("unexpected query %v", query)
+	}
+
+	turnService.SetProvider(&RESTProvider{Username: "user", Key: "key"})
+	lock.Lock()
+	status = http.StatusInternalServerError
+	lock.Unlock()
+	_, err := turnService.FetchCredentials()
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status error, got %v", err)
+	}
+	lock.Lock()
+	if query := queries[len(queries)-1]; query.Get("username") != "user" || query.Get("key") != "key" {
+		t.Errorf("unexpected query %v", query)
+	}
+	lock.Unlock()
+}
+
+func TestTURNServiceSecretProvider(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	provider := &SecretProvider{
+		Secret:  "secret",
+		Servers: testServers,
+		TTL:     time.Hour,
+		Clock:   clock,
+	}
+	turnService := NewTURNService("", WithProvider(provider))
+	defer turnService.Close()
+	turnService.Open("", "client", "")
+
+	turn := turnService.Credentials(true)
+	if turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if turn.Turn.Username != "1600003600:client" || turn.Turn.TTL != 3600 {
+		t.Errorf("unexpected credentials %+v", turn.Turn)
+	}
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte("1600003600:client"))
+	if expected := base64.StdEncoding.EncodeToString(mac.Sum(nil)); turn.Turn.Password != expected {
+		t.Errorf("expected password %s, got %s", expected, turn.Turn.Password)
+	}
+	if len(turn.Turn.Servers) != len(testServers) || turn.Turn.Servers[0] == testServers[0] {
+		t.Error("servers must be copied")
+	}
+
+	provider.Hash = sha256.New
+	response, err := turnService.FetchCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := base64.StdEncoding.DecodeString(response.Turn.Password); len(decoded) != sha256.Size {
+		t.Errorf("expected SHA-256 HMAC, got %s", response.Turn.Password)
+	}
+
+	provider.Secret = ""
+	if _, err := turnService.FetchCredentials(); err == nil {
+		t.Error("missing secret must fail")
+	}
+}
+
+func TestTURNServiceSessions(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if session := turnService.Session(); session != "" {
+		t.Errorf("expected no session, got %s", session)
+	}
+
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if session := turnService.Session(); session != "test-session" {
+		t.Errorf("expected test-session, got %s", session)
+	}
+	sessions := turnService.Sessions()
+	if len(sessions) != 1 || sessions[server.URL] != "test-session" {
+		t.Errorf("unexpected sessions %v", sessions)
+	}
+
+	turnService.ResetSession()
+	if session := turnService.Session(); session != "" {
+		t.Errorf("expected no session after reset, got %s", session)
+	}
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if s := server.Sessions(); s[len(s)-1] != "" {
+		t.Errorf("reset session must not be sent, got %s", s[len(s)-1])
+	}
+
+	// Restore in a new TURNService.
+	restored := NewTURNService(server.URL)
+	defer restored.Close()
+	restored.Open("token", "client", "")
+	restored.SetSessions(sessions)
+	if session := restored.Session(); session != "test-session" {
+		t.Errorf("expected restored session, got %s", session)
+	}
+	if _, err := restored.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if s := server.Sessions(); s[len(s)-1] != "test-session" {
+		t.Errorf("restored session must be sent, got %s", s[len(s)-1])
+	}
+}
+
+// writeTestCertificate writes a self-signed client certificate with serial
+// to certFile and its key to keyFile.
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestTURNServiceClientCertificateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "turnservicecli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := dir+"/client.crt", dir+"/client.key"
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	var lock sync.Mutex
+	var serials []int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		serials = append(serials, r.TLS.PeerCertificates[0].SerialNumber.Int64())
+		lock.Unlock()
+		turnServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	turnService := NewTURNService(server.URL, WithTLSConfig(&tls.Config{RootCAs: roots}), WithClientCertificateFiles(certFile, keyFile))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate the certificate, new connections present it.
+	writeTestCertificate(t, certFile, keyFile, 2)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	turnService.transport.CloseIdleConnections()
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unreadable files keep the previous certificate.
+	os.Remove(keyFile)
+	turnService.transport.CloseIdleConnections()
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(serials) != 3 || serials[0] != 1 || serials[1] != 2 || serials[2] != 2 {
+		t.Errorf("expected client certificates 1, 2, 2, got %v", serials)
+	}
+
+	missing := NewTURNService(server.URL, WithTLSConfig(&tls.Config{RootCAs: roots}), WithClientCertificateFiles(keyFile, keyFile))
+	defer missing.Close()
+	missing.Open("token", "client", "")
+	if _, err := missing.FetchCredentials(); err == nil || !strings.Contains(err.Error(), "failed to load client certificate") {
+		t.Errorf("expected error loading the client certificate, got %v", err)
+	}
+}
+
+func TestTURNServicePinnedPublicKeys(t *testing.T) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	server := httptest.NewUnstartedServer(turnServer.Config.Handler)
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	pin := PublicKeyPin(server.Certificate())
+
+	turnService := NewTURNService(server.URL, WithTLSConfig(&tls.Config{RootCAs: roots}), WithPinnedPublicKeys("other", "sha256/"+pin))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatalf("pinned key must be accepted: %s", err)
+	}
+
+	pinned := NewTURNService(server.URL, WithTLSConfig(&tls.Config{RootCAs: roots}), WithPinnedPublicKeys("other"))
+	defer pinned.Close()
+	pinned.Open("token", "client", "")
+	_, err := pinned.FetchCredentials()
+	var pinningErr *PinningError
+	if !errors.As(err, &pinningErr) || !errors.Is(err, ErrPinMismatch) {
+		t.Fatalf("expected pinning error, got %v", err)
+	}
+	if len(pinningErr.Pins) != 1 || pinningErr.Pins[0] != pin {
+		t.Errorf("expected presented pin %s, got %v", pin, pinningErr.Pins)
+	}
+	if requests := turnServer.Requests(); requests != 1 {
+		t.Errorf("pinning failure must not send the request, got %d requests", requests)
+	}
+}
+
+func TestTURNServicePinnedPublicKeyAppended(t *testing.T) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	create := func(template, parent *x509.Certificate, key, signer *ecdsa.PrivateKey) *x509.Certificate {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(cryptorand.Reader, template, parent, &key.PublicKey, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	caKey, leafKey, pinnedKey := newKey(), newKey(), newKey()
+	caTemplate := &x509.Certificate{SerialNumber: big.NewInt(1), IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	ca := create(caTemplate, caTemplate, caKey, caKey)
+	leaf := create(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, leafKey, caKey)
+	pinnedTemplate := &x509.Certificate{SerialNumber: big.NewInt(3)}
+	pinned := create(pinnedTemplate, pinnedTemplate, pinnedKey, pinnedKey)
+
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	server := httptest.NewUnstartedServer(turnServer.Config.Handler)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Raw, pinned.Raw},
+		PrivateKey:  leafKey,
+	}}}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	turnService := NewTURNService(server.URL, WithTLSConfig(&tls.Config{RootCAs: roots}), WithPinnedPublicKeys(PublicKeyPin(pinned)))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	_, err := turnService.FetchCredentials()
+	var pinningErr *PinningError
+	if !errors.As(err, &pinningErr) {
+		t.Fatalf("appended pinned certificate must not be accepted, got %v", err)
+	}
+	for _, pin := range pinningErr.Pins {
+		if pin == PublicKeyPin(pinned) {
+			t.Errorf("unverified certificate must not be matched, got %v", pinningErr.Pins)
+		}
+	}
+}
+
+func TestTURNServiceRootCAs(t *testing.T) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	server := httptest.NewUnstartedServer(turnServer.Config.Handler)
+	server.StartTLS()
+	defer server.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	turnService := NewTURNService(server.URL, WithRootCAs(serverCA))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "turnservicecli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := dir + "/ca.pem"
+	otherCA := writeTestCertificate(t, dir+"/other.crt", dir+"/other.key", 1)
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCA.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := NewTURNService(server.URL, WithRootCAFile(caFile))
+	defer bundle.Close()
+	bundle.Open("token", "client", "")
+	if _, err := bundle.FetchCredentials(); err == nil {
+		t.Fatal("expected certificate error with untrusted CA")
+	}
+
+	// Updating the bundle trusts the new CA.
+	if err := ioutil.WriteFile(caFile, serverCA, 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(caFile, future, future)
+	if _, err := bundle.FetchCredentials(); err != nil {
+		t.Fatalf("updated CA bundle must be used: %s", err)
+	}
+
+	missing := NewTURNService(server.URL, WithRootCAFile(dir+"/missing.pem"))
+	defer missing.Close()
+	missing.Open("token", "client", "")
+	if _, err := missing.FetchCredentials(); err == nil {
+		t.Error("expected certificate error without CA bundle")
+	}
+}
+
+func TestTURNServiceHTTPProxy(t *testing.T) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "turnservice.example.com" {
+			http.Error(w, "unexpected host", http.StatusBadGateway)
+			return
+		}
+		atomic.AddInt32(&proxied, 1)
+		turnServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	turnService := NewTURNService("http://turnservice.example.com", WithProxy(proxyURL))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&proxied); n != 1 {
+		t.Errorf("expected 1 proxied request, got %d", n)
+	}
+
+	direct := NewTURNService(turnServer.URL, WithProxy(nil))
+	defer direct.Close()
+	direct.Open("token", "client", "")
+	if _, err := direct.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&proxied); n != 1 {
+		t.Errorf("direct request must not be proxied, got %d proxied requests", n)
+	}
+}
+
+// serveTestSOCKS5 performs the handshake of a SOCKS5 connection
+// authenticated with username and password and returns the requested
+// address.
+func serveTestSOCKS5(conn net.Conn, username, password string) (string, error) {
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(conn, buf)
+		return buf, err
+	}
+	b, err := read(2)
+	if err == nil {
+		_, err = read(int(b[1]))
+	}
+	if err != nil {
+		return "", err
+	}
+	conn.Write([]byte{5, 2})
+	var user, pass []byte
+	if b, err = read(2); err == nil {
+		if user, err = read(int(b[1])); err == nil {
+			if b, err = read(1); err == nil {
+				pass, err = read(int(b[0]))
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if string(user) != username || string(pass) != password {
+		conn.Write([]byte{1, 1})
+		return "", errors.New("authentication failed")
+	}
+	conn.Write([]byte{1, 0})
+	if b, err = read(5); err != nil || b[3] != 3 {
+		return "", fmt.Errorf("unexpected request %v: %v", b, err)
+	}
+	host, err := read(int(b[4]) + 2)
+	if err != nil {
+		return "", err
+	}
+	port := int(host[len(host)-2])<<8 | int(host[len(host)-1])
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(string(host[:len(host)-2]), fmt.Sprint(port)), nil
+}
+
+func TestTURNServiceSOCKS5Proxy(t *testing.T) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addresses := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				address, err := serveTestSOCKS5(conn, "proxyuser", "proxypass")
+				if err != nil {
+					addresses <- err.Error()
+					return
+				}
+				addresses <- address
+				// Connect all requests to the test server.
+				target, err := net.Dial("tcp", turnServer.Listener.Addr().String())
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	turnService := NewTURNService("http://turnservice.example.com", WithSOCKS5Proxy(listener.Addr().String(), "proxyuser", "proxypass"))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if address := <-addresses; address != "turnservice.example.com:80" {
+		t.Errorf("expected proxied address turnservice.example.com:80, got %s", address)
+	}
+
+	wrongAuth := NewTURNService("http://turnservice.example.com", WithSOCKS5Proxy(listener.Addr().String(), "proxyuser", "wrong"))
+	defer wrongAuth.Close()
+	wrongAuth.Open("token", "client", "")
+	if _, err := wrongAuth.FetchCredentials(); err == nil {
+		t.Error("expected error with wrong proxy credentials")
+	}
+	if address := <-addresses; address != "authentication failed" {
+		t.Errorf("expected authentication failure, got %s", address)
+	}
+}
+
+func TestTURNServiceUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "turnservicecli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := dir + "/turnservice.sock"
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets not supported: %s", err)
+	}
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	var host atomic.Value
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		turnServer.Config.Handler.ServeHTTP(w, r)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	turnService := NewTURNService("http://localhost", WithUnixSocket(socket))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	credentials, err := turnService.FetchCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.Turn.Username != "user" {
+		t.Errorf("expected credentials of the test server, got %+v", credentials.Turn)
+	}
+	if h, _ := host.Load().(string); h != "localhost" {
+		t.Errorf("expected Host localhost, got %q", h)
+	}
+}
+
+func TestTURNServiceHTTP3Fallback(t *testing.T) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	var attempts int32
+	blocked := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		ioutil.ReadAll(r.Body)
+		return nil, errors.New("no recent network activity")
+	})
+
+	turnService := NewTURNService(turnServer.URL, WithHTTP3(blocked))
+	defer turnService.Close()
+	turnService.Open("token", "client", "")
+	for i := 0; i < 2; i++ {
+		if _, err := turnService.FetchCredentials(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("expected 1 HTTP/3 attempt before falling back, got %d", n)
+	}
+	if requests := turnServer.Requests(); requests != 2 {
+		t.Errorf("expected 2 requests with the fallback transport, got %d", requests)
+	}
+
+	// HTTP/3 is tried again after the retry interval.
+	fallback := turnService.client.Transport.(*fallbackRoundTripper)
+	fallback.Lock()
+	fallback.failed = time.Now().Add(-http3RetryInterval)
+	fallback.Unlock()
+	if _, err := turnService.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("expected HTTP/3 to be tried again, got %d attempts", n)
+	}
+
+	var sent int32
+	quic := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&sent, 1)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	http3 := NewTURNService(turnServer.URL, WithHTTP3(quic))
+	defer http3.Close()
+	http3.Open("token", "client", "")
+	if _, err := http3.FetchCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&sent); n != 1 {
+		t.Errorf("expected request sent with HTTP/3, got %d", n)
+	}
+}
+
+func TestTURNServiceTimeouts(t *testing.T) {
+	turnServer := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer turnServer.Close()
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Stall") == "body" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("{"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer stalled.Close()
+	defer close(release)
+
+	headers := NewTURNService(stalled.URL, WithResponseHeaderTimeout(100*time.Millisecond))
+	defer headers.Close()
+	headers.Open("token", "client", "")
+	start := time.Now()
+	if _, err := headers.FetchCredentials(); err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Errorf("expected response header timeout, got %v", err)
+	}
+
+	body := NewTURNService(stalled.URL, WithRequestTimeout(200*time.Millisecond))
+	defer body.Close()
+	body.Open("token", "client", "")
+	body.SetHeader("X-Stall", "body")
+	if _, err := body.FetchCredentials(); err == nil {
+		t.Error("expected request timeout with stalled body")
+	}
+
+	connect := NewTURNService(turnServer.URL, WithConnectTimeout(100*time.Millisecond), WithDialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}))
+	defer connect.Close()
+	connect.Open("token", "client", "")
+	if _, err := connect.FetchCredentials(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected connect timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timeouts took %s", elapsed)
+	}
+
+	if turnService := NewTURNService(turnServer.URL); turnService.client.Timeout != defaultRequestTimeout || turnService.transport.ResponseHeaderTimeout != defaultResponseHeaderTimeout {
+		t.Errorf("expected default timeouts, got %s and %s", turnService.client.Timeout, turnService.transport.ResponseHeaderTimeout)
+	}
+	if turnService := NewTURNService(turnServer.URL, WithRequestTimeout(-1)); turnService.client.Timeout != 0 {
+		t.Errorf("negative timeout must disable the timeout, got %s", turnService.client.Timeout)
+	}
+}
+
+func TestTURNServiceCredentialStoreIdentity(t *testing.T) {
+	server := NewTestServer(&CredentialsData{TTL: 3600, Username: "user", Password: "password", Servers: testServers})
+	defer server.Close()
+
+	turnService := NewTURNService(server.URL)
+	defer turnService.Close()
+	turnService.Open("token1", "", "")
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	turnService.Close()
+	turnService.Open("token2", "", "")
+	if turn := turnService.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", turnService.LastError())
+	}
+	if requests := server.Requests(); requests != 2 {
+		t.Errorf("credentials must be fetched again after Close and Open, got %d requests", requests)
+	}
+
+	// Shared stores are keyed by the access token and session.
+	store := NewMemoryCredentialStore()
+	first := NewTURNService(server.URL)
+	defer first.Close()
+	first.SetCredentialStore(store)
+	first.Open("token1", "client", "")
+	if turn := first.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", first.LastError())
+	}
+	second := NewTURNService(server.URL)
+	defer second.Close()
+	second.SetCredentialStore(store)
+	second.Open("token2", "client", "")
+	if turn := second.Credentials(true); turn == nil {
+		t.Fatalf("turn data must not be nil: %s", second.LastError())
+	}
+	if requests := server.Requests(); requests != 4 {
+		t.Errorf("credentials of another access token must not be restored, got %d requests", requests)
+	}
+}
@@ -0,0 +1,112 @@
+package turnservicecli
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URN schemes as defined in RFC 7064 and RFC 7065.
+const (
+	schemeSTUN  = "stun"
+	schemeSTUNS = "stuns"
+	schemeTURN  = "turn"
+	schemeTURNS = "turns"
+)
+
+// Default ports of URN schemes as defined in RFC 7064 and RFC 7065.
+var defaultURNPorts = map[string]int{
+	schemeSTUN:  3478,
+	schemeSTUNS: 5349,
+	schemeTURN:  3478,
+	schemeTURNS: 5349,
+}
+
+// Transports of TURN URNs as defined in RFC 7065.
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+)
+
+// Default order of preferred transports, see LimitURNsPerServer.
+var defaultTransportOrder = []string{TransportUDP, TransportTCP}
+
+// urnScheme returns the lower case scheme of urn, or an empty string if urn
+// has no scheme.
+func urnScheme(urn string) string {
+	idx := strings.Index(urn, ":")
+	if idx == -1 {
+		return ""
+	}
+	return strings.ToLower(urn[:idx])
+}
+
+// isRelayURN returns if urn refers to a TURN relay.
+func isRelayURN(urn string) bool {
+	switch urnScheme(urn) {
+	case schemeTURN, schemeTURNS:
+		return true
+	}
+	return false
+}
+
+// urnTransport returns the lower case transport of urn. If urn has no
+// transport parameter, the default transport of its scheme is returned.
+func urnTransport(urn string) string {
+	if transport := urnParameter(urn, "transport"); transport != "" {
+		return strings.ToLower(transport)
+	}
+	switch urnScheme(urn) {
+	case schemeSTUNS, schemeTURNS:
+		return TransportTCP
+	}
+	return TransportUDP
+}
+
+// urnParameter returns the value of the query parameter key of urn.
+func urnParameter(urn, key string) string {
+	idx := strings.Index(urn, "?")
+	if idx == -1 {
+		return ""
+	}
+	query, err := url.ParseQuery(urn[idx+1:])
+	if err != nil {
+		return ""
+	}
+	return query.Get(key)
+}
+
+// urnHostPort returns the host and the port of urn. The port is empty if urn
+// has no explicit port.
+func urnHostPort(urn string) (host, port string) {
+	hostport := urn
+	if idx := strings.Index(hostport, ":"); idx != -1 {
+		hostport = hostport[idx+1:]
+	}
+	if idx := strings.Index(hostport, "?"); idx != -1 {
+		hostport = hostport[:idx]
+	}
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
+	}
+	// No port, strip brackets of IPv6 addresses.
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), ""
+}
+
+// urnWithDefaultPort returns urn with port added if it has no explicit port.
+func urnWithDefaultPort(urn string, port int) string {
+	idx := strings.Index(urn, ":")
+	if idx == -1 {
+		return urn
+	}
+	host, p := urnHostPort(urn)
+	if p != "" || host == "" {
+		return urn
+	}
+	var query string
+	if idx := strings.Index(urn, "?"); idx != -1 {
+		query = urn[idx:]
+	}
+	return urn[:idx+1] + net.JoinHostPort(host, strconv.Itoa(port)) + query
+}
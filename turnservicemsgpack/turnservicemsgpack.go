@@ -0,0 +1,39 @@
+//go:build msgpack
+// +build msgpack
+
+/*
+Package turnservicemsgpack provides a turnservicecli.ResponseCodec for
+responses of the remote service encoded as msgpack.
+
+The package depends on github.com/vmihailenco/msgpack and is only built with
+the msgpack build tag, so the turnservicecli package stays free of
+dependencies.
+*/
+package turnservicemsgpack
+
+import (
+	"io"
+
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ContentType is the media type of msgpack responses.
+const ContentType = "application/msgpack"
+
+type codec struct{}
+
+func (c codec) ContentType() string {
+	return ContentType
+}
+
+func (c codec) Decode(r io.Reader, v interface{}) error {
+	decoder := msgpack.NewDecoder(r)
+	// Use the field names of the JSON encoding.
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
+
+// Codec is the ResponseCodec for msgpack responses, the fields are named as
+// in JSON responses. Set it with TURNService.SetResponseCodec.
+var Codec turnservicecli.ResponseCodec = codec{}
@@ -0,0 +1,61 @@
+//go:build msgpack
+// +build msgpack
+
+package turnservicemsgpack
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestCodec(t *testing.T) {
+	turnServer := turnservicecli.NewTestServer(&turnservicecli.CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "test", URNs: []string{"turn:turn.example.com:3478?transport=udp"}},
+		},
+	})
+	defer turnServer.Close()
+	// Re-encode the JSON responses of the test server as msgpack if they are
+	// accepted.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != ContentType {
+			http.Error(w, "not acceptable", http.StatusNotAcceptable)
+			return
+		}
+		recorder := httptest.NewRecorder()
+		turnServer.Config.Handler.ServeHTTP(recorder, r)
+		var response turnservicecli.CredentialsResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		encoder := msgpack.NewEncoder(w)
+		encoder.SetCustomStructTag("json")
+		if err := encoder.Encode(&response); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	service := turnservicecli.NewTURNService(server.URL)
+	defer service.Close()
+	service.SetResponseCodec(Codec)
+	service.Open("token", "client", "")
+
+	response, err := service.FetchCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turn := response.Turn; turn == nil || turn.Username != "user" || turn.Password != "password" || len(turn.Servers) != 1 {
+		t.Errorf("unexpected credentials: %+v", turn)
+	}
+}
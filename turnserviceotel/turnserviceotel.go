@@ -0,0 +1,73 @@
+//go:build otel
+// +build otel
+
+/*
+Package turnserviceotel traces the requests of a TURNService of the
+turnservicecli package with OpenTelemetry.
+
+The package depends on go.opentelemetry.io/otel and is only built with the
+otel build tag, so the turnservicecli package stays free of dependencies.
+*/
+package turnserviceotel
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer is a turnservicecli.PropagatingTracer backed by an OpenTelemetry
+// trace.Tracer, set it with turnservicecli.WithTracer.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer returns a Tracer starting spans with tracer and propagating their
+// context to the remote service with propagator. A nil propagator uses the
+// global propagator of otel.GetTextMapPropagator.
+func NewTracer(tracer trace.Tracer, propagator propagation.TextMapPropagator) *Tracer {
+	return &Tracer{
+		tracer:     tracer,
+		propagator: propagator,
+	}
+}
+
+// Start implements turnservicecli.Tracer, attributes become string
+// attributes of the span.
+func (t *Tracer) Start(ctx context.Context, name string, attributes map[string]string) (context.Context, turnservicecli.Span) {
+	kvs := make([]attribute.KeyValue, 0, len(attributes))
+	for k, v := range attributes {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(kvs...))
+	return ctx, &otelSpan{span}
+}
+
+// Inject implements turnservicecli.PropagatingTracer.
+func (t *Tracer) Inject(ctx context.Context, header http.Header) {
+	propagator := t.propagator
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// otelSpan is a turnservicecli.Span of an OpenTelemetry span.
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s *otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,60 @@
+//go:build otel
+// +build otel
+
+package turnserviceotel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTracer(t *testing.T) {
+	turnServer := turnservicecli.NewTestServer(&turnservicecli.CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "test", URNs: []string{"turn:turn.example.com:3478?transport=udp"}},
+		},
+	})
+	defer turnServer.Close()
+	var lock sync.Mutex
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		traceparent = r.Header.Get("traceparent")
+		lock.Unlock()
+		turnServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(noop.NewTracerProvider().Tracer("test"), propagation.TraceContext{})
+	service := turnservicecli.NewTURNService(server.URL, turnservicecli.WithTracer(tracer))
+	defer service.Close()
+	service.Open("token", "client", "")
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		SpanID:     trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), parent)
+	if _, err := service.FetchCredentialsContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !strings.HasPrefix(traceparent, "00-"+parent.TraceID().String()+"-") {
+		t.Errorf("trace context must be propagated, got traceparent %q", traceparent)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build pion
+// +build pion
+
+/*
+Package turnservicepion converts credentials of the turnservicecli package
+into ICE servers of pion/webrtc.
+
+The package depends on github.com/pion/webrtc/v3 and is only built with the
+pion build tag, so the turnservicecli package stays free of dependencies.
+*/
+package turnservicepion
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+)
+
+// ICEServers returns the ICE servers of credentials, see
+// turnservicecli.CredentialsData.ICEServers. Nil credentials return no ICE
+// servers.
+func ICEServers(credentials *turnservicecli.CachedCredentialsData) []webrtc.ICEServer {
+	iceServers := []webrtc.ICEServer{}
+	if credentials == nil {
+		return iceServers
+	}
+	credentials.RLock()
+	turn := credentials.Turn
+	credentials.RUnlock()
+	if turn == nil {
+		return iceServers
+	}
+	for _, server := range turn.ICEServers() {
+		iceServer := webrtc.ICEServer{
+			URLs:     server.URLs,
+			Username: server.Username,
+		}
+		if server.Credential != "" {
+			iceServer.Credential = server.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		iceServers = append(iceServers, iceServer)
+	}
+	return iceServers
+}
+
+// Config keeps a webrtc.Configuration updated with the credentials of a
+// TURNService.
+type Config struct {
+	sync.RWMutex
+
+	base    webrtc.Configuration
+	current webrtc.Configuration
+	unbind  func()
+	update  func(webrtc.Configuration)
+}
+
+// Bind returns a Config which adds the ICE servers of the credentials of
+// service to the ICE servers of base whenever new credentials become
+// available, using service.BindOnCredentials. The ICE transport policy is
+// set to relay if recommended by the credentials. The caller should call
+// Close when finished.
+func Bind(service *turnservicecli.TURNService, base webrtc.Configuration) *Config {
+	c := &Config{
+		base:    base,
+		current: base,
+	}
+	c.unbind = service.BindOnCredentials(func(credentials *turnservicecli.CachedCredentialsData, err error) {
+		if err != nil || credentials == nil {
+			return
+		}
+		c.set(credentials)
+	})
+	if credentials := service.Credentials(false); credentials != nil {
+		c.set(credentials)
+	}
+	return c
+}
+
+func (c *Config) set(credentials *turnservicecli.CachedCredentialsData) {
+	config := c.base
+	config.ICEServers = append(append([]webrtc.ICEServer(nil), c.base.ICEServers...), ICEServers(credentials)...)
+	credentials.RLock()
+	turn := credentials.Turn
+	credentials.RUnlock()
+	if turn != nil && turn.RecommendedTransportPolicy() == turnservicecli.TransportPolicyRelay {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+
+	c.Lock()
+	c.current = config
+	update := c.update
+	c.Unlock()
+	if update != nil {
+		update(config)
+	}
+}
+
+// Configuration returns the current webrtc.Configuration.
+func (c *Config) Configuration() webrtc.Configuration {
+	c.RLock()
+	defer c.RUnlock()
+	return c.current
+}
+
+// OnUpdate sets a function which is called with the updated configuration
+// whenever new credentials become available, for example to call
+// SetConfiguration of a webrtc.PeerConnection.
+func (c *Config) OnUpdate(f func(webrtc.Configuration)) {
+	c.Lock()
+	defer c.Unlock()
+	c.update = f
+}
+
+// Close stops updating the Config.
+func (c *Config) Close() {
+	c.unbind()
+}
@@ -0,0 +1,58 @@
+//go:build pion
+// +build pion
+
+package turnservicepion
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+)
+
+func TestBind(t *testing.T) {
+	server := turnservicecli.NewTestServer(&turnservicecli.CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "test", URNs: []string{"turn:turn.example.com:3478?transport=udp"}},
+		},
+	})
+	defer server.Close()
+
+	service := turnservicecli.NewTURNService(server.URL)
+	defer service.Close()
+	service.SetSynchronousHandlers(true)
+	service.Open("token", "client", "")
+
+	stun := webrtc.ICEServer{URLs: []string{"stun:stun.example.com"}}
+	config := Bind(service, webrtc.Configuration{ICEServers: []webrtc.ICEServer{stun}})
+	defer config.Close()
+	updated := make(chan webrtc.Configuration, 1)
+	config.OnUpdate(func(c webrtc.Configuration) {
+		updated <- c
+	})
+
+	if service.Credentials(true) == nil {
+		t.Fatal(service.LastError())
+	}
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("configuration was not updated")
+	}
+
+	current := config.Configuration()
+	if len(current.ICEServers) != 2 || current.ICEServers[0].URLs[0] != "stun:stun.example.com" {
+		t.Fatalf("unexpected ICE servers %+v", current.ICEServers)
+	}
+	relay := current.ICEServers[1]
+	if relay.Username != "user" || relay.Credential != "password" || relay.CredentialType != webrtc.ICECredentialTypePassword {
+		t.Errorf("unexpected relay ICE server %+v", relay)
+	}
+	if current.ICETransportPolicy != webrtc.ICETransportPolicyRelay {
+		t.Errorf("expected relay transport policy, got %v", current.ICETransportPolicy)
+	}
+}
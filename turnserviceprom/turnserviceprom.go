@@ -0,0 +1,61 @@
+//go:build prometheus
+// +build prometheus
+
+/*
+Package turnserviceprom exports the metrics of a TURNService of the
+turnservicecli package to Prometheus.
+
+The package depends on github.com/prometheus/client_golang and is only built
+with the prometheus build tag, so the turnservicecli package stays free of
+dependencies.
+*/
+package turnserviceprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+)
+
+// Collector is a prometheus.Collector of the Metrics of a TURNService.
+type Collector struct {
+	service *turnservicecli.TURNService
+
+	fetchAttempts  *prometheus.Desc
+	fetchFailures  *prometheus.Desc
+	fetchLatency   *prometheus.Desc
+	credentialsTTL *prometheus.Desc
+}
+
+// NewCollector returns a Collector of the metrics of service, named with
+// namespace and the subsystem turnservice. The constLabels are added to all
+// metrics, for example to distinguish several services.
+func NewCollector(service *turnservicecli.TURNService, namespace string, constLabels prometheus.Labels) *Collector {
+	name := func(name string) string {
+		return prometheus.BuildFQName(namespace, "turnservice", name)
+	}
+	return &Collector{
+		service: service,
+
+		fetchAttempts:  prometheus.NewDesc(name("fetch_attempts_total"), "Number of fetches of credentials.", nil, constLabels),
+		fetchFailures:  prometheus.NewDesc(name("fetch_failures_total"), "Number of failed fetches of credentials.", nil, constLabels),
+		fetchLatency:   prometheus.NewDesc(name("fetch_latency_seconds"), "Latency of fetches of credentials.", nil, constLabels),
+		credentialsTTL: prometheus.NewDesc(name("credentials_ttl_seconds"), "Remaining TTL of the cached credentials.", nil, constLabels),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.fetchAttempts
+	ch <- c.fetchFailures
+	ch <- c.fetchLatency
+	ch <- c.credentialsTTL
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	metrics := c.service.Metrics()
+	ch <- prometheus.MustNewConstMetric(c.fetchAttempts, prometheus.CounterValue, float64(metrics.FetchAttempts))
+	ch <- prometheus.MustNewConstMetric(c.fetchFailures, prometheus.CounterValue, float64(metrics.FetchFailures))
+	ch <- prometheus.MustNewConstHistogram(c.fetchLatency, metrics.FetchLatencyCount, metrics.FetchLatencySum, metrics.FetchLatencyBuckets)
+	ch <- prometheus.MustNewConstMetric(c.credentialsTTL, prometheus.GaugeValue, metrics.CredentialsTTL.Seconds())
+}
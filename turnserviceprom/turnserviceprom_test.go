@@ -0,0 +1,57 @@
+//go:build prometheus
+// +build prometheus
+
+package turnserviceprom
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/strukturag/spreed-turnservicecli/turnservicecli"
+)
+
+func TestCollector(t *testing.T) {
+	server := turnservicecli.NewTestServer(&turnservicecli.CredentialsData{
+		TTL:      3600,
+		Username: "user",
+		Password: "password",
+		Servers: []*turnservicecli.URNsWithID{
+			{ID: "test", URNs: []string{"turn:turn.example.com:3478?transport=udp"}},
+		},
+	})
+	defer server.Close()
+
+	service := turnservicecli.NewTURNService(server.URL)
+	defer service.Close()
+	service.Open("token", "client", "")
+	if service.Credentials(true) == nil {
+		t.Fatal(service.LastError())
+	}
+
+	collector := NewCollector(service, "app", prometheus.Labels{"service": "test"})
+	descs := make(chan *prometheus.Desc, 10)
+	collector.Describe(descs)
+	close(descs)
+	var names []string
+	for desc := range descs {
+		names = append(names, desc.String())
+	}
+	for _, name := range []string{"app_turnservice_fetch_attempts_total", "app_turnservice_fetch_failures_total", "app_turnservice_fetch_latency_seconds", "app_turnservice_credentials_ttl_seconds"} {
+		if !strings.Contains(strings.Join(names, " "), `"`+name+`"`) {
+			t.Errorf("expected metric %s, got %v", name, names)
+		}
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 4 {
+		t.Errorf("expected 4 metric families, got %d", len(families))
+	}
+}